@@ -0,0 +1,443 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// every annotation the injector reads lives under this prefix
+	secretAnnotationPrefix = "secrets.k8s.aws/"
+
+	// annotation turning the injector on, it never names a secret
+	injectorAnnotation = secretAnnotationPrefix + "sidecarInjectorWebhook"
+
+	// parameter store parameters are requested with annotations under
+	// this prefix, and take the same options as secrets
+	parameterAnnotationPrefix = "parameters.k8s.aws/"
+
+	// options applying to the whole pod rather than one secret live
+	// under this prefix, so they can't clash with secret names
+	injectorOptionPrefix = "injector.secrets.k8s.aws/"
+
+	// templates rendering the secrets into a file are set with
+	// annotations of the form injector.secrets.k8s.aws/template.<file>
+	templateAnnotationPrefix = injectorOptionPrefix + "template."
+)
+
+// default directory the init container writes the secrets to
+const defaultMountPath = "/tmp"
+
+// where the ConfigMap of templates is mounted in the init container
+const templateMountPath = "/etc/secrets-templates"
+
+// where the init container goes among the init containers the pod already
+// has. First lets the others use the secrets, last lets them prepare the
+// network, like a service mesh's init container does.
+const (
+	positionFirst = "first"
+	positionLast  = "last"
+)
+
+func validPosition(value string) bool {
+	return value == positionFirst || value == positionLast
+}
+
+// names of ConfigMaps, DNS subdomains
+var configMapName = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?(\.[a-z0-9]([-a-z0-9]*[a-z0-9])?)*$`)
+
+// backend the fetcher gets each annotation prefix's secrets from
+var annotationBackends = map[string]string{
+	secretAnnotationPrefix:    "secretsmanager",
+	parameterAnnotationPrefix: "ssm",
+}
+
+// per secret options are set with annotations of the form
+// secrets.k8s.aws/<name>.<option>: <value>, parameters.k8s.aws/ for
+// parameters. The values are handed to the fetcher as is, the
+// /validate-pods webhook checks them as the fetcher would.
+var secretOptions = map[string]func(ref *secretRef, value string){
+	"region":        func(ref *secretRef, value string) { ref.Region = value },
+	"role-arn":      func(ref *secretRef, value string) { ref.RoleARN = value },
+	"external-id":   func(ref *secretRef, value string) { ref.ExternalID = value },
+	"session-name":  func(ref *secretRef, value string) { ref.SessionName = value },
+	"version-stage": func(ref *secretRef, value string) { ref.VersionStage = value },
+	"version-id":    func(ref *secretRef, value string) { ref.VersionID = value },
+	"format":        func(ref *secretRef, value string) { ref.Format = value },
+	"separator":     func(ref *secretRef, value string) { ref.Separator = value },
+	"arrays":        func(ref *secretRef, value string) { ref.Arrays = value },
+	"file":          func(ref *secretRef, value string) { ref.File = value },
+	"keys":          func(ref *secretRef, value string) { ref.Keys = value },
+	"containers":    func(ref *secretRef, value string) { ref.Containers = value },
+}
+
+// secretRef is a single entry of the secrets manifest handed to the fetcher
+// in the SECRETS env var of the init container.
+type secretRef struct {
+	Name         string `json:"name"`
+	ARN          string `json:"arn"`
+	Backend      string `json:"backend,omitempty"`
+	Region       string `json:"region,omitempty"`
+	RoleARN      string `json:"roleArn,omitempty"`
+	ExternalID   string `json:"externalId,omitempty"`
+	SessionName  string `json:"sessionName,omitempty"`
+	VersionStage string `json:"versionStage,omitempty"`
+	VersionID    string `json:"versionId,omitempty"`
+	Format       string `json:"format,omitempty"`
+	Separator    string `json:"separator,omitempty"`
+	Arrays       string `json:"arrays,omitempty"`
+	Output       string `json:"output,omitempty"`
+	File         string `json:"file,omitempty"`
+	Keys         string `json:"keys,omitempty"`
+	// Containers lists the containers the secret is mounted in, it is
+	// for the webhook rather than the fetcher
+	Containers string `json:"-"`
+}
+
+// splitOption splits an annotation name into the secret name and option,
+// returning an empty option when the annotation names a secret.
+func splitOption(name string) (string, string) {
+	i := strings.LastIndex(name, ".")
+	if i < 0 {
+		return name, ""
+	}
+	if _, ok := secretOptions[name[i+1:]]; !ok {
+		return name, ""
+	}
+	return name[:i], name[i+1:]
+}
+
+// injectorOptions are the pod wide settings of the injection
+type injectorOptions struct {
+	// MountPath the secrets volume is mounted at in all the containers.
+	// Empty keeps the init container's /tmp and a random directory
+	// under /tmp in the other containers.
+	MountPath string
+	// TemplateConfigMap names a ConfigMap of templates mounted into the
+	// init container, each key rendering to the file of the same name
+	TemplateConfigMap string
+	// InitContainerPosition overrides the position of the init container
+	// set with the init-container-position flag
+	InitContainerPosition string
+	// env vars passing the options on to the fetcher
+	Env []corev1.EnvVar
+	// flags of the sidecar refreshing the secrets
+	WatchArgs []string
+	// ReloadProcess is set when the sidecar signals a process of the app
+	ReloadProcess bool
+	// FileUID and FileGID are the owner of the files, nil when unset. The
+	// fetcher runs as them so it creates the files with that owner,
+	// which needs neither root nor capabilities.
+	FileUID *int64
+	FileGID *int64
+	// FileName the export and dotenv formats write to, empty for the
+	// fetcher's default
+	FileName string
+	// Templates is set when the pod renders templates
+	Templates bool
+	// Containers the secrets are mounted in, all of the pod's when empty
+	Containers []string
+	// Resources are the requests and limits of the fetcher's containers
+	Resources corev1.ResourceRequirements
+}
+
+// templateRef is a single entry of the templates handed to the fetcher in
+// the SECRETS_TEMPLATES env var of the init container.
+type templateRef struct {
+	Template string `json:"template"`
+	Output   string `json:"output"`
+}
+
+// pod wide options and the env var each one is handed to the fetcher in,
+// along with a check of the value.
+var injectorEnvOptions = []struct {
+	option string
+	env    string
+	valid  func(string) bool
+}{
+	{"file-name", "SECRETS_OUTPUT_FILE", validFileName},
+	{"file-mode", "SECRETS_FILE_MODE", validFileMode},
+	{"file-uid", "SECRETS_FILE_UID", validID},
+	{"file-gid", "SECRETS_FILE_GID", validID},
+}
+
+// options of the sidecar refreshing the secrets and the flag each one is
+// handed to it as, along with a check of the value.
+var watchOptions = []struct {
+	option string
+	flag   string
+	valid  func(string) bool
+}{
+	{"refresh-interval", "--refresh-interval", validInterval},
+	{"check-version", "--check-version", validBool},
+	{"reload-process", "--reload-process", validProcessName},
+	{"reload-signal", "--reload-signal", validSignal},
+	{"reload-url", "--reload-url", validURL},
+}
+
+func validInterval(value string) bool {
+	interval, err := time.ParseDuration(value)
+	return err == nil && interval > 0
+}
+
+func validBool(value string) bool {
+	_, err := strconv.ParseBool(value)
+	return err == nil
+}
+
+func validProcessName(value string) bool {
+	return value != "" && !strings.ContainsAny(value, "/\x00")
+}
+
+// the signals the fetcher can send to reload the app
+var reloadSignals = map[string]bool{"HUP": true, "USR1": true, "USR2": true, "INT": true, "QUIT": true, "TERM": true}
+
+func validSignal(value string) bool {
+	return reloadSignals[strings.TrimPrefix(strings.ToUpper(value), "SIG")]
+}
+
+func validURL(value string) bool {
+	u, err := url.Parse(value)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+func validFileName(value string) bool {
+	clean := path.Clean(value)
+	return value != "" && !path.IsAbs(clean) && clean != "." && clean != ".." && !strings.HasPrefix(clean, "../")
+}
+
+func validFileMode(value string) bool {
+	mode, err := strconv.ParseUint(value, 8, 32)
+	return err == nil && mode <= 0777
+}
+
+func validID(value string) bool {
+	id, err := strconv.Atoi(value)
+	return err == nil && id >= 0
+}
+
+// parseInjectorOptions reads the pod wide options from the pod's
+// annotations. Unknown options are an error so typos don't go unnoticed.
+func parseInjectorOptions(annotations map[string]string) (injectorOptions, error) {
+	var opts injectorOptions
+	known := map[string]bool{"mount-path": true, "template-configmap": true, "init-container-position": true, "containers": true}
+	for _, o := range resourceOptions {
+		known[o.option] = true
+	}
+	for _, o := range injectorEnvOptions {
+		known[o.option] = true
+		value, ok := annotations[injectorOptionPrefix+o.option]
+		if !ok {
+			continue
+		}
+		if !o.valid(value) {
+			return opts, fmt.Errorf("invalid value %q for %s%s", value, injectorOptionPrefix, o.option)
+		}
+		opts.Env = append(opts.Env, corev1.EnvVar{Name: o.env, Value: value})
+		if o.option == "file-uid" || o.option == "file-gid" {
+			id, _ := strconv.ParseInt(value, 10, 64)
+			if o.option == "file-uid" {
+				opts.FileUID = &id
+			} else {
+				opts.FileGID = &id
+			}
+		}
+		if o.option == "file-name" {
+			opts.FileName = value
+		}
+	}
+	for _, o := range watchOptions {
+		known[o.option] = true
+		value, ok := annotations[injectorOptionPrefix+o.option]
+		if !ok {
+			continue
+		}
+		if !o.valid(value) {
+			return opts, fmt.Errorf("invalid value %q for %s%s", value, injectorOptionPrefix, o.option)
+		}
+		opts.WatchArgs = append(opts.WatchArgs, o.flag+"="+value)
+		if o.option == "reload-process" {
+			opts.ReloadProcess = true
+		}
+	}
+	for _, annotation := range sortedAnnotations(annotations) {
+		if strings.HasPrefix(annotation, injectorOptionPrefix) && !strings.HasPrefix(annotation, templateAnnotationPrefix) &&
+			!known[strings.TrimPrefix(annotation, injectorOptionPrefix)] {
+			return opts, fmt.Errorf("unknown option %s", annotation)
+		}
+	}
+
+	if mountPath, ok := annotations[injectorOptionPrefix+"mount-path"]; ok {
+		clean := path.Clean(mountPath)
+		if !path.IsAbs(mountPath) || clean == "/" || strings.ContainsAny(mountPath, ":\"\\\x00") {
+			return opts, fmt.Errorf("invalid value %q for %smount-path, expected an absolute path without quotes or colons", mountPath, injectorOptionPrefix)
+		}
+		opts.MountPath = clean
+		opts.Env = append(opts.Env, corev1.EnvVar{Name: "SECRETS_OUTPUT_DIR", Value: clean})
+	}
+
+	if position, ok := annotations[injectorOptionPrefix+"init-container-position"]; ok {
+		if !validPosition(position) {
+			return opts, fmt.Errorf("invalid value %q for %sinit-container-position, expected %s or %s", position, injectorOptionPrefix, positionFirst, positionLast)
+		}
+		opts.InitContainerPosition = position
+	}
+
+	resources, err := podResources(annotations)
+	if err != nil {
+		return opts, err
+	}
+	opts.Resources = resources
+
+	// the fetcher runs as the owner of the files, which the restricted
+	// security context doesn't allow to be root
+	if restrictedContext && opts.FileUID != nil && *opts.FileUID == 0 {
+		return opts, fmt.Errorf("%sfile-uid 0 would run the secrets containers as root, which the webhook's restricted security context doesn't allow", injectorOptionPrefix)
+	}
+
+	if list, ok := annotations[injectorOptionPrefix+"containers"]; ok {
+		containers, err := parseContainerList(list)
+		if err != nil {
+			return opts, fmt.Errorf("invalid value %q for %scontainers: %v", list, injectorOptionPrefix, err)
+		}
+		opts.Containers = containers
+	}
+
+	templates, err := parseTemplateAnnotations(annotations)
+	if err != nil {
+		return opts, err
+	}
+	if len(templates) > 0 {
+		opts.Templates = true
+		list, err := json.Marshal(templates)
+		if err != nil {
+			return opts, err
+		}
+		opts.Env = append(opts.Env, corev1.EnvVar{Name: "SECRETS_TEMPLATES", Value: string(list)})
+	}
+	if name, ok := annotations[injectorOptionPrefix+"template-configmap"]; ok {
+		if len(name) > 253 || !configMapName.MatchString(name) {
+			return opts, fmt.Errorf("invalid value %q for %stemplate-configmap, expected a ConfigMap name", name, injectorOptionPrefix)
+		}
+		opts.TemplateConfigMap = name
+		opts.Templates = true
+		opts.Env = append(opts.Env, corev1.EnvVar{Name: "SECRETS_TEMPLATE_DIR", Value: templateMountPath})
+	}
+	return opts, nil
+}
+
+// parseContainerList parses a comma separated list of container names
+func parseContainerList(list string) ([]string, error) {
+	var containers []string
+	seen := map[string]bool{}
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			return nil, fmt.Errorf("empty container name")
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("container %s is listed twice", name)
+		}
+		seen[name] = true
+		containers = append(containers, name)
+	}
+	return containers, nil
+}
+
+// parseTemplateAnnotations collects the templates set by the pod's
+// annotations, sorted by file so the init container is the same every
+// time. The fetcher parses the templates.
+func parseTemplateAnnotations(annotations map[string]string) ([]templateRef, error) {
+	var templates []templateRef
+	for _, annotation := range sortedAnnotations(annotations) {
+		value := annotations[annotation]
+		if !strings.HasPrefix(annotation, templateAnnotationPrefix) {
+			continue
+		}
+		output := strings.TrimPrefix(annotation, templateAnnotationPrefix)
+		if !validFileName(output) {
+			return nil, fmt.Errorf("invalid template file %q in %s", output, annotation)
+		}
+		templates = append(templates, templateRef{Template: value, Output: output})
+	}
+	sort.Slice(templates, func(i, j int) bool { return templates[i].Output < templates[j].Output })
+	return templates, nil
+}
+
+// annotationPrefix returns the prefix of annotations naming secrets or
+// parameters, or an empty string for any other annotation.
+func annotationPrefix(annotation string) string {
+	for prefix := range annotationBackends {
+		if strings.HasPrefix(annotation, prefix) && annotation != injectorAnnotation {
+			return prefix
+		}
+	}
+	return ""
+}
+
+// parseSecretAnnotations collects the secrets and parameters and their
+// options requested by the pod's annotations. Secrets and parameters share
+// the one namespace of names. The secrets are sorted by annotation, so the
+// manifest handed to the fetcher, and the errors, are the same at every
+// admission of the pod.
+func parseSecretAnnotations(annotations map[string]string) ([]secretRef, error) {
+	var refs []secretRef
+	index := map[string]int{}
+	options := map[string]map[string]string{}
+	prefixes := map[string]string{}
+	var names []string
+
+	for _, annotation := range sortedAnnotations(annotations) {
+		value := annotations[annotation]
+		prefix := annotationPrefix(annotation)
+		if prefix == "" {
+			continue
+		}
+		name, option := splitOption(strings.TrimPrefix(annotation, prefix))
+		if other, ok := prefixes[name]; ok && other != prefix {
+			return nil, fmt.Errorf("%q is set as both %s%s and %s%s", name, other, name, prefix, name)
+		}
+		prefixes[name] = prefix
+		if option != "" {
+			if options[name] == nil {
+				options[name] = map[string]string{}
+				names = append(names, name)
+			}
+			options[name][option] = value
+			continue
+		}
+		index[name] = len(refs)
+		refs = append(refs, secretRef{Name: name, ARN: value, Backend: annotationBackends[prefix]})
+	}
+
+	for _, name := range names {
+		i, ok := index[name]
+		if !ok {
+			return nil, fmt.Errorf("annotations set options for secret %q but %s%s is not set", name, prefixes[name], name)
+		}
+		for option, value := range options[name] {
+			secretOptions[option](&refs[i], value)
+		}
+	}
+
+	return refs, nil
+}
+
+// sortedAnnotations returns the names of the annotations in a stable order
+func sortedAnnotations(annotations map[string]string) []string {
+	names := make([]string, 0, len(annotations))
+	for annotation := range annotations {
+		names = append(names, annotation)
+	}
+	sort.Strings(names)
+	return names
+}
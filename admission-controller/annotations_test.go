@@ -0,0 +1,234 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestParseSecretAnnotations(t *testing.T) {
+	testCases := []struct {
+		name        string
+		annotations map[string]string
+		expected    []secretRef
+		err         bool
+	}{
+		{
+			name: "secrets and parameters",
+			annotations: map[string]string{
+				injectorAnnotation:                   "true",
+				"secrets.k8s.aws/db":                 "arn:aws:secretsmanager:us-east-1:123456789012:secret:db-AbCdEf",
+				"secrets.k8s.aws/db.format":          "dotenv",
+				"parameters.k8s.aws/app":             "/app/prod/*",
+				"parameters.k8s.aws/app.region":      "eu-west-1",
+				"injector.secrets.k8s.aws/file-name": "app.env",
+				"other.example.com/annotation":       "ignored",
+			},
+			expected: []secretRef{
+				{Name: "app", ARN: "/app/prod/*", Backend: "ssm", Region: "eu-west-1"},
+				{Name: "db", ARN: "arn:aws:secretsmanager:us-east-1:123456789012:secret:db-AbCdEf", Backend: "secretsmanager", Format: "dotenv"},
+			},
+		},
+		{
+			name: "dotted secret names",
+			annotations: map[string]string{
+				"secrets.k8s.aws/db.prod": "db",
+			},
+			expected: []secretRef{{Name: "db.prod", ARN: "db", Backend: "secretsmanager"}},
+		},
+		{
+			name: "selected keys",
+			annotations: map[string]string{
+				"secrets.k8s.aws/db":       "db#password=DB_PASSWORD,username=DB_USER",
+				"secrets.k8s.aws/api":      "api",
+				"secrets.k8s.aws/api.keys": "token=API_TOKEN",
+			},
+			expected: []secretRef{
+				{Name: "api", ARN: "api", Backend: "secretsmanager", Keys: "token=API_TOKEN"},
+				{Name: "db", ARN: "db#password=DB_PASSWORD,username=DB_USER", Backend: "secretsmanager"},
+			},
+		},
+		{
+			name: "name used for a secret and a parameter",
+			annotations: map[string]string{
+				"secrets.k8s.aws/db":    "db",
+				"parameters.k8s.aws/db": "/db",
+			},
+			err: true,
+		},
+		{
+			name: "options for a missing secret",
+			annotations: map[string]string{
+				"secrets.k8s.aws/db.format": "json",
+			},
+			err: true,
+		},
+	}
+	for _, testcase := range testCases {
+		refs, err := parseSecretAnnotations(testcase.annotations)
+		if testcase.err {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %+v", testcase.name, refs)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", testcase.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(refs, testcase.expected) {
+			t.Errorf("%s:\nexpected %+v\n, got %+v", testcase.name, testcase.expected, refs)
+		}
+	}
+}
+
+func TestInjectionIsDeterministic(t *testing.T) {
+	sidecarImage = "test-image"
+	annotations := map[string]string{"injector.secrets.k8s.aws/mount-path": "/secrets"}
+	for i := 0; i < 20; i++ {
+		annotations[fmt.Sprintf("secrets.k8s.aws/s%02d", i)] = fmt.Sprintf("arn:%d", i)
+		annotations[fmt.Sprintf("secrets.k8s.aws/s%02d.format", i)] = "json"
+		annotations[fmt.Sprintf("parameters.k8s.aws/p%02d", i)] = fmt.Sprintf("/p/%d", i)
+		annotations[fmt.Sprintf("injector.secrets.k8s.aws/template.t%02d", i)] = "{{ .s00 }}"
+	}
+	var first *corev1.Pod
+	for i := 0; i < 20; i++ {
+		// a fresh map iterates in another order
+		copied := map[string]string{}
+		for k, v := range annotations {
+			copied[k] = v
+		}
+		pod := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Annotations: copied},
+			Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "app"}}},
+		}
+		if err := injectSecrets(pod); err != nil {
+			t.Fatal(err)
+		}
+		if first == nil {
+			first = pod
+			continue
+		}
+		if !reflect.DeepEqual(pod.Spec.InitContainers, first.Spec.InitContainers) {
+			t.Fatalf("expected the same init container at every admission, got\n%+v\nand\n%+v", first.Spec.InitContainers, pod.Spec.InitContainers)
+		}
+	}
+
+	refs, err := parseSecretAnnotations(annotations)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// parameters.k8s.aws/ sorts before secrets.k8s.aws/
+	for i, ref := range refs {
+		expected := fmt.Sprintf("p%02d", i)
+		if i >= 20 {
+			expected = fmt.Sprintf("s%02d", i-20)
+		}
+		if ref.Name != expected {
+			t.Errorf("expected %s at %d, got %s", expected, i, ref.Name)
+		}
+	}
+
+	// with several mistakes the same one is reported every time
+	broken := map[string]string{}
+	for i := 0; i < 10; i++ {
+		broken[fmt.Sprintf("secrets.k8s.aws/s%d.format", i)] = "json"
+	}
+	_, expected := parseSecretAnnotations(broken)
+	for i := 0; i < 20; i++ {
+		if _, err := parseSecretAnnotations(broken); err == nil || err.Error() != expected.Error() {
+			t.Fatalf("expected %v, got %v", expected, err)
+		}
+	}
+}
+
+func TestParseInjectorOptions(t *testing.T) {
+	opts, err := parseInjectorOptions(map[string]string{
+		"injector.secrets.k8s.aws/mount-path": "/var/run/secrets/app/",
+		"injector.secrets.k8s.aws/file-name":  "app.env",
+		"injector.secrets.k8s.aws/file-mode":  "0440",
+		"injector.secrets.k8s.aws/file-uid":   "1000",
+		"injector.secrets.k8s.aws/file-gid":   "2000",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	uid, gid := int64(1000), int64(2000)
+	expected := injectorOptions{
+		MountPath: "/var/run/secrets/app",
+		FileUID:   &uid,
+		FileGID:   &gid,
+		FileName:  "app.env",
+		Env: []corev1.EnvVar{
+			{Name: "SECRETS_OUTPUT_FILE", Value: "app.env"},
+			{Name: "SECRETS_FILE_MODE", Value: "0440"},
+			{Name: "SECRETS_FILE_UID", Value: "1000"},
+			{Name: "SECRETS_FILE_GID", Value: "2000"},
+			{Name: "SECRETS_OUTPUT_DIR", Value: "/var/run/secrets/app"},
+		},
+	}
+	if !reflect.DeepEqual(opts, expected) {
+		t.Errorf("expected %+v, got %+v", expected, opts)
+	}
+
+	opts, err = parseInjectorOptions(map[string]string{
+		"injector.secrets.k8s.aws/template.pgpass":    "{{ .db.host }}:5432:*:{{ .db.username }}:{{ .db.password }}",
+		"injector.secrets.k8s.aws/template.app.conf":  "url={{ .api.url }}",
+		"injector.secrets.k8s.aws/template-configmap": "app-templates",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = injectorOptions{
+		TemplateConfigMap: "app-templates",
+		Templates:         true,
+		Env: []corev1.EnvVar{
+			{Name: "SECRETS_TEMPLATES", Value: `[{"template":"url={{ .api.url }}","output":"app.conf"},` +
+				`{"template":"{{ .db.host }}:5432:*:{{ .db.username }}:{{ .db.password }}","output":"pgpass"}]`},
+			{Name: "SECRETS_TEMPLATE_DIR", Value: "/etc/secrets-templates"},
+		},
+	}
+	if !reflect.DeepEqual(opts, expected) {
+		t.Errorf("expected %+v, got %+v", expected, opts)
+	}
+
+	opts, err = parseInjectorOptions(map[string]string{
+		"injector.secrets.k8s.aws/refresh-interval": "90s",
+		"injector.secrets.k8s.aws/check-version":    "false",
+		"injector.secrets.k8s.aws/reload-signal":    "SIGUSR1",
+		"injector.secrets.k8s.aws/reload-url":       "http://localhost:8080/-/reload",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = injectorOptions{
+		WatchArgs: []string{"--refresh-interval=90s", "--check-version=false", "--reload-signal=SIGUSR1", "--reload-url=http://localhost:8080/-/reload"},
+	}
+	if !reflect.DeepEqual(opts, expected) {
+		t.Errorf("expected %+v, got %+v", expected, opts)
+	}
+
+	for _, invalid := range []map[string]string{
+		{"injector.secrets.k8s.aws/refresh-interval": "0s"},
+		{"injector.secrets.k8s.aws/check-version": "maybe"},
+		{"injector.secrets.k8s.aws/reload-process": "/usr/bin/app"},
+		{"injector.secrets.k8s.aws/reload-signal": "KILL"},
+		{"injector.secrets.k8s.aws/reload-url": "localhost:8080"},
+		{"injector.secrets.k8s.aws/mount-path": "relative"},
+		{"injector.secrets.k8s.aws/mount-path": "/"},
+		{"injector.secrets.k8s.aws/mount-path": `/tmp/"quoted"`},
+		{"injector.secrets.k8s.aws/file-name": "../etc/passwd"},
+		{"injector.secrets.k8s.aws/file-mode": "rw-r--r--"},
+		{"injector.secrets.k8s.aws/file-uid": "app"},
+		{"injector.secrets.k8s.aws/mount-paht": "/secrets"},
+		{"injector.secrets.k8s.aws/template..": "x"},
+		{"injector.secrets.k8s.aws/template-configmap": "App_Templates"},
+	} {
+		if _, err := parseInjectorOptions(invalid); err == nil {
+			t.Errorf("%v: expected an error", invalid)
+		}
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// settings of the containers running the fetcher, set by the flags
+var (
+	// fetcherResources are the requests and limits of the containers,
+	// which pods may change with annotations
+	fetcherResources corev1.ResourceRequirements
+	// maxResources bound the requests and limits set by pods, a resource
+	// left out is unbounded
+	maxResources corev1.ResourceList
+	// fetcherPullPolicy is the containers' imagePullPolicy, empty for the
+	// cluster's default
+	fetcherPullPolicy corev1.PullPolicy
+	// fetcherPullSecrets are added to the pod's imagePullSecrets
+	fetcherPullSecrets []corev1.LocalObjectReference
+	// restrictedContext runs the containers as the PodSecurity restricted
+	// profile requires
+	restrictedContext bool
+	// restrictedUser is the user the containers run as in the restricted
+	// context, unless the pod sets its own
+	restrictedUser int64
+)
+
+// seccompProfileType is the seccomp profile of the restricted context
+const seccompProfileType = "RuntimeDefault"
+
+// the resources the fetcher's containers are sized by
+var fetcherResourceNames = []corev1.ResourceName{corev1.ResourceCPU, corev1.ResourceMemory}
+
+// pod wide options overriding the requests and limits of the containers
+var resourceOptions = []struct {
+	option   string
+	resource corev1.ResourceName
+	limit    bool
+}{
+	{"cpu-request", corev1.ResourceCPU, false},
+	{"memory-request", corev1.ResourceMemory, false},
+	{"cpu-limit", corev1.ResourceCPU, true},
+	{"memory-limit", corev1.ResourceMemory, true},
+}
+
+// parseQuantities parses the quantities of the resources, leaving out the
+// empty ones. It returns nil when all are empty.
+func parseQuantities(quantities map[corev1.ResourceName]string) (corev1.ResourceList, error) {
+	var list corev1.ResourceList
+	for _, name := range fetcherResourceNames {
+		value := quantities[name]
+		if value == "" {
+			continue
+		}
+		quantity, err := resource.ParseQuantity(value)
+		if err != nil || quantity.Sign() <= 0 {
+			return nil, fmt.Errorf("invalid %s quantity %q", name, value)
+		}
+		if list == nil {
+			list = corev1.ResourceList{}
+		}
+		list[name] = quantity
+	}
+	return list, nil
+}
+
+// checkResources returns an error for a request above its limit, or a
+// request or limit above the maximum.
+func checkResources(resources corev1.ResourceRequirements) error {
+	for _, name := range fetcherResourceNames {
+		request, hasRequest := resources.Requests[name]
+		limit, hasLimit := resources.Limits[name]
+		if hasRequest && hasLimit && request.Cmp(limit) > 0 {
+			return fmt.Errorf("the %s request %s is above the limit %s", name, request.String(), limit.String())
+		}
+		max, ok := maxResources[name]
+		if !ok {
+			continue
+		}
+		if hasRequest && request.Cmp(max) > 0 {
+			return fmt.Errorf("the %s request %s is above the maximum %s", name, request.String(), max.String())
+		}
+		if hasLimit && limit.Cmp(max) > 0 {
+			return fmt.Errorf("the %s limit %s is above the maximum %s", name, limit.String(), max.String())
+		}
+	}
+	return nil
+}
+
+// podResources returns the requests and limits of the containers, those
+// set by the pod's annotations replacing the flags'.
+func podResources(annotations map[string]string) (corev1.ResourceRequirements, error) {
+	resources := *fetcherResources.DeepCopy()
+	for _, o := range resourceOptions {
+		value, ok := annotations[injectorOptionPrefix+o.option]
+		if !ok {
+			continue
+		}
+		quantity, err := resource.ParseQuantity(value)
+		if err != nil || quantity.Sign() <= 0 {
+			return resources, fmt.Errorf("invalid value %q for %s%s, expected a quantity like 100m or 64Mi", value, injectorOptionPrefix, o.option)
+		}
+		list := &resources.Requests
+		if o.limit {
+			list = &resources.Limits
+		}
+		if *list == nil {
+			*list = corev1.ResourceList{}
+		}
+		(*list)[o.resource] = quantity
+	}
+	if err := checkResources(resources); err != nil {
+		return resources, fmt.Errorf("invalid resources for the secrets containers: %v", err)
+	}
+	return resources, nil
+}
+
+// parsePullSecrets parses a comma separated list of secret names
+func parsePullSecrets(list string) ([]corev1.LocalObjectReference, error) {
+	var secrets []corev1.LocalObjectReference
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if len(name) > 253 || !configMapName.MatchString(name) {
+			return nil, fmt.Errorf("invalid secret name %q", name)
+		}
+		secrets = append(secrets, corev1.LocalObjectReference{Name: name})
+	}
+	return secrets, nil
+}
+
+func validPullPolicy(value string) bool {
+	switch corev1.PullPolicy(value) {
+	case "", corev1.PullAlways, corev1.PullIfNotPresent, corev1.PullNever:
+		return true
+	}
+	return false
+}
+
+// addPullSecrets adds the pull secrets of the fetcher's image the pod
+// doesn't have yet
+func addPullSecrets(pod *corev1.Pod) {
+	for _, secret := range fetcherPullSecrets {
+		found := false
+		for _, existing := range pod.Spec.ImagePullSecrets {
+			if existing.Name == secret.Name {
+				found = true
+				break
+			}
+		}
+		if !found {
+			pod.Spec.ImagePullSecrets = append(pod.Spec.ImagePullSecrets, secret)
+		}
+	}
+}
+
+// fetcherSecurityContext returns the security context of the fetcher's
+// containers in the pod, nil to leave it to the pod's.
+func fetcherSecurityContext(pod *corev1.Pod, opts injectorOptions) *corev1.SecurityContext {
+	var context *corev1.SecurityContext
+	if restrictedContext {
+		nonRoot, readOnly, escalation := true, true, false
+		context = &corev1.SecurityContext{
+			RunAsNonRoot:             &nonRoot,
+			ReadOnlyRootFilesystem:   &readOnly,
+			AllowPrivilegeEscalation: &escalation,
+			Capabilities:             &corev1.Capabilities{Drop: []corev1.Capability{"ALL"}},
+		}
+		// the fetcher's image runs as root unless told otherwise
+		if pod.Spec.SecurityContext == nil || pod.Spec.SecurityContext.RunAsUser == nil {
+			user := restrictedUser
+			context.RunAsUser = &user
+		}
+	}
+	// the files are given to another user or group by creating them as
+	// that user and group, rather than changing their owner as root
+	if opts.FileUID != nil || opts.FileGID != nil {
+		if context == nil {
+			context = &corev1.SecurityContext{}
+		}
+		if opts.FileUID != nil {
+			user := *opts.FileUID
+			context.RunAsUser = &user
+		}
+		if opts.FileGID != nil {
+			group := *opts.FileGID
+			context.RunAsGroup = &group
+		}
+	}
+	return context
+}
+
+// setSeccompProfiles sets the seccomp profile of the restricted context
+// on the fetcher's containers of a pod or pod template encoded as JSON.
+// The k8s.io/api version we build with predates the seccompProfile field
+// of security contexts, the annotations it has instead being ignored by
+// the PodSecurity admission.
+func setSeccompProfiles(podJSON interface{}) {
+	if !restrictedContext {
+		return
+	}
+	pod, _ := podJSON.(map[string]interface{})
+	spec, _ := pod["spec"].(map[string]interface{})
+	for _, field := range []string{"initContainers", "containers"} {
+		containers, _ := spec[field].([]interface{})
+		for _, c := range containers {
+			container, _ := c.(map[string]interface{})
+			if container == nil || (container["name"] != initContainerName && container["name"] != sidecarContainerName) {
+				continue
+			}
+			context, _ := container["securityContext"].(map[string]interface{})
+			if context == nil {
+				context = map[string]interface{}{}
+				container["securityContext"] = context
+			}
+			context["seccompProfile"] = map[string]interface{}{"type": seccompProfileType}
+		}
+	}
+}
+
+// configureContainers sets the settings of the containers from the flags
+func configureContainers() error {
+	requests, err := parseQuantities(map[corev1.ResourceName]string{corev1.ResourceCPU: cpuRequest, corev1.ResourceMemory: memoryRequest})
+	if err != nil {
+		return fmt.Errorf("invalid requests: %v", err)
+	}
+	limits, err := parseQuantities(map[corev1.ResourceName]string{corev1.ResourceCPU: cpuLimit, corev1.ResourceMemory: memoryLimit})
+	if err != nil {
+		return fmt.Errorf("invalid limits: %v", err)
+	}
+	maxResources, err = parseQuantities(map[corev1.ResourceName]string{corev1.ResourceCPU: maxCPU, corev1.ResourceMemory: maxMemory})
+	if err != nil {
+		return fmt.Errorf("invalid maximums: %v", err)
+	}
+	fetcherResources = corev1.ResourceRequirements{Requests: requests, Limits: limits}
+	if err := checkResources(fetcherResources); err != nil {
+		return fmt.Errorf("invalid resources: %v", err)
+	}
+	if !validPullPolicy(imagePullPolicy) {
+		return fmt.Errorf("invalid image-pull-policy %q, expected Always, IfNotPresent or Never", imagePullPolicy)
+	}
+	fetcherPullPolicy = corev1.PullPolicy(imagePullPolicy)
+	if fetcherPullSecrets, err = parsePullSecrets(imagePullSecrets); err != nil {
+		return fmt.Errorf("invalid image-pull-secrets: %v", err)
+	}
+	if restrictedUser <= 0 {
+		return fmt.Errorf("invalid restricted-run-as-user %d, expected a user other than root", restrictedUser)
+	}
+	return nil
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	v1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func TestPodResources(t *testing.T) {
+	defer func(resources corev1.ResourceRequirements, max corev1.ResourceList) {
+		fetcherResources, maxResources = resources, max
+	}(fetcherResources, maxResources)
+	fetcherResources = corev1.ResourceRequirements{
+		Requests: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("10m"), corev1.ResourceMemory: resource.MustParse("32Mi")},
+		Limits:   corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("100m"), corev1.ResourceMemory: resource.MustParse("64Mi")},
+	}
+	maxResources = corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("256Mi")}
+
+	testCases := []struct {
+		name        string
+		annotations map[string]string
+		requests    map[corev1.ResourceName]string
+		limits      map[corev1.ResourceName]string
+		err         string
+	}{
+		{
+			name:     "defaults",
+			requests: map[corev1.ResourceName]string{corev1.ResourceCPU: "10m", corev1.ResourceMemory: "32Mi"},
+			limits:   map[corev1.ResourceName]string{corev1.ResourceCPU: "100m", corev1.ResourceMemory: "64Mi"},
+		},
+		{
+			name: "overrides",
+			annotations: map[string]string{
+				"injector.secrets.k8s.aws/memory-request": "128Mi",
+				"injector.secrets.k8s.aws/memory-limit":   "256Mi",
+				"injector.secrets.k8s.aws/cpu-limit":      "2",
+			},
+			requests: map[corev1.ResourceName]string{corev1.ResourceCPU: "10m", corev1.ResourceMemory: "128Mi"},
+			limits:   map[corev1.ResourceName]string{corev1.ResourceCPU: "2", corev1.ResourceMemory: "256Mi"},
+		},
+		{
+			name:        "above the maximum",
+			annotations: map[string]string{"injector.secrets.k8s.aws/memory-limit": "1Gi"},
+			err:         "the memory limit 1Gi is above the maximum 256Mi",
+		},
+		{
+			name:        "request above the limit",
+			annotations: map[string]string{"injector.secrets.k8s.aws/cpu-request": "200m"},
+			err:         "the cpu request 200m is above the limit 100m",
+		},
+		{
+			name:        "invalid quantity",
+			annotations: map[string]string{"injector.secrets.k8s.aws/cpu-limit": "fast"},
+			err:         `invalid value "fast" for injector.secrets.k8s.aws/cpu-limit`,
+		},
+		{
+			name:        "negative quantity",
+			annotations: map[string]string{"injector.secrets.k8s.aws/memory-request": "-1Mi"},
+			err:         `invalid value "-1Mi" for injector.secrets.k8s.aws/memory-request`,
+		},
+	}
+	for _, testcase := range testCases {
+		opts, err := parseInjectorOptions(testcase.annotations)
+		if testcase.err != "" {
+			if err == nil || !strings.Contains(err.Error(), testcase.err) {
+				t.Errorf("%s: expected error %q, got %v", testcase.name, testcase.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", testcase.name, err)
+			continue
+		}
+		for list, expected := range map[*corev1.ResourceList]map[corev1.ResourceName]string{&opts.Resources.Requests: testcase.requests, &opts.Resources.Limits: testcase.limits} {
+			for name, value := range expected {
+				if quantity := (*list)[name]; quantity.Cmp(resource.MustParse(value)) != 0 {
+					t.Errorf("%s: expected %s of %s, got %s", testcase.name, name, value, quantity.String())
+				}
+			}
+		}
+	}
+	if !reflect.DeepEqual(fetcherResources.Requests[corev1.ResourceMemory], resource.MustParse("32Mi")) {
+		t.Errorf("expected the overrides to leave the defaults alone, got %+v", fetcherResources)
+	}
+}
+
+func TestConfigureContainers(t *testing.T) {
+	defer func() {
+		cpuRequest, cpuLimit, maxMemory, memoryLimit, imagePullPolicy, imagePullSecrets = "", "", "", "", "", ""
+		restrictedUser = 65534
+		if err := configureContainers(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	cpuRequest, cpuLimit, maxMemory, imagePullPolicy, imagePullSecrets = "10m", "100m", "128Mi", "IfNotPresent", "registry, mirror"
+	if err := configureContainers(); err != nil {
+		t.Fatal(err)
+	}
+	if fetcherPullPolicy != corev1.PullIfNotPresent || !reflect.DeepEqual(fetcherPullSecrets, []corev1.LocalObjectReference{{Name: "registry"}, {Name: "mirror"}}) {
+		t.Errorf("expected the pull settings to be set, got %q and %v", fetcherPullPolicy, fetcherPullSecrets)
+	}
+
+	for name, set := range map[string]func(){
+		"request above the limit": func() { cpuRequest = "1" },
+		"limit above the maximum": func() { memoryLimit = "1Gi" },
+		"invalid quantity":        func() { cpuLimit = "fast" },
+		"invalid pull policy":     func() { imagePullPolicy = "Sometimes" },
+		"invalid pull secret":     func() { imagePullSecrets = "Registry" },
+		"root user":               func() { restrictedUser = 0 },
+	} {
+		cpuRequest, cpuLimit, maxMemory, memoryLimit, imagePullPolicy, imagePullSecrets = "10m", "100m", "128Mi", "", "", ""
+		restrictedUser = 65534
+		set()
+		if err := configureContainers(); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+// mutatedContainers injects the sidecar into the pod, returning the
+// patched pod and the JSON security context of each of its containers,
+// with the fields the k8s.io/api types don't have.
+func mutatedContainers(t *testing.T, pod corev1.Pod) (corev1.Pod, map[string]interface{}) {
+	raw, err := json.Marshal(pod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response := mutatePodsSidecar(v1.AdmissionReview{Request: &v1.AdmissionRequest{
+		Resource: metav1.GroupVersionResource{Version: "v1", Resource: "pods"},
+		Object:   runtime.RawExtension{Raw: raw},
+	}})
+	if !response.Allowed || response.PatchType == nil {
+		t.Fatalf("expected a patch, got %+v", response)
+	}
+	var ops []patchOperation
+	if err := json.Unmarshal(response.Patch, &ops); err != nil {
+		t.Fatal(err)
+	}
+	patched := corev1.Pod{}
+	applyRawPatch(t, raw, ops, &patched)
+	contexts := map[string]interface{}{}
+	var patchedJSON struct {
+		Spec struct {
+			InitContainers []map[string]interface{}
+			Containers     []map[string]interface{}
+		}
+	}
+	applyRawPatch(t, raw, ops, &patchedJSON)
+	for _, c := range append(patchedJSON.Spec.InitContainers, patchedJSON.Spec.Containers...) {
+		contexts[c["name"].(string)] = c["securityContext"]
+	}
+	return patched, contexts
+}
+
+func TestInjectedContainerSettings(t *testing.T) {
+	sidecarImage = "test-image"
+	defer func() {
+		restrictedContext, fetcherPullPolicy, fetcherPullSecrets = false, "", nil
+	}()
+	restrictedContext = true
+	restrictedUser = 65534
+	fetcherPullPolicy = corev1.PullAlways
+	fetcherPullSecrets = []corev1.LocalObjectReference{{Name: "registry"}, {Name: "mirror"}}
+
+	pod := corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{"secrets.k8s.aws/db": "db"}},
+		Spec: corev1.PodSpec{
+			ImagePullSecrets: []corev1.LocalObjectReference{{Name: "registry"}},
+			Containers:       []corev1.Container{{Name: "app", Image: "app"}},
+		},
+	}
+	patched, contexts := mutatedContainers(t, pod)
+	if !reflect.DeepEqual(patched.Spec.ImagePullSecrets, []corev1.LocalObjectReference{{Name: "registry"}, {Name: "mirror"}}) {
+		t.Errorf("expected the missing pull secret to be added, got %v", patched.Spec.ImagePullSecrets)
+	}
+	fetchers := []corev1.Container{patched.Spec.InitContainers[0], patched.Spec.Containers[1]}
+	for _, c := range fetchers {
+		if c.ImagePullPolicy != corev1.PullAlways {
+			t.Errorf("%s: expected pull policy Always, got %q", c.Name, c.ImagePullPolicy)
+		}
+		sc := c.SecurityContext
+		if sc == nil || sc.RunAsNonRoot == nil || !*sc.RunAsNonRoot || sc.RunAsUser == nil || *sc.RunAsUser != 65534 ||
+			sc.ReadOnlyRootFilesystem == nil || !*sc.ReadOnlyRootFilesystem ||
+			sc.AllowPrivilegeEscalation == nil || *sc.AllowPrivilegeEscalation ||
+			sc.Capabilities == nil || !reflect.DeepEqual(sc.Capabilities.Drop, []corev1.Capability{"ALL"}) {
+			t.Errorf("%s: expected the restricted context, got %+v", c.Name, sc)
+		}
+		context, _ := contexts[c.Name].(map[string]interface{})
+		if !reflect.DeepEqual(context["seccompProfile"], map[string]interface{}{"type": "RuntimeDefault"}) {
+			t.Errorf("%s: expected the RuntimeDefault seccomp profile, got %v", c.Name, contexts[c.Name])
+		}
+	}
+	if patched.Spec.Containers[0].SecurityContext != nil || contexts["app"] != nil {
+		t.Errorf("expected the app's security context to be left alone, got %v", contexts["app"])
+	}
+
+	// the pod's user is kept, and the owner of the files is the user and
+	// group the fetchers run as, the rest of the restricted context kept
+	user := int64(1000)
+	pod.Spec.SecurityContext = &corev1.PodSecurityContext{RunAsUser: &user}
+	patched, _ = mutatedContainers(t, pod)
+	if sc := patched.Spec.InitContainers[0].SecurityContext; sc.RunAsUser != nil {
+		t.Errorf("expected the pod's user, got %d", *sc.RunAsUser)
+	}
+	pod.Annotations["injector.secrets.k8s.aws/file-uid"] = "2000"
+	pod.Annotations["injector.secrets.k8s.aws/file-gid"] = "3000"
+	patched, contexts = mutatedContainers(t, pod)
+	for _, c := range []corev1.Container{patched.Spec.InitContainers[0], patched.Spec.Containers[1]} {
+		sc := c.SecurityContext
+		if *sc.RunAsUser != 2000 || sc.RunAsGroup == nil || *sc.RunAsGroup != 3000 || !*sc.RunAsNonRoot || !*sc.ReadOnlyRootFilesystem ||
+			!reflect.DeepEqual(sc.Capabilities.Drop, []corev1.Capability{"ALL"}) || len(sc.Capabilities.Add) != 0 {
+			t.Errorf("%s: expected the owner of the files with the restricted context otherwise, got %+v", c.Name, sc)
+		}
+		if context, _ := contexts[c.Name].(map[string]interface{}); context["seccompProfile"] == nil {
+			t.Errorf("%s: expected the seccomp profile to be kept, got %v", c.Name, context)
+		}
+	}
+
+	// files owned by root would need the fetchers to run as root
+	pod.Annotations["injector.secrets.k8s.aws/file-uid"] = "0"
+	if err := injectSecrets(pod.DeepCopy()); err == nil || !strings.Contains(err.Error(), "file-uid 0") {
+		t.Errorf("expected files owned by root to be denied, got %v", err)
+	}
+	response := validatePods(podReview(t, pod.Annotations))
+	if response.Allowed || !strings.Contains(response.Result.Message, "restricted security context") {
+		t.Errorf("expected the validation to deny files owned by root, got %+v", response)
+	}
+}
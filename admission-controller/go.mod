@@ -3,10 +3,13 @@ module github.com/amit0701/adm-controller
 go 1.13
 
 require (
+	github.com/evanphx/json-patch v4.2.0+incompatible
+	github.com/google/gofuzz v1.1.0
 	github.com/google/ko v0.4.0
-	github.com/google/uuid v1.2.0 // indirect
+	github.com/google/uuid v1.2.0
 	k8s.io/api v0.18.0
 	k8s.io/apiextensions-apiserver v0.18.0
 	k8s.io/apimachinery v0.18.0
 	k8s.io/klog v1.0.0
+	sigs.k8s.io/yaml v1.2.0
 )
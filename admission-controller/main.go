@@ -22,13 +22,12 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"time"
 
 	v1 "k8s.io/api/admission/v1"
 	"k8s.io/api/admission/v1beta1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/klog"
-	// TODO: try this library to see if it generates correct json patch
-	// https://github.com/mattbaird/jsonpatch
 )
 
 var (
@@ -36,6 +35,20 @@ var (
 	keyFile  string
 	port     int
         sidecarImage string
+	secretsManagerEndpoint string
+	ssmEndpoint            string
+	stsEndpoint            string
+	initContainerPosition  string
+	policyFile             string
+	policyReloadInterval   time.Duration
+	cpuRequest             string
+	memoryRequest          string
+	cpuLimit               string
+	memoryLimit            string
+	maxCPU                 string
+	maxMemory              string
+	imagePullPolicy        string
+	imagePullSecrets       string
 )
 
 func init() {
@@ -47,6 +60,38 @@ func init() {
 		"Secure port that the webhook listens on")
         flag.StringVar(&sidecarImage, "sidecar-image", "",
 		"Image to be used as the injected sidecar")
+	flag.StringVar(&secretsManagerEndpoint, "secretsmanager-endpoint", "",
+		"Secrets Manager endpoint URL the injected containers use, like a VPC endpoint. {region} is replaced by the secret's region.")
+	flag.StringVar(&ssmEndpoint, "ssm-endpoint", "",
+		"SSM endpoint URL the injected containers fetch parameters from.")
+	flag.StringVar(&stsEndpoint, "sts-endpoint", "",
+		"STS endpoint URL the injected containers use to assume roles.")
+	flag.StringVar(&initContainerPosition, "init-container-position", positionFirst,
+		"Where the secrets init container goes among the pod's init containers, first or last.")
+	flag.StringVar(&policyFile, "policy-file", "",
+		"YAML file of the secrets pods may ask for by namespace, service account and labels. Every secret is allowed without one.")
+	flag.DurationVar(&policyReloadInterval, "policy-reload-interval", 30*time.Second,
+		"How often the policy file is checked for changes.")
+	flag.StringVar(&cpuRequest, "cpu-request", "",
+		"CPU request of the injected containers, which pods may change with annotations.")
+	flag.StringVar(&memoryRequest, "memory-request", "",
+		"Memory request of the injected containers, which pods may change with annotations.")
+	flag.StringVar(&cpuLimit, "cpu-limit", "",
+		"CPU limit of the injected containers, which pods may change with annotations.")
+	flag.StringVar(&memoryLimit, "memory-limit", "",
+		"Memory limit of the injected containers, which pods may change with annotations.")
+	flag.StringVar(&maxCPU, "max-cpu", "",
+		"Highest CPU request or limit pods may set for the injected containers. Unbounded when empty.")
+	flag.StringVar(&maxMemory, "max-memory", "",
+		"Highest memory request or limit pods may set for the injected containers. Unbounded when empty.")
+	flag.StringVar(&imagePullPolicy, "image-pull-policy", "",
+		"imagePullPolicy of the injected containers, Always, IfNotPresent or Never.")
+	flag.StringVar(&imagePullSecrets, "image-pull-secrets", "",
+		"Comma separated secrets added to the imagePullSecrets of the pods to pull the injected image.")
+	flag.BoolVar(&restrictedContext, "restricted-security-context", false,
+		"Run the injected containers as the PodSecurity restricted profile requires: non-root, read-only root filesystem, no capabilities and the RuntimeDefault seccomp profile.")
+	flag.Int64Var(&restrictedUser, "restricted-run-as-user", 65534,
+		"User the injected containers run as with --restricted-security-context, unless the pod sets runAsUser.")
 
 }
 
@@ -60,6 +105,9 @@ type admitv1Func func(v1.AdmissionReview) *v1.AdmissionResponse
 type admitHandler struct {
 	v1beta1 admitv1beta1Func
 	v1      admitv1Func
+	// warnings, when set, returns the warnings added to allowed and denied
+	// responses alike
+	warnings func(v1.AdmissionReview) []string
 }
 
 func newDelegateToV1AdmitHandler(f admitv1Func) admitHandler {
@@ -106,6 +154,7 @@ func serve(w http.ResponseWriter, r *http.Request, admit admitHandler) {
 	}
 
 	var responseObj runtime.Object
+	var request v1.AdmissionReview
 	switch *gvk {
 	case v1beta1.SchemeGroupVersion.WithKind("AdmissionReview"):
 		requestedAdmissionReview, ok := obj.(*v1beta1.AdmissionReview)
@@ -118,6 +167,7 @@ func serve(w http.ResponseWriter, r *http.Request, admit admitHandler) {
 		responseAdmissionReview.Response = admit.v1beta1(*requestedAdmissionReview)
 		responseAdmissionReview.Response.UID = requestedAdmissionReview.Request.UID
 		responseObj = responseAdmissionReview
+		request.Request = convertAdmissionRequestToV1(requestedAdmissionReview.Request)
 	case v1.SchemeGroupVersion.WithKind("AdmissionReview"):
 		requestedAdmissionReview, ok := obj.(*v1.AdmissionReview)
 		if !ok {
@@ -129,6 +179,7 @@ func serve(w http.ResponseWriter, r *http.Request, admit admitHandler) {
 		responseAdmissionReview.Response = admit.v1(*requestedAdmissionReview)
 		responseAdmissionReview.Response.UID = requestedAdmissionReview.Request.UID
 		responseObj = responseAdmissionReview
+		request = *requestedAdmissionReview
 	default:
 		msg := fmt.Sprintf("Unsupported group version kind: %v", gvk)
 		klog.Error(msg)
@@ -143,6 +194,13 @@ func serve(w http.ResponseWriter, r *http.Request, admit admitHandler) {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	if admit.warnings != nil {
+		if respBytes, err = addWarnings(respBytes, admit.warnings(request)); err != nil {
+			klog.Error(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
 	w.Header().Set("Content-Type", "application/json")
 	if _, err := w.Write(respBytes); err != nil {
 		klog.Error(err)
@@ -150,6 +208,50 @@ func serve(w http.ResponseWriter, r *http.Request, admit admitHandler) {
 }
 
 
+// addWarnings sets the warnings of a marshalled admission review. The
+// AdmissionResponse of the k8s.io/api version we build with predates its
+// Warnings field, which API servers from 1.19 show to the user.
+func addWarnings(review []byte, warnings []string) ([]byte, error) {
+	if len(warnings) == 0 {
+		return review, nil
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(review, &fields); err != nil {
+		return nil, err
+	}
+	var response map[string]interface{}
+	if err := json.Unmarshal(fields["response"], &response); err != nil {
+		return nil, err
+	}
+	response["warnings"] = warnings
+	raw, err := json.Marshal(response)
+	if err != nil {
+		return nil, err
+	}
+	fields["response"] = raw
+	return json.Marshal(fields)
+}
+
+func serveValidatePods(w http.ResponseWriter, r *http.Request) {
+	handler := newDelegateToV1AdmitHandler(validatePods)
+	handler.warnings = podWarnings
+	serve(w, r, handler)
+}
+
+func serveValidateWorkloads(w http.ResponseWriter, r *http.Request) {
+	handler := newDelegateToV1AdmitHandler(validateWorkloads)
+	handler.warnings = workloadWarnings
+	serve(w, r, handler)
+}
+
+func servePreviewWorkloads(w http.ResponseWriter, r *http.Request) {
+	serve(w, r, newDelegateToV1AdmitHandler(previewWorkloads))
+}
+
+func servePreviewWorkloadsSidecar(w http.ResponseWriter, r *http.Request) {
+	serve(w, r, newDelegateToV1AdmitHandler(previewWorkloadsSidecar))
+}
+
 func serveMutatePods(w http.ResponseWriter, r *http.Request) {
 	serve(w, r, newDelegateToV1AdmitHandler(mutatePods))
 }
@@ -164,12 +266,30 @@ func main() {
 	loggingFlags := &flag.FlagSet{}
 	klog.InitFlags(loggingFlags)
 	flag.Parse()
+	if !validPosition(initContainerPosition) {
+		klog.Fatalf("invalid init-container-position %q, expected %s or %s", initContainerPosition, positionFirst, positionLast)
+	}
+	if err := configureContainers(); err != nil {
+		klog.Fatal(err)
+	}
+	if policyFile != "" {
+		loader, err := newPolicyLoader(policyFile)
+		if err != nil {
+			klog.Fatal(err)
+		}
+		injectionPolicy = loader
+		go loader.watch(policyReloadInterval, nil)
+	}
 
 	config := Config{
 		CertFile: certFile,
 		KeyFile:  keyFile,
 	}
 
+	http.HandleFunc("/validate-pods", serveValidatePods)
+	http.HandleFunc("/validate-workloads", serveValidateWorkloads)
+	http.HandleFunc("/preview-workloads", servePreviewWorkloads)
+	http.HandleFunc("/preview-workloads-sidecar", servePreviewWorkloadsSidecar)
 	http.HandleFunc("/mutating-pods", serveMutatePods)
         http.HandleFunc("/mutating-pods-sidecar", serveMutatePodsSidecar)
 	http.HandleFunc("/readyz", func(w http.ResponseWriter, req *http.Request) { w.Write([]byte("ok")) })
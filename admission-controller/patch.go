@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// patchOperation is a single RFC 6902 JSON patch operation
+type patchOperation struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	Value interface{} `json:"value"`
+}
+
+// MarshalJSON leaves the value out of remove operations only, add and
+// replace need one even when it is null.
+func (op patchOperation) MarshalJSON() ([]byte, error) {
+	if op.Op == "remove" {
+		return json.Marshal(struct {
+			Op   string `json:"op"`
+			Path string `json:"path"`
+		}{op.Op, op.Path})
+	}
+	type operation patchOperation
+	return json.Marshal(operation(op))
+}
+
+// createPatch returns the JSON patch turning original into desired. Both
+// go through the same JSON encoding, so only what the mutator changed on
+// desired shows up in the patch. The edits change the encoded desired,
+// for fields its type doesn't have.
+func createPatch(original, desired interface{}, edits ...func(interface{})) ([]patchOperation, error) {
+	from, err := toJSONValue(original)
+	if err != nil {
+		return nil, err
+	}
+	to, err := toJSONValue(desired)
+	if err != nil {
+		return nil, err
+	}
+	for _, edit := range edits {
+		edit(to)
+	}
+	ops := []patchOperation{}
+	diffJSON("", from, to, &ops)
+	return ops, nil
+}
+
+// toJSONValue turns an object into the maps, slices and scalars it is
+// encoded as in JSON.
+func toJSONValue(obj interface{}) (interface{}, error) {
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return nil, err
+	}
+	var value interface{}
+	err = json.Unmarshal(data, &value)
+	return value, err
+}
+
+// diffJSON appends the operations turning from into to, both at path.
+// Objects are diffed key by key and arrays element by element, elements
+// being added or removed at the end, so appending to an array only adds
+// the new elements. Elements put in front of an array are added there.
+func diffJSON(path string, from, to interface{}, ops *[]patchOperation) {
+	switch fromValue := from.(type) {
+	case map[string]interface{}:
+		toValue, ok := to.(map[string]interface{})
+		if !ok {
+			break
+		}
+		for _, key := range sortedJSONKeys(fromValue) {
+			if _, ok := toValue[key]; !ok {
+				*ops = append(*ops, patchOperation{Op: "remove", Path: path + "/" + escapePointer(key)})
+			}
+		}
+		for _, key := range sortedJSONKeys(toValue) {
+			if old, ok := fromValue[key]; ok {
+				diffJSON(path+"/"+escapePointer(key), old, toValue[key], ops)
+			} else {
+				*ops = append(*ops, patchOperation{Op: "add", Path: path + "/" + escapePointer(key), Value: toValue[key]})
+			}
+		}
+		return
+	case []interface{}:
+		toValue, ok := to.([]interface{})
+		if !ok {
+			break
+		}
+		// elements put in front are added there rather than replacing
+		// every element after them
+		if inserted := len(toValue) - len(fromValue); inserted > 0 && reflect.DeepEqual(toValue[inserted:], fromValue) {
+			for i := 0; i < inserted; i++ {
+				*ops = append(*ops, patchOperation{Op: "add", Path: path + "/" + strconv.Itoa(i), Value: toValue[i]})
+			}
+			return
+		}
+		common := len(fromValue)
+		if len(toValue) < common {
+			common = len(toValue)
+		}
+		for i := 0; i < common; i++ {
+			diffJSON(path+"/"+strconv.Itoa(i), fromValue[i], toValue[i], ops)
+		}
+		// removed from the end first so the indexes stay valid
+		for i := len(fromValue) - 1; i >= common; i-- {
+			*ops = append(*ops, patchOperation{Op: "remove", Path: path + "/" + strconv.Itoa(i)})
+		}
+		for i := common; i < len(toValue); i++ {
+			*ops = append(*ops, patchOperation{Op: "add", Path: path + "/" + strconv.Itoa(i), Value: toValue[i]})
+		}
+		return
+	}
+	if !reflect.DeepEqual(from, to) {
+		*ops = append(*ops, patchOperation{Op: "replace", Path: path, Value: to})
+	}
+}
+
+func sortedJSONKeys(object map[string]interface{}) []string {
+	keys := make([]string, 0, len(object))
+	for key := range object {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// escapePointer escapes a key for use in a JSON pointer, annotation keys
+// being full of slashes.
+func escapePointer(key string) string {
+	return strings.NewReplacer("~", "~0", "/", "~1").Replace(key)
+}
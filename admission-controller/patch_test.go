@@ -19,121 +19,199 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"math/rand"
 	"reflect"
 	"testing"
 
 	jsonpatch "github.com/evanphx/json-patch"
+	v1 "k8s.io/api/admission/v1"
 	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
 )
 
+// applyPatch applies the operations to the JSON of obj and decodes the
+// result into into.
+func applyPatch(t *testing.T, obj interface{}, ops []patchOperation, into interface{}) {
+	t.Helper()
+	objJS, err := json.Marshal(obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	applyRawPatch(t, objJS, ops, into)
+}
+
+func applyRawPatch(t *testing.T, objJS []byte, ops []patchOperation, into interface{}) {
+	t.Helper()
+	patchJS, err := json.Marshal(ops)
+	if err != nil {
+		t.Fatal(err)
+	}
+	patchObj, err := jsonpatch.DecodePatch(patchJS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	patchedJS, err := patchObj.Apply(objJS)
+	if err != nil {
+		t.Fatalf("%v\npatch: %s\nobject: %s", err, patchJS, objJS)
+	}
+	if err := json.Unmarshal(patchedJS, into); err != nil {
+		t.Fatal(err)
+	}
+}
+
 func TestPatches(t *testing.T) {
 	sidecarImage = "test-image"
+	shareProcessNamespace := true
 	testCases := []struct {
-		patch    string
-		initial  interface{}
-		expected interface{}
-		toTest   interface{}
+		mutate   func(*corev1.Pod) error
+		initial  corev1.Pod
+		expected *corev1.Pod
 	}{
 		{
-			patch: configMapPatch1,
-			initial: corev1.ConfigMap{
-				Data: map[string]string{
-					"mutation-start": "yes",
+			mutate: addSidecar,
+			initial: corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{
+						"secrets.k8s.aws/db":                        "db",
+						"injector.secrets.k8s.aws/mount-path":       "/secrets",
+						"injector.secrets.k8s.aws/refresh-interval": "1m",
+						"injector.secrets.k8s.aws/reload-process":   "nginx",
+					},
 				},
-			},
-			expected: &corev1.ConfigMap{
-				Data: map[string]string{
-					"mutation-start":   "yes",
-					"mutation-stage-1": "yes",
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{{Name: "app", Image: "app"}},
 				},
 			},
-		},
-		{
-			patch: configMapPatch2,
-			initial: corev1.ConfigMap{
-				Data: map[string]string{
-					"mutation-start": "yes",
+			expected: &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{
+						"secrets.k8s.aws/db":                        "db",
+						"injector.secrets.k8s.aws/mount-path":       "/secrets",
+						"injector.secrets.k8s.aws/refresh-interval": "1m",
+						"injector.secrets.k8s.aws/reload-process":   "nginx",
+					},
 				},
-			},
-			expected: &corev1.ConfigMap{
-				Data: map[string]string{
-					"mutation-start":   "yes",
-					"mutation-stage-2": "yes",
+				Spec: corev1.PodSpec{
+					InitContainers: []corev1.Container{{
+						Name:         "secrets-init-container",
+						Image:        sidecarImage,
+						VolumeMounts: []corev1.VolumeMount{{Name: "secret-vol", MountPath: "/secrets"}},
+						Env: []corev1.EnvVar{
+							{Name: "SECRETS", Value: `[{"name":"db","arn":"db","backend":"secretsmanager"}]`},
+							{Name: "SECRETS_OUTPUT_DIR", Value: "/secrets"},
+						},
+					}},
+					Containers: []corev1.Container{
+						{
+							Name:         "app",
+							Image:        "app",
+							VolumeMounts: []corev1.VolumeMount{{Name: "secret-vol", MountPath: "/secrets"}},
+							Env:          []corev1.EnvVar{{Name: "SEC_LOC", Value: "/secrets"}},
+						},
+						{
+							Name:         "webhook-added-sidecar",
+							Image:        sidecarImage,
+							Args:         []string{"--watch", "--refresh-interval=1m", "--reload-process=nginx"},
+							VolumeMounts: []corev1.VolumeMount{{Name: "secret-vol", MountPath: "/secrets"}},
+							Env: []corev1.EnvVar{
+								{Name: "SECRETS", Value: `[{"name":"db","arn":"db","backend":"secretsmanager"}]`},
+								{Name: "SECRETS_OUTPUT_DIR", Value: "/secrets"},
+							},
+						},
+					},
+					Volumes: []corev1.Volume{{
+						Name:         "secret-vol",
+						VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{Medium: corev1.StorageMediumMemory}},
+					}},
+					ShareProcessNamespace: &shareProcessNamespace,
 				},
 			},
 		},
-
 		{
-			patch: podsInitContainerPatch,
+			// the init container is already there, only the sidecar
+			// is added
+			mutate: addSidecar,
 			initial: corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{"secrets.k8s.aws/db": "db"}},
 				Spec: corev1.PodSpec{
-					InitContainers: []corev1.Container{},
+					InitContainers: []corev1.Container{{Name: "secrets-init-container", Image: sidecarImage}},
+					Containers:     []corev1.Container{{Name: "app", Image: "app"}},
 				},
 			},
 			expected: &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{"secrets.k8s.aws/db": "db"}},
 				Spec: corev1.PodSpec{
-					InitContainers: []corev1.Container{
+					InitContainers: []corev1.Container{{Name: "secrets-init-container", Image: sidecarImage}},
+					Containers: []corev1.Container{
+						{Name: "app", Image: "app"},
 						{
-							Image:     "webhook-added-image",
-							Name:      "webhook-added-init-container",
-							Resources: corev1.ResourceRequirements{},
+							Name:         "webhook-added-sidecar",
+							Image:        sidecarImage,
+							Args:         []string{"--watch"},
+							VolumeMounts: []corev1.VolumeMount{{Name: "secret-vol", MountPath: "/tmp"}},
+							Env:          []corev1.EnvVar{{Name: "SECRETS", Value: `[{"name":"db","arn":"db","backend":"secretsmanager"}]`}},
 						},
 					},
 				},
 			},
 		},
 		{
-			patch: fmt.Sprintf(podsSidecarPatch, sidecarImage),
+			mutate: injectSecrets,
 			initial: corev1.Pod{
-				Spec: corev1.PodSpec{
-					Containers: []corev1.Container{
-						{
-							Image:     "image1",
-							Name:      "container1",
-							Resources: corev1.ResourceRequirements{},
-						},
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{
+						"secrets.k8s.aws/db":                  `db#password="quoted"`,
+						"injector.secrets.k8s.aws/mount-path": "/secrets",
 					},
 				},
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{{Name: "app", Image: "app"}},
+				},
 			},
 			expected: &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{
+						"secrets.k8s.aws/db":                  `db#password="quoted"`,
+						"injector.secrets.k8s.aws/mount-path": "/secrets",
+					},
+				},
 				Spec: corev1.PodSpec{
-					Containers: []corev1.Container{
-						{
-							Image:     "image1",
-							Name:      "container1",
-							Resources: corev1.ResourceRequirements{},
-						},
-						{
-							Image:     sidecarImage,
-							Name:      "webhook-added-sidecar",
-							Resources: corev1.ResourceRequirements{},
+					InitContainers: []corev1.Container{{
+						Name:         "secrets-init-container",
+						Image:        sidecarImage,
+						VolumeMounts: []corev1.VolumeMount{{Name: "secret-vol", MountPath: "/secrets"}},
+						Env: []corev1.EnvVar{
+							{Name: "SECRETS", Value: `[{"name":"db","arn":"db#password=\"quoted\"","backend":"secretsmanager"}]`},
+							{Name: "SECRETS_OUTPUT_DIR", Value: "/secrets"},
 						},
-					},
+					}},
+					Containers: []corev1.Container{{
+						Name:         "app",
+						Image:        "app",
+						VolumeMounts: []corev1.VolumeMount{{Name: "secret-vol", MountPath: "/secrets"}},
+						Env:          []corev1.EnvVar{{Name: "SEC_LOC", Value: "/secrets"}},
+					}},
+					Volumes: []corev1.Volume{{
+						Name:         "secret-vol",
+						VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{Medium: corev1.StorageMediumMemory}},
+					}},
 				},
 			},
 		},
 	}
 	for _, testcase := range testCases {
-		objJS, err := json.Marshal(testcase.initial)
-		if err != nil {
-			t.Fatal(err)
-		}
-		patchObj, err := jsonpatch.DecodePatch([]byte(testcase.patch))
-		if err != nil {
-			t.Fatal(err)
-		}
-
-		patchedJS, err := patchObj.Apply(objJS)
-		if err != nil {
+		desired := testcase.initial.DeepCopy()
+		if err := testcase.mutate(desired); err != nil {
 			t.Fatal(err)
 		}
-		objType := reflect.TypeOf(testcase.initial)
-		objTest := reflect.New(objType).Interface()
-		err = json.Unmarshal(patchedJS, objTest)
+		ops, err := createPatch(&testcase.initial, desired)
 		if err != nil {
 			t.Fatal(err)
 		}
+		objTest := &corev1.Pod{}
+		applyPatch(t, testcase.initial, ops, objTest)
 		if !reflect.DeepEqual(objTest, testcase.expected) {
 			t.Errorf("\nexpected %#v\n, got %#v", testcase.expected, objTest)
 		}
@@ -141,6 +219,49 @@ func TestPatches(t *testing.T) {
 
 }
 
+func TestInjectSecretsChown(t *testing.T) {
+	sidecarImage = "test-image"
+	nonRoot := true
+	user := int64(1000)
+	pod := corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{
+			"secrets.k8s.aws/db":                "db",
+			"injector.secrets.k8s.aws/file-uid": "2000",
+			"injector.secrets.k8s.aws/file-gid": "3000",
+		}},
+		Spec: corev1.PodSpec{
+			SecurityContext: &corev1.PodSecurityContext{RunAsUser: &user, RunAsNonRoot: &nonRoot},
+			Containers:      []corev1.Container{{Name: "app", Image: "app"}},
+		},
+	}
+	if err := addSidecar(&pod); err != nil {
+		t.Fatal(err)
+	}
+	// both fetchers run as the owner of the files, so they create them
+	// with that owner without root or capabilities, the app keeps the
+	// pod's user
+	for _, c := range append(pod.Spec.InitContainers, pod.Spec.Containers[1]) {
+		sc := c.SecurityContext
+		if sc == nil || sc.RunAsUser == nil || *sc.RunAsUser != 2000 || sc.RunAsGroup == nil || *sc.RunAsGroup != 3000 {
+			t.Errorf("%s: expected to run as the owner of the files, got %+v", c.Name, sc)
+		} else if sc.RunAsNonRoot != nil || sc.Capabilities != nil {
+			t.Errorf("%s: expected neither root nor capabilities, got %+v", c.Name, sc)
+		}
+	}
+	if pod.Spec.Containers[0].SecurityContext != nil {
+		t.Errorf("expected the app's security context to be left alone, got %+v", pod.Spec.Containers[0].SecurityContext)
+	}
+
+	pod.Annotations = map[string]string{"secrets.k8s.aws/db": "db"}
+	pod.Spec.InitContainers = nil
+	if err := injectSecrets(&pod); err != nil {
+		t.Fatal(err)
+	}
+	if sc := pod.Spec.InitContainers[0].SecurityContext; sc != nil {
+		t.Errorf("expected the pod's user without file-uid or file-gid, got %+v", sc)
+	}
+}
+
 func TestJSONPatchForUnstructured(t *testing.T) {
 	cr := &unstructured.Unstructured{
 		Object: map[string]interface{}{
@@ -148,33 +269,374 @@ func TestJSONPatchForUnstructured(t *testing.T) {
 			"apiVersion": "somegroup/v1",
 			"data": map[string]interface{}{
 				"mutation-start": "yes",
+				"a/b~c":          "escaped",
+				"cleared":        "yes",
 			},
 		},
 	}
-	crJS, err := json.Marshal(cr)
+	desired := cr.DeepCopy()
+	desired.Object["data"] = map[string]interface{}{
+		"mutation-start":   "yes",
+		"mutation-stage-1": "yes",
+		"cleared":          nil,
+		"added":            nil,
+	}
+	ops, err := createPatch(cr, desired)
 	if err != nil {
 		t.Fatal(err)
 	}
+	patchedObj := unstructured.Unstructured{}
+	applyPatch(t, cr, ops, &patchedObj)
+	expectedData := map[string]interface{}{
+		"mutation-start":   "yes",
+		"mutation-stage-1": "yes",
+		"cleared":          nil,
+		"added":            nil,
+	}
+
+	if !reflect.DeepEqual(patchedObj.Object["data"], expectedData) {
+		t.Errorf("\nexpected %#v\n, got %#v", expectedData, patchedObj.Object["data"])
+	}
 
-	patchObj, err := jsonpatch.DecodePatch([]byte(configMapPatch1))
+	// null values are kept, only removals have no value
+	patchJS, err := json.Marshal(ops)
 	if err != nil {
 		t.Fatal(err)
 	}
-	patchedJS, err := patchObj.Apply(crJS)
-	if err != nil {
+	var raw []map[string]interface{}
+	if err := json.Unmarshal(patchJS, &raw); err != nil {
 		t.Fatal(err)
 	}
-	patchedObj := unstructured.Unstructured{}
-	err = json.Unmarshal(patchedJS, &patchedObj)
-	if err != nil {
+	for _, op := range raw {
+		if _, ok := op["value"]; ok == (op["op"] == "remove") {
+			t.Errorf("unexpected value in %v", op)
+		}
+	}
+}
+
+// randomString returns a short string, now and then with characters which
+// need escaping in JSON or JSON pointers.
+func randomString(r *rand.Rand) string {
+	const chars = `abcxyz019-._/~"\`
+	b := make([]byte, 1+r.Intn(8))
+	for i := range b {
+		b[i] = chars[r.Intn(len(chars))]
+	}
+	return string(b)
+}
+
+// randomPod builds a pod of a random shape: any number of containers and
+// init containers, with or without env, volume mounts and volumes, and
+// with secret annotations whose values are full of quotes.
+func randomPod(r *rand.Rand) corev1.Pod {
+	pod := corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "pod", Annotations: map[string]string{}},
+	}
+	for i := r.Intn(4); i >= 0; i-- {
+		pod.Annotations[fmt.Sprintf("secrets.k8s.aws/s%d", i)] = "arn:" + randomString(r)
+	}
+	for i := r.Intn(3); i > 0; i-- {
+		pod.Annotations["example.com/"+randomString(r)] = randomString(r)
+	}
+	container := func(name string) corev1.Container {
+		c := corev1.Container{Name: name, Image: randomString(r)}
+		for i := r.Intn(3); i > 0; i-- {
+			c.Env = append(c.Env, corev1.EnvVar{Name: fmt.Sprintf("ENV%d", i), Value: randomString(r)})
+		}
+		for i := r.Intn(3); i > 0; i-- {
+			c.VolumeMounts = append(c.VolumeMounts, corev1.VolumeMount{Name: fmt.Sprintf("vol%d", i), MountPath: "/" + randomString(r)})
+		}
+		return c
+	}
+	for i := r.Intn(4); i >= 0; i-- {
+		pod.Spec.Containers = append(pod.Spec.Containers, container(fmt.Sprintf("app%d", i)))
+	}
+	for i := r.Intn(3); i > 0; i-- {
+		pod.Spec.InitContainers = append(pod.Spec.InitContainers, container(fmt.Sprintf("init%d", i)))
+	}
+	for i := r.Intn(3); i > 0; i-- {
+		pod.Spec.Volumes = append(pod.Spec.Volumes, corev1.Volume{
+			Name:         fmt.Sprintf("vol%d", i),
+			VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}},
+		})
+	}
+	return pod
+}
+
+// randomMutation changes the pod in one of the ways a diff has to handle:
+// removals, replacements and additions at any depth.
+func randomMutation(r *rand.Rand, pod *corev1.Pod) {
+	switch r.Intn(5) {
+	case 0:
+		pod.Spec.Containers = pod.Spec.Containers[:r.Intn(len(pod.Spec.Containers))]
+	case 1:
+		pod.Spec.Containers[0].Image = randomString(r)
+	case 2:
+		pod.Spec.InitContainers = append([]corev1.Container{{Name: "first", Image: randomString(r)}}, pod.Spec.InitContainers...)
+	case 3:
+		pod.Annotations = nil
+	case 4:
+		pod.Labels = map[string]string{randomString(r): randomString(r)}
+	}
+}
+
+func TestPatchesApplyToRandomPods(t *testing.T) {
+	sidecarImage = "test-image"
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 500; i++ {
+		pod := randomPod(r)
+		for _, mutate := range []func(*corev1.Pod) error{
+			injectSecrets,
+			addSidecar,
+			func(pod *corev1.Pod) error { randomMutation(r, pod); return nil },
+		} {
+			desired := pod.DeepCopy()
+			if err := mutate(desired); err != nil {
+				t.Fatal(err)
+			}
+			ops, err := createPatch(&pod, desired)
+			if err != nil {
+				t.Fatal(err)
+			}
+			patched := &corev1.Pod{}
+			applyPatch(t, pod, ops, patched)
+			if !reflect.DeepEqual(patched, desired) {
+				t.Fatalf("pod %d:\nexpected %#v\n, got %#v", i, desired, patched)
+			}
+		}
+	}
+}
+
+func TestMutatePods(t *testing.T) {
+	sidecarImage = "test-image"
+	r := rand.New(rand.NewSource(2))
+	for i := 0; i < 100; i++ {
+		pod := randomPod(r)
+		raw, err := json.Marshal(pod)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response := mutatePods(v1.AdmissionReview{Request: &v1.AdmissionRequest{
+			Resource: metav1.GroupVersionResource{Version: "v1", Resource: "pods"},
+			Object:   runtime.RawExtension{Raw: raw},
+		}})
+		if !response.Allowed || response.PatchType == nil {
+			t.Fatalf("pod %d: expected a patch, got %+v", i, response)
+		}
+		var ops []patchOperation
+		if err := json.Unmarshal(response.Patch, &ops); err != nil {
+			t.Fatal(err)
+		}
+		patched := &corev1.Pod{}
+		applyRawPatch(t, raw, ops, patched)
+
+		if n := len(patched.Spec.InitContainers); n != len(pod.Spec.InitContainers)+1 || patched.Spec.InitContainers[0].Name != initContainerName {
+			t.Errorf("pod %d: expected the init container to be added first to %+v", i, patched.Spec.InitContainers)
+		} else if len(pod.Spec.InitContainers) > 0 && !reflect.DeepEqual(patched.Spec.InitContainers[1:], pod.Spec.InitContainers) {
+			t.Errorf("pod %d: existing init containers changed to %+v", i, patched.Spec.InitContainers[1:])
+		}
+		if n := len(patched.Spec.Volumes); n != len(pod.Spec.Volumes)+1 || patched.Spec.Volumes[n-1].Name != secretsVolumeName {
+			t.Errorf("pod %d: expected the secrets volume to be added to %+v", i, patched.Spec.Volumes)
+		}
+		for j, c := range patched.Spec.Containers {
+			original := pod.Spec.Containers[j]
+			if len(c.Env) != len(original.Env)+1 || c.Env[len(c.Env)-1].Name != "SEC_LOC" {
+				t.Errorf("pod %d: expected SEC_LOC to be added to %+v", i, c.Env)
+			}
+			if len(c.VolumeMounts) != len(original.VolumeMounts)+1 || c.VolumeMounts[len(c.VolumeMounts)-1].Name != secretsVolumeName {
+				t.Errorf("pod %d: expected the secrets to be mounted in %+v", i, c.VolumeMounts)
+			}
+		}
+		if !reflect.DeepEqual(patched.Annotations, pod.Annotations) {
+			t.Errorf("pod %d: annotations changed to %v", i, patched.Annotations)
+		}
+	}
+}
+
+func TestInitContainerPosition(t *testing.T) {
+	sidecarImage = "test-image"
+	defer func(position string) { initContainerPosition = position }(initContainerPosition)
+	existing := corev1.Container{Name: "istio-init", Image: "proxy"}
+	for combination := 0; combination < 1<<5; combination++ {
+		has := func(bit uint) bool { return combination&(1<<bit) != 0 }
+		pod := corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{"secrets.k8s.aws/db": "arn:db"}},
+			Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "app", Image: "app"}}},
+		}
+		if has(0) {
+			pod.Spec.Containers[0].Env = []corev1.EnvVar{{Name: "A", Value: "a"}}
+		}
+		if has(1) {
+			pod.Spec.Volumes = []corev1.Volume{{Name: "data"}}
+			pod.Spec.Containers[0].VolumeMounts = []corev1.VolumeMount{{Name: "data", MountPath: "/data"}}
+		}
+		if has(2) {
+			pod.Spec.InitContainers = []corev1.Container{existing}
+		}
+		// the position comes from the flag, or from the annotation
+		// overriding the other position given to the flag
+		position := positionFirst
+		if has(3) {
+			position = positionLast
+		}
+		initContainerPosition = position
+		if has(4) {
+			initContainerPosition = positionFirst
+			if position == positionFirst {
+				initContainerPosition = positionLast
+			}
+			pod.Annotations["injector.secrets.k8s.aws/init-container-position"] = position
+		}
+		name := fmt.Sprintf("env=%v,volumes=%v,init=%v,position=%s,annotation=%v", has(0), has(1), has(2), position, has(4))
+
+		desired := pod.DeepCopy()
+		if err := injectSecrets(desired); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		ops, err := createPatch(&pod, desired)
+		if err != nil {
+			t.Fatal(err)
+		}
+		patched := &corev1.Pod{}
+		applyPatch(t, pod, ops, patched)
+		if !reflect.DeepEqual(patched, desired) {
+			t.Fatalf("%s: expected %#v\n, got %#v", name, desired, patched)
+		}
+
+		var names []string
+		for _, c := range patched.Spec.InitContainers {
+			names = append(names, c.Name)
+		}
+		expected := []string{initContainerName}
+		if has(2) && position == positionFirst {
+			expected = []string{initContainerName, existing.Name}
+		} else if has(2) {
+			expected = []string{existing.Name, initContainerName}
+		}
+		if !reflect.DeepEqual(names, expected) {
+			t.Errorf("%s: expected init containers %v, got %v", name, expected, names)
+		}
+		for _, c := range patched.Spec.InitContainers {
+			if c.Name == existing.Name && !reflect.DeepEqual(c, existing) {
+				t.Errorf("%s: existing init container changed to %+v", name, c)
+			}
+		}
+		// only additions, so the patch never clobbers what another
+		// webhook or the user put there
+		for _, op := range ops {
+			if op.Op != "add" {
+				t.Errorf("%s: unexpected %s of %s", name, op.Op, op.Path)
+			}
+		}
+	}
+
+	pod := corev1.Pod{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{
+		"secrets.k8s.aws/db": "arn:db",
+		"injector.secrets.k8s.aws/init-container-position": "middle",
+	}}}
+	if err := injectSecrets(&pod); err == nil {
+		t.Error("expected an error for an invalid position")
+	}
+}
+
+func TestSecretTargeting(t *testing.T) {
+	sidecarImage = "test-image"
+	pod := func(annotations map[string]string) corev1.Pod {
+		return corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Annotations: annotations},
+			Spec: corev1.PodSpec{
+				InitContainers: []corev1.Container{{Name: "migrate"}},
+				Containers:     []corev1.Container{{Name: "app"}, {Name: "worker"}, {Name: "proxy"}},
+			},
+		}
+	}
+	// inject returns the pod as patched, checking the patch gives the
+	// mutated pod
+	inject := func(original corev1.Pod) *corev1.Pod {
+		t.Helper()
+		desired := original.DeepCopy()
+		if err := injectSecrets(desired); err != nil {
+			t.Fatal(err)
+		}
+		ops, err := createPatch(&original, desired)
+		if err != nil {
+			t.Fatal(err)
+		}
+		patched := &corev1.Pod{}
+		applyPatch(t, original, ops, patched)
+		if !reflect.DeepEqual(patched, desired) {
+			t.Fatalf("expected %#v\n, got %#v", desired, patched)
+		}
+		return patched
+	}
+	mounts := func(patched *corev1.Pod) map[string][]string {
+		found := map[string][]string{}
+		for _, c := range append(patched.Spec.InitContainers, patched.Spec.Containers...) {
+			if c.Name == initContainerName {
+				continue
+			}
+			for _, m := range c.VolumeMounts {
+				found[c.Name] = append(found[c.Name], m.SubPath)
+			}
+			hasSecLoc := len(c.Env) == 1 && c.Env[0].Name == "SEC_LOC"
+			if hasSecLoc != (len(c.VolumeMounts) > 0) {
+				t.Errorf("%s: expected SEC_LOC only with the secrets mounted, got %v", c.Name, c.Env)
+			}
+		}
+		return found
+	}
+
+	// the whole volume in the pod-wide containers only
+	patched := inject(pod(map[string]string{
+		"secrets.k8s.aws/db":                  "db",
+		"injector.secrets.k8s.aws/containers": "app, worker",
+	}))
+	if expected := map[string][]string{"app": {""}, "worker": {""}}; !reflect.DeepEqual(mounts(patched), expected) {
+		t.Errorf("expected mounts %v, got %v", expected, mounts(patched))
+	}
+
+	// each secret's directory in its own containers, the others in the
+	// pod-wide ones
+	patched = inject(pod(map[string]string{
+		"secrets.k8s.aws/db":                  "db",
+		"secrets.k8s.aws/db.containers":       "app,migrate",
+		"secrets.k8s.aws/api":                 "api",
+		"secrets.k8s.aws/api.format":          "json",
+		"parameters.k8s.aws/url":              "/app/url",
+		"injector.secrets.k8s.aws/containers": "worker",
+		"injector.secrets.k8s.aws/file-name":  "app.env",
+	}))
+	expected := map[string][]string{"migrate": {"db"}, "app": {"db"}, "worker": {"url", "api"}}
+	if !reflect.DeepEqual(mounts(patched), expected) {
+		t.Errorf("expected mounts %v, got %v", expected, mounts(patched))
+	}
+	location := patched.Spec.Containers[0].Env[0].Value
+	if m := patched.Spec.Containers[0].VolumeMounts[0]; m.MountPath != location+"/db" {
+		t.Errorf("expected db mounted at %s/db, got %s", location, m.MountPath)
+	}
+	var manifest []secretRef
+	if err := json.Unmarshal([]byte(patched.Spec.InitContainers[0].Env[0].Value), &manifest); err != nil {
 		t.Fatal(err)
 	}
-	expectedData := map[string]interface{}{
-		"mutation-start":   "yes",
-		"mutation-stage-1": "yes",
+	expectedManifest := []secretRef{
+		{Name: "url", ARN: "/app/url", Backend: "ssm", Output: "url/app.env", File: "url/url"},
+		{Name: "api", ARN: "api", Backend: "secretsmanager", Format: "json", Output: "api/api", File: "api/api"},
+		{Name: "db", ARN: "db", Backend: "secretsmanager", Output: "db/app.env", File: "db/db"},
+	}
+	if !reflect.DeepEqual(manifest, expectedManifest) {
+		t.Errorf("expected the manifest %+v, got %+v", expectedManifest, manifest)
 	}
 
-	if !reflect.DeepEqual(patchedObj.Object["data"], expectedData) {
-		t.Errorf("\nexpected %#v\n, got %#v", expectedData, patchedObj.Object["data"])
+	for _, annotations := range []map[string]string{
+		{"secrets.k8s.aws/db": "db", "secrets.k8s.aws/db.containers": "app,typo"},
+		{"secrets.k8s.aws/db": "db", "secrets.k8s.aws/db.containers": "app,,worker"},
+		{"secrets.k8s.aws/db": "db", "secrets.k8s.aws/db.containers": initContainerName},
+		{"secrets.k8s.aws/db": "db", "injector.secrets.k8s.aws/containers": "typo"},
+		{"secrets.k8s.aws/db": "db", "secrets.k8s.aws/db.containers": "app", "injector.secrets.k8s.aws/template.out": "{{ .db }}"},
+	} {
+		p := pod(annotations)
+		if err := injectSecrets(&p); err == nil {
+			t.Errorf("%v: expected an error", annotations)
+		}
 	}
 }
@@ -17,8 +17,9 @@ limitations under the License.
 package main
 
 import (
+	"encoding/json"
 	"fmt"
-	"strconv"
+	"path"
 	"strings"
 
 	"github.com/google/uuid"
@@ -28,141 +29,277 @@ import (
 	"k8s.io/klog"
 )
 
+// names of the containers and volumes the mutators add
 const (
-	podsSidecarPatch string = `[
-		{"op":"add", "path":"/spec/containers/-","value":{"image":"%v","name":"webhook-added-sidecar","volumeMounts":[{"name":"vol","mountPath":"/tmp"}],"resources":{}}}
-	]`
+	initContainerName    = "secrets-init-container"
+	sidecarContainerName = "webhook-added-sidecar"
+	secretsVolumeName    = "secret-vol"
+	templatesVolumeName  = "secret-templates"
 )
 
-// is the operation for patching for the init containers. Needs an array of init containers
-// to be added to the incoming manifest
-var initContainersShell string = `{"op":"add","path":"/spec/initContainers","value":[%s]},`
-
-// Init container array entry with values to be added. Last entry needs the , stripped off
-// takes 3 values, image name, a number for the container and annotation name from the
-// the incoming manifest
-var initContainerEntry string = `{"image":"%v","name":"secrets-init-container-%d","volumeMounts":[{"name":"secret-vol","mountPath":"/tmp"}],"env":[{"name": "SECRET_ARN","valueFrom": {"fieldRef": {"fieldPath": "metadata.annotations['%v']"}}}],"resources":{}},`
+// injectSecrets adds the init container fetching the secrets requested by
+// the pod's annotations, and the volume it writes them to, mounted in
+// every container of the pod.
+func injectSecrets(pod *corev1.Pod) error {
+	// a note about the annotation
+	// using SSM, its a key value store which always returns
+	// the keys in the json form { "key": "value" }. So, when
+	// we set this up, it gets exported as KEY=VALUE. So, the
+	// annotation values after the main clause, dont matter as
+	// log as they are unique. We use them to name the secrets
+	// for the fetcher. K8s will enforce they are globally unique
+	secrets, opts, err := podSecrets(pod)
+	if err != nil {
+		return err
+	}
+	for _, secret := range secrets {
+		klog.Info(secret.ARN)
+	}
 
-// this modification will the secrets in memory volume which each init container will populate
-// and the main container will use to pull the secrets in.
-var secretsMountPointPatch string = `{"op":"add","path":"/spec/volumes/-","value":{"emptyDir": {"medium": "Memory"},"name": "secret-vol"}}`
+	initContainer, err := fetcherContainer(pod, initContainerName, secrets, opts)
+	if err != nil {
+		return err
+	}
+	addPullSecrets(pod)
+
+	// the in memory volume the init container populates and the main
+	// containers read the secrets from
+	pod.Spec.Volumes = append(pod.Spec.Volumes, corev1.Volume{
+		Name:         secretsVolumeName,
+		VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{Medium: corev1.StorageMediumMemory}},
+	})
+	if opts.TemplateConfigMap != "" {
+		// only the fetchers mount the templates
+		pod.Spec.Volumes = append(pod.Spec.Volumes, corev1.Volume{
+			Name: templatesVolumeName,
+			VolumeSource: corev1.VolumeSource{ConfigMap: &corev1.ConfigMapVolumeSource{
+				LocalObjectReference: corev1.LocalObjectReference{Name: opts.TemplateConfigMap},
+			}},
+		})
+	}
+	// keep the init containers the pod already has
+	position := initContainerPosition
+	if opts.InitContainerPosition != "" {
+		position = opts.InitContainerPosition
+	}
+	if position == positionLast {
+		pod.Spec.InitContainers = append(pod.Spec.InitContainers, initContainer)
+	} else {
+		pod.Spec.InitContainers = append([]corev1.Container{initContainer}, pod.Spec.InitContainers...)
+	}
 
-// only allow pods to pull images from specific registry.
-func admitPods(ar v1.AdmissionReview) *v1.AdmissionResponse {
-	klog.V(2).Info("admitting pods")
-	podResource := metav1.GroupVersionResource{Group: "", Version: "v1", Resource: "pods"}
-	if ar.Request.Resource != podResource {
-		err := fmt.Errorf("expect resource to be %s", podResource)
-		klog.Error(err)
-		return toV1AdmissionResponse(err)
+	// generate a random mount location to mitigate LFI, unless
+	// the pod asks for a specific one
+	mountLocation := opts.MountPath
+	if mountLocation == "" {
+		mountLocation = "/tmp/" + uuid.New().String()
 	}
+	klog.Info(
+		fmt.Sprintf("Will mount secrets in main conatiners to %s", mountLocation),
+	)
+
+	// Apply secrets mount to each container the secrets target
+	mounts := secretMounts(secrets, opts, pod, mountLocation)
+	for _, containers := range [][]corev1.Container{pod.Spec.InitContainers, pod.Spec.Containers} {
+		for i := range containers {
+			container := &containers[i]
+			if len(mounts[container.Name]) == 0 {
+				continue
+			}
+			container.VolumeMounts = append(container.VolumeMounts, mounts[container.Name]...)
+			container.Env = append(container.Env, corev1.EnvVar{Name: "SEC_LOC", Value: mountLocation})
+		}
+	}
+	return nil
+}
 
-	raw := ar.Request.Object.Raw
-	pod := corev1.Pod{}
-	deserializer := codecs.UniversalDeserializer()
-	if _, _, err := deserializer.Decode(raw, nil, &pod); err != nil {
-		klog.Error(err)
-		return toV1AdmissionResponse(err)
+// podSecrets parses the secrets and options set by the pod's annotations
+// and checks the pod is entitled to the secrets and the containers they
+// target exist. Secrets listing containers
+// of their own are each written to a directory named after the secret, so
+// only that directory is mounted in those containers.
+func podSecrets(pod *corev1.Pod) ([]secretRef, injectorOptions, error) {
+	secrets, err := parseSecretAnnotations(pod.ObjectMeta.Annotations)
+	if err != nil {
+		return nil, injectorOptions{}, err
+	}
+	opts, err := parseInjectorOptions(pod.ObjectMeta.Annotations)
+	if err != nil {
+		return nil, opts, err
+	}
+	if err := checkPolicy(pod.Namespace, pod, secrets); err != nil {
+		return nil, opts, err
 	}
-	reviewResponse := v1.AdmissionResponse{}
-	reviewResponse.Allowed = true
 
-	var msg string
-	if v, ok := pod.Labels["webhook-e2e-test"]; ok {
-		if v == "webhook-disallow" {
-			reviewResponse.Allowed = false
-			msg = msg + "the pod contains unwanted label; "
+	known := map[string]bool{}
+	for _, containers := range [][]corev1.Container{pod.Spec.InitContainers, pod.Spec.Containers} {
+		for _, container := range containers {
+			if container.Name != initContainerName && container.Name != sidecarContainerName {
+				known[container.Name] = true
+			}
 		}
-		if v == "wait-forever" {
-			reviewResponse.Allowed = false
-			msg = msg + "the pod response should not be sent; "
-			<-make(chan int) // Sleep forever - no one sends to this channel
+	}
+	for _, name := range opts.Containers {
+		if !known[name] {
+			return nil, opts, fmt.Errorf("%scontainers lists container %q but the pod has no such container", injectorOptionPrefix, name)
 		}
 	}
-	for _, container := range pod.Spec.Containers {
-		if strings.Contains(container.Name, "webhook-disallow") {
-			reviewResponse.Allowed = false
-			msg = msg + "the pod contains unwanted container name; "
+	for i, secret := range secrets {
+		if secret.Containers == "" {
+			continue
+		}
+		containers, err := parseContainerList(secret.Containers)
+		if err != nil {
+			return nil, opts, fmt.Errorf("invalid value %q for the containers of secret %s: %v", secret.Containers, secret.Name, err)
+		}
+		for _, name := range containers {
+			if !known[name] {
+				return nil, opts, fmt.Errorf("secret %s lists container %q but the pod has no such container", secret.Name, name)
+			}
+		}
+		if opts.Templates {
+			return nil, opts, fmt.Errorf("secret %s lists its own containers, which templates can't be combined with as they render all the secrets", secret.Name)
 		}
+		secrets[i].Containers = strings.Join(containers, ",")
 	}
-	if !reviewResponse.Allowed {
-		reviewResponse.Result = &metav1.Status{Message: strings.TrimSpace(msg)}
+	if targetsPerSecret(secrets) {
+		for i := range secrets {
+			secrets[i].Output, secrets[i].File = secretPaths(secrets[i], opts)
+		}
 	}
-	return &reviewResponse
+	return secrets, opts, nil
 }
 
-func processAnnotations(pod *corev1.Pod) string {
-	var patch string
-	initCount := 0
-	for annotation, value := range pod.ObjectMeta.Annotations {
-		// a note about the annotation
-		// using SSM, its a key value store which always returns
-		// the keys in the json form { "key": "value" }. So, when
-		// we set this up, it gets exported as KEY=VALUE. So, the
-		// annotation values after the main clause, dont matter as
-		// log as they are unique. We can look to use them in the case
-		// where we dont get a key,value pair back. But for now, just
-		// ignoring them. K8s will enforce they are globally unique
-		if strings.Contains(annotation, "secrets.k8s.aws") {
-
-			// ignore the injector turn on flag
-			if annotation == "secrets.k8s.aws/sidecarInjectorWebhook" {
-				continue
-			}
-			klog.Info(value)
-			patchPart := fmt.Sprintf(initContainerEntry, sidecarImage, initCount, annotation)
-			patch += patchPart
-			initCount++
-			klog.Info(patchPart)
+// targetsPerSecret tells whether any secret lists its own containers
+func targetsPerSecret(secrets []secretRef) bool {
+	for _, secret := range secrets {
+		if secret.Containers != "" {
+			return true
 		}
 	}
+	return false
+}
 
-	// trim off the trailing ,
-	patch = patch[:len(patch)-1]
-
-	klog.Info(fmt.Sprintf("Patch Array: \n*****\n%s\n******"), patch)
+// secretPaths returns the output and file of a secret written to its own
+// directory, relative to the output dir. Each secret gets an env file of
+// its own, named as the shared one would be.
+func secretPaths(secret secretRef, opts injectorOptions) (string, string) {
+	output := secret.Name
+	if secret.Format == "" || secret.Format == "export" || secret.Format == "dotenv" {
+		output = "secret"
+		if opts.FileName != "" {
+			output = opts.FileName
+		}
+	}
+	file := secret.Name
+	if secret.File != "" {
+		file = secret.File
+	}
+	return path.Join(secret.Name, output), path.Join(secret.Name, file)
+}
 
-	// put the array elements into the shell entry
-	patch = fmt.Sprintf(initContainersShell, patch)
+// secretMounts returns the mounts of the secrets volume each container
+// gets, by container name. Secrets listing containers of their own have
+// their directory mounted in those containers, the others go to the
+// pod-wide containers, or all the containers when none are listed. With
+// no secret listing its own containers, the whole volume is mounted.
+func secretMounts(secrets []secretRef, opts injectorOptions, pod *corev1.Pod, mountLocation string) map[string][]corev1.VolumeMount {
+	defaults := opts.Containers
+	if len(defaults) == 0 {
+		for _, container := range pod.Spec.Containers {
+			defaults = append(defaults, container.Name)
+		}
+	}
+	mounts := map[string][]corev1.VolumeMount{}
+	if !targetsPerSecret(secrets) {
+		for _, name := range defaults {
+			mounts[name] = []corev1.VolumeMount{{Name: secretsVolumeName, MountPath: mountLocation}}
+		}
+		return mounts
+	}
+	for _, secret := range secrets {
+		containers := defaults
+		if secret.Containers != "" {
+			containers = strings.Split(secret.Containers, ",")
+		}
+		for _, name := range containers {
+			mounts[name] = append(mounts[name], corev1.VolumeMount{
+				Name:      secretsVolumeName,
+				MountPath: path.Join(mountLocation, secret.Name),
+				SubPath:   secret.Name,
+			})
+		}
+	}
+	return mounts
+}
 
-	klog.Info(fmt.Sprintf("Full Init Containers Entry: \n*****\n%s\n******"), patch)
+// fetcherContainer builds a container of the pod running the fetcher with
+// the secrets volume mounted and the secrets and options in its env.
+func fetcherContainer(pod *corev1.Pod, name string, secrets []secretRef, opts injectorOptions) (corev1.Container, error) {
+	// all the secrets go to the one container as a manifest
+	manifest, err := json.Marshal(secrets)
+	if err != nil {
+		return corev1.Container{}, err
+	}
+	envVars := []corev1.EnvVar{{Name: "SECRETS", Value: string(manifest)}}
+	envVars = append(envVars, opts.Env...)
+	if secretsManagerEndpoint != "" {
+		envVars = append(envVars, corev1.EnvVar{Name: "AWS_ENDPOINT_URL_SECRETS_MANAGER", Value: secretsManagerEndpoint})
+	}
+	if ssmEndpoint != "" {
+		envVars = append(envVars, corev1.EnvVar{Name: "AWS_ENDPOINT_URL_SSM", Value: ssmEndpoint})
+	}
+	if stsEndpoint != "" {
+		envVars = append(envVars, corev1.EnvVar{Name: "AWS_ENDPOINT_URL_STS", Value: stsEndpoint})
+	}
+	mountPath := defaultMountPath
+	if opts.MountPath != "" {
+		mountPath = opts.MountPath
+	}
+	container := corev1.Container{
+		Name:            name,
+		Image:           sidecarImage,
+		ImagePullPolicy: fetcherPullPolicy,
+		VolumeMounts:    []corev1.VolumeMount{{Name: secretsVolumeName, MountPath: mountPath}},
+		Env:             envVars,
+		Resources:       opts.Resources,
+		SecurityContext: fetcherSecurityContext(pod, opts),
+	}
+	if opts.TemplateConfigMap != "" {
+		container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{Name: templatesVolumeName, MountPath: templateMountPath, ReadOnly: true})
+	}
+	return container, nil
+}
 
-	// prepend the open array into the patch
-	patch = fmt.Sprintf("[%s", patch)
+// needsInitContainer tells whether the pod asks for secrets and doesn't
+// have the init container yet
+func needsInitContainer(pod *corev1.Pod) bool {
 
-	klog.Info(fmt.Sprintf("Full Entry: \n*****\n%s\n******"), patch)
+	// look for the annotations needed to query
+	// for secrets from SSM. Broken annotations still patch
+	// so injectSecrets can report the error.
+	secrets, err := parseSecretAnnotations(pod.ObjectMeta.Annotations)
+	secretFound := err != nil || len(secrets) > 0
 
-	// Add the mount patch once
-	patch += secretsMountPointPatch
+	if !secretFound {
+		return false
+	}
 
-	klog.Info(fmt.Sprintf("Patch statement: \n*****\n%s\n******\n", patch))
+	return !hasContainer(pod.Spec.InitContainers, initContainerName)
+}
 
-	return patch
+// needsSidecar tells whether the pod asks for secrets and doesn't have
+// the sidecar yet
+func needsSidecar(pod *corev1.Pod) bool {
+	secrets, err := parseSecretAnnotations(pod.ObjectMeta.Annotations)
+	if err == nil && len(secrets) == 0 {
+		return false
+	}
+	return !hasContainer(pod.Spec.Containers, sidecarContainerName)
 }
 
 func mutatePods(ar v1.AdmissionReview) *v1.AdmissionResponse {
-	shouldPatchPod := func(pod *corev1.Pod) bool {
-
-		// loop over looking for the annotations needed to query
-		// for secrets from SSM.
-		secretFound := false
-		for annotation := range pod.ObjectMeta.Annotations {
-			if strings.Contains(annotation, "secrets.k8s.aws") {
-				// ignore the injector turn on flag
-				if annotation == "secrets.k8s.aws/sidecarInjectorWebhook" {
-					continue
-				}
-				secretFound = true
-			}
-		}
-
-		if !secretFound {
-			return false
-		}
-
-		return !hasContainer(pod.Spec.InitContainers, "secrets-init-container")
-	}
-	return applyPodPatch(ar, shouldPatchPod, "")
+	return applyPodPatch(ar, needsInitContainer, injectSecrets)
 }
 
 func mutatePodsSidecar(ar v1.AdmissionReview) *v1.AdmissionResponse {
@@ -176,10 +313,37 @@ func mutatePodsSidecar(ar v1.AdmissionReview) *v1.AdmissionResponse {
 			},
 		}
 	}
-	shouldPatchPod := func(pod *corev1.Pod) bool {
-		return !hasContainer(pod.Spec.Containers, "webhook-added-sidecar")
+	return applyPodPatch(ar, needsSidecar, addSidecar)
+}
+
+// addSidecar adds a container running the fetcher in watch mode, which
+// keeps the secrets in the secrets volume up to date. The init container
+// still writes them first, so the app starts with its secrets; it is
+// injected here unless the pod already has it.
+func addSidecar(pod *corev1.Pod) error {
+	if !hasContainer(pod.Spec.InitContainers, initContainerName) {
+		if err := injectSecrets(pod); err != nil {
+			return err
+		}
+	}
+	secrets, opts, err := podSecrets(pod)
+	if err != nil {
+		return err
 	}
-	return applyPodPatch(ar, shouldPatchPod, fmt.Sprintf(podsSidecarPatch, sidecarImage))
+	sidecar, err := fetcherContainer(pod, sidecarContainerName, secrets, opts)
+	if err != nil {
+		return err
+	}
+	sidecar.Args = append([]string{"--watch"}, opts.WatchArgs...)
+	pod.Spec.Containers = append(pod.Spec.Containers, sidecar)
+
+	// the sidecar signals the app's process, which it only sees when the
+	// containers share the process namespace
+	if opts.ReloadProcess {
+		share := true
+		pod.Spec.ShareProcessNamespace = &share
+	}
+	return nil
 }
 
 func hasContainer(containers []corev1.Container, containerName string) bool {
@@ -191,7 +355,10 @@ func hasContainer(containers []corev1.Container, containerName string) bool {
 	return false
 }
 
-func applyPodPatch(ar v1.AdmissionReview, shouldPatchPod func(*corev1.Pod) bool, patch1 string) *v1.AdmissionResponse {
+// applyPodPatch responds with the patch the mutate function makes to the
+// pod, when shouldPatchPod says the pod needs it. The patch is the diff
+// between the pod as it came in and as mutated.
+func applyPodPatch(ar v1.AdmissionReview, shouldPatchPod func(*corev1.Pod) bool, mutate func(*corev1.Pod) error) *v1.AdmissionResponse {
 	klog.V(2).Info("mutating pods")
 	klog.Info("Mutating Pods")
 	podResource := metav1.GroupVersionResource{Group: "", Version: "v1", Resource: "pods"}
@@ -207,55 +374,47 @@ func applyPodPatch(ar v1.AdmissionReview, shouldPatchPod func(*corev1.Pod) bool,
 		klog.Error(err)
 		return toV1AdmissionResponse(err)
 	}
+	// pods being created don't have their namespace set yet
+	if pod.Namespace == "" {
+		pod.Namespace = ar.Request.Namespace
+	}
 
 	reviewResponse := v1.AdmissionResponse{}
 	reviewResponse.Allowed = true
-	var patch string
 
-	// Need to add the secrets mount to the "rea" containers in the pod spec.
-	// The init containers where created with this mount point and the patch
-	// already has the addition of the in memory volume for the secrets.
 	if shouldPatchPod(&pod) {
-		// if we should patch, we need to process the pod's annotations
-		// to get a handle to the initial patch
-		patch = processAnnotations(&pod)
-		klog.Info(fmt.Sprintf("Pre Processed Patch info:\n*****\n%s\n******", patch))
-
-		// generate a random mount location to mitigate LFI
-		mountLocation := uuid.New()
-
-		klog.Info(
-			fmt.Sprintf("Will mount secrets in main conatiners to %s", mountLocation),
-		)
-
-		var path = "{\"op\": \"add\",\"path\": \"/spec/containers/"
-		var value = fmt.Sprintf("/volumeMounts/-\",\"value\": {\"mountPath\": \"/tmp/%s\",\"name\": \"secret-vol\"}}", mountLocation)
-
-		envPatch := `{"op":"add","path":"/spec/containers/%d/env/-","value":{"name":"SEC_LOC","value":"/tmp/%s"}}`
-		var volMounts = ""
-		var envPatches = ""
-
-		// Apply secrets mount to each container in the main pod spec
-		for i := range pod.Spec.Containers {
-			klog.Info(fmt.Sprintf("container: %s", i))
-			if i == 0 {
-				volMounts = path + strconv.Itoa(i) + value
-				envPatches = fmt.Sprintf(envPatch, i, mountLocation)
-			} else {
-				volMounts = volMounts + "," + path + strconv.Itoa(i) + value
-				envPatches = envPatches + "," + fmt.Sprintf(envPatch, i, mountLocation)
-			}
+		desired := pod.DeepCopy()
+		if err := mutate(desired); err != nil {
+			klog.Error(err)
+			return toV1AdmissionResponse(err)
+		}
+		ops, err := createPatch(&pod, desired, setSeccompProfiles)
+		if err != nil {
+			klog.Error(err)
+			return toV1AdmissionResponse(err)
+		}
+		if err := setPatch(&reviewResponse, ops); err != nil {
+			klog.Error(err)
+			return toV1AdmissionResponse(err)
 		}
-		patch = patch + "," + volMounts + "," + envPatches + "]"
-		klog.Info(fmt.Sprintf("Post Processed Patch info:\n*****\n%s\n******", patch))
-		reviewResponse.Patch = []byte(patch)
-		pt := v1.PatchTypeJSONPatch
-		reviewResponse.PatchType = &pt
 	}
 	klog.Info(&reviewResponse)
 	return &reviewResponse
 }
 
+// setPatch sets the JSON patch of the response
+func setPatch(response *v1.AdmissionResponse, ops []patchOperation) error {
+	patch, err := json.Marshal(ops)
+	if err != nil {
+		return err
+	}
+	klog.Info(fmt.Sprintf("Patch statement: \n*****\n%s\n******\n", patch))
+	response.Patch = patch
+	pt := v1.PatchTypeJSONPatch
+	response.PatchType = &pt
+	return nil
+}
+
 // denySpecificAttachment denies `kubectl attach to-be-attached-pod -i -c=container1"
 // or equivalent client requests.
 func denySpecificAttachment(ar v1.AdmissionReview) *v1.AdmissionResponse {
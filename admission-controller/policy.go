@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/klog"
+	"sigs.k8s.io/yaml"
+)
+
+// injectionPolicy restricts the secrets pods may ask for, nil when the
+// webhook runs without a policy file and every pod may ask for anything.
+var injectionPolicy *policyLoader
+
+// policyRule entitles the pods it matches to the secrets, parameters and
+// roles matching its patterns. A pod matches when it is in one of the
+// namespaces, runs as one of the service accounts and has labels matching
+// the selector; fields left out match every pod. Patterns are the
+// references as written in the annotations, * matching any characters.
+type policyRule struct {
+	Namespaces      []string              `json:"namespaces,omitempty"`
+	ServiceAccounts []string              `json:"serviceAccounts,omitempty"`
+	Selector        *metav1.LabelSelector `json:"selector,omitempty"`
+	Secrets         []string              `json:"secrets,omitempty"`
+	Parameters      []string              `json:"parameters,omitempty"`
+	Roles           []string              `json:"roles,omitempty"`
+
+	selector   labels.Selector
+	secrets    []*regexp.Regexp
+	parameters []*regexp.Regexp
+	roles      []*regexp.Regexp
+}
+
+// policy is the list of rules of the policy file. A pod may ask for a
+// secret when any rule matching it allows the secret.
+type policy struct {
+	Rules []policyRule `json:"rules"`
+}
+
+// parsePolicy parses a YAML or JSON policy, compiling its selectors and
+// patterns.
+func parsePolicy(data []byte) (*policy, error) {
+	var p policy
+	if err := yaml.UnmarshalStrict(data, &p); err != nil {
+		return nil, fmt.Errorf("unable to parse policy: %v", err)
+	}
+	for i := range p.Rules {
+		rule := &p.Rules[i]
+		rule.selector = labels.Everything()
+		if rule.Selector != nil {
+			selector, err := metav1.LabelSelectorAsSelector(rule.Selector)
+			if err != nil {
+				return nil, fmt.Errorf("rule %d has an invalid selector: %v", i, err)
+			}
+			rule.selector = selector
+		}
+		rule.secrets = compilePatterns(rule.Secrets)
+		rule.parameters = compilePatterns(rule.Parameters)
+		rule.roles = compilePatterns(rule.Roles)
+	}
+	return &p, nil
+}
+
+// compilePatterns turns patterns where * matches any characters but a
+// colon into anchored regexps. A * stays within one field of an ARN, so
+// it can't match the colons of a crafted secret name into another account
+// or region. Slashes are matched, so payments/* covers a whole hierarchy.
+func compilePatterns(patterns []string) []*regexp.Regexp {
+	var compiled []*regexp.Regexp
+	for _, pattern := range patterns {
+		expr := strings.Replace(regexp.QuoteMeta(pattern), `\*`, "[^:]*", -1)
+		compiled = append(compiled, regexp.MustCompile("^"+expr+"$"))
+	}
+	return compiled
+}
+
+func matchesAny(patterns []*regexp.Regexp, value string) bool {
+	for _, pattern := range patterns {
+		if pattern.MatchString(value) {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// matches tells whether the rule applies to the pod
+func (r *policyRule) matches(namespace, serviceAccount string, podLabels map[string]string) bool {
+	if len(r.Namespaces) > 0 && !contains(r.Namespaces, namespace) {
+		return false
+	}
+	if len(r.ServiceAccounts) > 0 && !contains(r.ServiceAccounts, serviceAccount) {
+		return false
+	}
+	return r.selector.Matches(labels.Set(podLabels))
+}
+
+// allows tells whether the rule entitles a pod to the secret, and to the
+// role it is fetched with
+func (r *policyRule) allows(secret secretRef) bool {
+	patterns := r.secrets
+	if secret.Backend == annotationBackends[parameterAnnotationPrefix] {
+		patterns = r.parameters
+	}
+	if !matchesAny(patterns, secret.ARN) {
+		return false
+	}
+	return secret.RoleARN == "" || matchesAny(r.roles, secret.RoleARN)
+}
+
+// check returns an error naming the first secret the pod isn't entitled
+// to, in the order of the secrets.
+func (p *policy) check(namespace string, pod *corev1.Pod, secrets []secretRef) error {
+	serviceAccount := pod.Spec.ServiceAccountName
+	if serviceAccount == "" {
+		serviceAccount = "default"
+	}
+	var rules []*policyRule
+	for i := range p.Rules {
+		if p.Rules[i].matches(namespace, serviceAccount, pod.Labels) {
+			rules = append(rules, &p.Rules[i])
+		}
+	}
+	for _, secret := range secrets {
+		allowed := false
+		for _, rule := range rules {
+			if rule.allows(secret) {
+				allowed = true
+				break
+			}
+		}
+		if allowed {
+			continue
+		}
+		what := fmt.Sprintf("secret %s (%s)", secret.Name, secret.ARN)
+		if secret.RoleARN != "" {
+			what += " with role " + secret.RoleARN
+		}
+		return fmt.Errorf("the injector policy doesn't allow pods of service account %s in namespace %s to fetch %s", serviceAccount, namespace, what)
+	}
+	return nil
+}
+
+// policyLoader holds the policy of a file, reloading it when the file
+// changes. A file which can't be read or parsed leaves the last policy in
+// place.
+type policyLoader struct {
+	path string
+
+	mu      sync.RWMutex
+	data    []byte
+	current *policy
+}
+
+// newPolicyLoader loads the policy file, which has to be valid at start.
+func newPolicyLoader(path string) (*policyLoader, error) {
+	l := &policyLoader{path: path}
+	if err := l.reload(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// reload parses the file again if its content changed
+func (l *policyLoader) reload() error {
+	data, err := ioutil.ReadFile(l.path)
+	if err != nil {
+		return err
+	}
+	l.mu.RLock()
+	unchanged := l.current != nil && bytes.Equal(data, l.data)
+	l.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+	p, err := parsePolicy(data)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	l.data, l.current = data, p
+	l.mu.Unlock()
+	klog.Infof("loaded the injector policy from %s, %d rules", l.path, len(p.Rules))
+	return nil
+}
+
+// watch reloads the file every interval until stop is closed. Polling
+// rather than watching for events keeps working with ConfigMap volumes,
+// which swap the file through a symlink.
+func (l *policyLoader) watch(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		if err := l.reload(); err != nil {
+			klog.Errorf("keeping the current injector policy: %v", err)
+		}
+	}
+}
+
+func (l *policyLoader) policy() *policy {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.current
+}
+
+// checkPolicy denies the pod any secret the injector policy doesn't
+// entitle it to. Without a policy every secret is allowed.
+func checkPolicy(namespace string, pod *corev1.Pod, secrets []secretRef) error {
+	if injectionPolicy == nil {
+		return nil
+	}
+	return injectionPolicy.policy().check(namespace, pod, secrets)
+}
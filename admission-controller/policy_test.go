@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	v1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+const testPolicy = `
+rules:
+- namespaces: [payments]
+  serviceAccounts: [api]
+  secrets:
+  - arn:aws:secretsmanager:us-east-1:123456789012:secret:payments/*
+  parameters:
+  - /payments/*
+- namespaces: [payments]
+  selector:
+    matchLabels:
+      app: reports
+  secrets:
+  - arn:aws:secretsmanager:us-east-1:210987654321:secret:reports-*
+  roles:
+  - arn:aws:iam::210987654321:role/reports-reader
+- secrets: [shared/*]
+- namespaces: [audit]
+  secrets:
+  - arn:aws:secretsmanager:*:111111111111:secret:payments/*
+`
+
+func TestPolicy(t *testing.T) {
+	p, err := parsePolicy([]byte(testPolicy))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pod := func(serviceAccount string, labels map[string]string) *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Labels: labels},
+			Spec:       corev1.PodSpec{ServiceAccountName: serviceAccount},
+		}
+	}
+	testCases := []struct {
+		name      string
+		namespace string
+		pod       *corev1.Pod
+		secret    secretRef
+		allowed   bool
+	}{
+		{
+			name: "secret of the service account", namespace: "payments", pod: pod("api", nil),
+			secret:  secretRef{Name: "db", ARN: "arn:aws:secretsmanager:us-east-1:123456789012:secret:payments/db-AbCdEf", Backend: "secretsmanager"},
+			allowed: true,
+		},
+		{
+			name: "parameter of the service account", namespace: "payments", pod: pod("api", nil),
+			secret:  secretRef{Name: "url", ARN: "/payments/url", Backend: "ssm"},
+			allowed: true,
+		},
+		{
+			name: "parameter pattern for a secret", namespace: "payments", pod: pod("api", nil),
+			secret: secretRef{Name: "url", ARN: "/payments/url", Backend: "secretsmanager"},
+		},
+		{
+			name: "another service account", namespace: "payments", pod: pod("worker", nil),
+			secret: secretRef{Name: "db", ARN: "arn:aws:secretsmanager:us-east-1:123456789012:secret:payments/db-AbCdEf", Backend: "secretsmanager"},
+		},
+		{
+			name: "another namespace", namespace: "default", pod: pod("api", nil),
+			secret: secretRef{Name: "db", ARN: "arn:aws:secretsmanager:us-east-1:123456789012:secret:payments/db-AbCdEf", Backend: "secretsmanager"},
+		},
+		{
+			name: "labels and role", namespace: "payments", pod: pod("", map[string]string{"app": "reports"}),
+			secret:  secretRef{Name: "db", ARN: "arn:aws:secretsmanager:us-east-1:210987654321:secret:reports-db", Backend: "secretsmanager", RoleARN: "arn:aws:iam::210987654321:role/reports-reader"},
+			allowed: true,
+		},
+		{
+			name: "another role", namespace: "payments", pod: pod("", map[string]string{"app": "reports"}),
+			secret: secretRef{Name: "db", ARN: "arn:aws:secretsmanager:us-east-1:210987654321:secret:reports-db", Backend: "secretsmanager", RoleARN: "arn:aws:iam::210987654321:role/admin"},
+		},
+		{
+			name: "labels not matching", namespace: "payments", pod: pod("", map[string]string{"app": "web"}),
+			secret: secretRef{Name: "db", ARN: "arn:aws:secretsmanager:us-east-1:210987654321:secret:reports-db", Backend: "secretsmanager"},
+		},
+		{
+			name: "rule for every pod", namespace: "default", pod: pod("", nil),
+			secret:  secretRef{Name: "ca", ARN: "shared/ca", Backend: "secretsmanager"},
+			allowed: true,
+		},
+		{
+			name: "wildcard region", namespace: "audit", pod: pod("", nil),
+			secret:  secretRef{Name: "db", ARN: "arn:aws:secretsmanager:eu-west-1:111111111111:secret:payments/db-AbCdEf", Backend: "secretsmanager"},
+			allowed: true,
+		},
+		{
+			name: "wildcard spanning the fields of another account", namespace: "audit", pod: pod("", nil),
+			secret: secretRef{Name: "db", ARN: "arn:aws:secretsmanager:us-east-1:999999999999:secret:x:111111111111:secret:payments/db", Backend: "secretsmanager"},
+		},
+	}
+	for _, testcase := range testCases {
+		err := p.check(testcase.namespace, testcase.pod, []secretRef{testcase.secret})
+		if testcase.allowed && err != nil {
+			t.Errorf("%s: unexpected error %v", testcase.name, err)
+		}
+		if !testcase.allowed && (err == nil || !strings.Contains(err.Error(), testcase.secret.ARN)) {
+			t.Errorf("%s: expected an error naming the secret, got %v", testcase.name, err)
+		}
+	}
+
+	for _, invalid := range []string{
+		"rules: [{namespace: [payments]}]",
+		"rules: [{selector: {matchExpressions: [{key: app, operator: Maybe}]}}]",
+	} {
+		if _, err := parsePolicy([]byte(invalid)); err == nil {
+			t.Errorf("%s: expected an error", invalid)
+		}
+	}
+}
+
+func TestPolicyReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "policy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "policy.yaml")
+	ioutil.WriteFile(path, []byte("rules: [{secrets: [db]}]"), 0644)
+
+	loader, err := newPolicyLoader(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pod := &corev1.Pod{}
+	db := []secretRef{{Name: "db", ARN: "db", Backend: "secretsmanager"}}
+	if err := loader.policy().check("default", pod, db); err != nil {
+		t.Fatal(err)
+	}
+
+	ioutil.WriteFile(path, []byte("rules: [{secrets: [api]}]"), 0644)
+	if err := loader.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if err := loader.policy().check("default", pod, db); err == nil {
+		t.Error("expected the reloaded policy to deny the secret")
+	}
+
+	// a broken file keeps the last policy
+	ioutil.WriteFile(path, []byte("rules: {"), 0644)
+	if err := loader.reload(); err == nil {
+		t.Error("expected an error for a broken policy")
+	}
+	if err := loader.policy().check("default", pod, []secretRef{{Name: "api", ARN: "api", Backend: "secretsmanager"}}); err != nil {
+		t.Errorf("expected the last policy to be kept, got %v", err)
+	}
+}
+
+func TestMutatePodsDenied(t *testing.T) {
+	sidecarImage = "test-image"
+	p, err := parsePolicy([]byte(testPolicy))
+	if err != nil {
+		t.Fatal(err)
+	}
+	injectionPolicy = &policyLoader{current: p}
+	defer func() { injectionPolicy = nil }()
+
+	pod := corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{
+			"secrets.k8s.aws/ca": "shared/ca",
+			"secrets.k8s.aws/db": "arn:aws:secretsmanager:us-east-1:123456789012:secret:payments/db-AbCdEf",
+		}},
+		Spec: corev1.PodSpec{ServiceAccountName: "api", Containers: []corev1.Container{{Name: "app"}}},
+	}
+	raw, err := json.Marshal(pod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for namespace, allowed := range map[string]bool{"payments": true, "default": false} {
+		response := mutatePods(v1.AdmissionReview{Request: &v1.AdmissionRequest{
+			Namespace: namespace,
+			Resource:  metav1.GroupVersionResource{Version: "v1", Resource: "pods"},
+			Object:    runtime.RawExtension{Raw: raw},
+		}})
+		if response.Allowed != allowed {
+			t.Errorf("%s: expected allowed %v, got %+v", namespace, allowed, response)
+		}
+		if !allowed && !strings.Contains(response.Result.Message, "namespace default") {
+			t.Errorf("%s: expected the denial to name the namespace, got %s", namespace, response.Result.Message)
+		}
+	}
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+
+	v1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog"
+)
+
+// the checks below mirror the fetcher's, so a pod the webhook lets in
+// doesn't fail in its init container instead
+var (
+	// characters secrets manager allows in secret names
+	secretNamePattern = regexp.MustCompile(`^[A-Za-z0-9/_+=.@-]{1,512}$`)
+	// characters parameter store allows in parameter names
+	parameterNamePattern = regexp.MustCompile(`^[A-Za-z0-9_./-]+$`)
+	// region names like us-east-1 or us-gov-west-1
+	regionPattern = regexp.MustCompile(`^[a-z]{2}(-[a-z]+)+-[0-9]+$`)
+	// role ARNs, assumed to fetch cross-account secrets
+	roleARNPattern = regexp.MustCompile(`^arn:aws[a-z-]*:iam::[0-9]{12}:role/.+$`)
+	// role session names
+	sessionNamePattern = regexp.MustCompile(`^[\w+=,.@-]{2,64}$`)
+)
+
+// longest parameter name parameter store allows
+const maxParameterName = 2048
+
+// values of the options the fetcher only accepts some values for
+var (
+	outputFormats = map[string]bool{"export": true, "dotenv": true, "raw": true, "json": true, "yaml": true, "files": true, "none": true}
+	arraysModes   = map[string]bool{"error": true, "json": true, "index": true}
+)
+
+// options only the sidecar refreshing the secrets uses
+var sidecarOnlyOptions = []string{"refresh-interval", "check-version", "reload-process", "reload-signal", "reload-url"}
+
+// arnParts splits an ARN into its service, region, account and resource
+func arnParts(ref string) (service, region, account, resource string, ok bool) {
+	parts := strings.SplitN(ref, ":", 6)
+	if len(parts) != 6 || parts[0] != "arn" || parts[1] == "" {
+		return "", "", "", "", false
+	}
+	return parts[2], parts[3], parts[4], parts[5], true
+}
+
+// validateReference checks the secret's ARN or name, and returns the
+// region of its ARN, empty for names.
+func validateReference(secret secretRef) (string, error) {
+	ref := secret.ARN
+	if i := strings.Index(ref, "#"); i >= 0 {
+		ref = ref[:i]
+	}
+	if secret.Backend == annotationBackends[parameterAnnotationPrefix] {
+		name := strings.TrimSuffix(strings.TrimSuffix(ref, "/**"), "/*")
+		if !strings.HasPrefix(name, "arn:") {
+			if name != "" && (!parameterNamePattern.MatchString(name) || len(name) > maxParameterName) {
+				return "", fmt.Errorf("%q is neither an ARN nor a valid parameter name", secret.ARN)
+			}
+			if (name != ref || strings.Contains(name, "/")) && !strings.HasPrefix(ref, "/") {
+				return "", fmt.Errorf("parameter %q must start with /", secret.ARN)
+			}
+			return "", nil
+		}
+		if name != ref {
+			return "", fmt.Errorf("%s: parameter hierarchies are referenced by path, not ARN", secret.ARN)
+		}
+		service, region, _, resource, ok := arnParts(ref)
+		if !ok || service != "ssm" || !strings.HasPrefix(resource, "parameter/") || resource == "parameter/" {
+			return "", fmt.Errorf("%s is not a parameter ARN", secret.ARN)
+		}
+		if !regionPattern.MatchString(region) {
+			return "", fmt.Errorf("%s has an invalid region %q", secret.ARN, region)
+		}
+		return region, nil
+	}
+
+	if !strings.HasPrefix(ref, "arn:") {
+		if !secretNamePattern.MatchString(ref) {
+			return "", fmt.Errorf("%q is neither an ARN nor a valid secret name", secret.ARN)
+		}
+		return "", nil
+	}
+	service, region, account, resource, ok := arnParts(ref)
+	if !ok || service != "secretsmanager" {
+		return "", fmt.Errorf("%s is not a secrets manager ARN", secret.ARN)
+	}
+	if !strings.HasPrefix(resource, "secret:") || resource == "secret:" {
+		return "", fmt.Errorf("%s does not name a secret", secret.ARN)
+	}
+	// secret names have no colons, one in the name would make the ARN
+	// read as another's to the policy
+	if strings.Contains(strings.TrimPrefix(resource, "secret:"), ":") {
+		return "", fmt.Errorf("%s has an invalid secret name %q", secret.ARN, strings.TrimPrefix(resource, "secret:"))
+	}
+	if !regionPattern.MatchString(region) {
+		return "", fmt.Errorf("%s has an invalid region %q", secret.ARN, region)
+	}
+	if len(account) != 12 || strings.Trim(account, "0123456789") != "" {
+		return "", fmt.Errorf("%s has an invalid account %q", secret.ARN, account)
+	}
+	return region, nil
+}
+
+// validateKeys checks a list of key[=name] entries selecting keys
+func validateKeys(keys string) error {
+	names := map[string]bool{}
+	for _, entry := range strings.Split(keys, ",") {
+		key, name := entry, entry
+		if i := strings.Index(entry, "="); i >= 0 {
+			key, name = entry[:i], entry[i+1:]
+		}
+		key, name = strings.TrimSpace(key), strings.TrimSpace(name)
+		if key == "" || name == "" {
+			return fmt.Errorf("invalid key %q, expected key or key=name", entry)
+		}
+		if names[name] {
+			return fmt.Errorf("duplicate key name %s", name)
+		}
+		names[name] = true
+	}
+	return nil
+}
+
+// validateSecret returns the problems of a secret's reference and options
+func validateSecret(secret secretRef) []string {
+	var problems []string
+	fail := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf("secret %s: ", secret.Name)+fmt.Sprintf(format, args...))
+	}
+
+	region, err := validateReference(secret)
+	if err != nil {
+		fail("%v", err)
+	}
+	if secret.Region != "" {
+		if !regionPattern.MatchString(secret.Region) {
+			fail("invalid region %q", secret.Region)
+		} else if region != "" && region != secret.Region {
+			fail("region %s does not match the region %s of its ARN", secret.Region, region)
+		}
+	}
+	if secret.RoleARN != "" && !roleARNPattern.MatchString(secret.RoleARN) {
+		fail("invalid role-arn %q, expected arn:aws:iam::<account>:role/<name>", secret.RoleARN)
+	}
+	if (secret.ExternalID != "" || secret.SessionName != "") && secret.RoleARN == "" {
+		fail("external-id and session-name need a role-arn")
+	}
+	if secret.SessionName != "" && !sessionNamePattern.MatchString(secret.SessionName) {
+		fail("invalid session-name %q", secret.SessionName)
+	}
+	if secret.Format != "" && !outputFormats[secret.Format] {
+		fail("unknown format %q", secret.Format)
+	}
+	if secret.Arrays != "" && !arraysModes[secret.Arrays] {
+		fail("unknown arrays setting %q, expected error, json or index", secret.Arrays)
+	}
+	if secret.Backend == annotationBackends[parameterAnnotationPrefix] {
+		ref := strings.SplitN(secret.ARN, "#", 2)[0]
+		byPath := strings.HasSuffix(ref, "/*") || strings.HasSuffix(ref, "/**")
+		if byPath && (secret.VersionID != "" || secret.VersionStage != "") {
+			fail("versions can't be selected for a parameter hierarchy")
+		}
+		if secret.VersionID != "" && secret.VersionStage != "" {
+			fail("a parameter is selected by either version-id or version-stage, not both")
+		}
+		if version, err := strconv.Atoi(secret.VersionID); secret.VersionID != "" && (err != nil || version < 1) {
+			fail("parameter versions are numbers, got version-id %q", secret.VersionID)
+		}
+	}
+	if secret.File != "" && !validFileName(secret.File) {
+		fail("invalid file %q, expected a path relative to the output directory", secret.File)
+	}
+	keys := secret.Keys
+	if i := strings.Index(secret.ARN, "#"); i >= 0 {
+		if keys != "" {
+			fail("keys are set both after the # of the ARN and with the keys option")
+		}
+		keys = secret.ARN[i+1:]
+	}
+	if keys != "" {
+		if err := validateKeys(keys); err != nil {
+			fail("%v", err)
+		}
+	}
+	return problems
+}
+
+// checkPod returns what stops the pod's secrets from being injected, and
+// warnings about what might not do what the pod's author expects.
+func checkPod(pod *corev1.Pod) ([]string, []string) {
+	secrets, _, err := podSecrets(pod)
+	if err != nil {
+		return []string{err.Error()}, nil
+	}
+	var problems, warnings []string
+	for _, secret := range secrets {
+		problems = append(problems, validateSecret(secret)...)
+		if secret.Region == "" && !strings.HasPrefix(secret.ARN, "arn:") {
+			warnings = append(warnings, fmt.Sprintf("secret %s is referenced by name, so it is fetched from the region of the init container's environment or of the node; set %s.region to pin it", secret.Name, secret.Name))
+		}
+	}
+	// the annotations were already checked by podSecrets
+	templates, _ := parseTemplateAnnotations(pod.Annotations)
+	for _, t := range templates {
+		if err := validateTemplate(t); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	for _, option := range sidecarOnlyOptions {
+		if _, ok := pod.Annotations[injectorOptionPrefix+option]; ok {
+			warnings = append(warnings, fmt.Sprintf("%s%s is only used by the sidecar the /mutating-pods-sidecar webhook injects", injectorOptionPrefix, option))
+		}
+	}
+	return problems, warnings
+}
+
+// templateFunc stands in for the functions the fetcher adds to its
+// templates, which only need to be known to parse them
+func templateFunc(...interface{}) interface{} { return nil }
+
+// the functions the fetcher's templates can use on top of the builtins
+var templateFuncs = template.FuncMap{
+	"b64enc":   templateFunc,
+	"b64dec":   templateFunc,
+	"jsonPath": templateFunc,
+	"default":  templateFunc,
+	"toJSON":   templateFunc,
+}
+
+// validateTemplate parses the template as the fetcher does, so syntax
+// errors and unknown functions are reported when the pod is created
+// rather than by its init container.
+func validateTemplate(t templateRef) error {
+	if _, err := template.New(t.Output).Funcs(templateFuncs).Parse(t.Template); err != nil {
+		return fmt.Errorf("invalid template %s%s: %v", templateAnnotationPrefix, t.Output, err)
+	}
+	return nil
+}
+
+// hasSecretAnnotations tells whether the pod asks for the injector at all
+func hasSecretAnnotations(pod *corev1.Pod) bool {
+	for annotation := range pod.Annotations {
+		if annotationPrefix(annotation) != "" || strings.HasPrefix(annotation, injectorOptionPrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// decodePod decodes the pod of a pods admission request
+func decodePod(ar v1.AdmissionReview) (*corev1.Pod, error) {
+	podResource := metav1.GroupVersionResource{Group: "", Version: "v1", Resource: "pods"}
+	if ar.Request.Resource != podResource {
+		return nil, fmt.Errorf("expect resource to be %s", podResource)
+	}
+	pod := corev1.Pod{}
+	deserializer := codecs.UniversalDeserializer()
+	if _, _, err := deserializer.Decode(ar.Request.Object.Raw, nil, &pod); err != nil {
+		return nil, err
+	}
+	if pod.Namespace == "" {
+		pod.Namespace = ar.Request.Namespace
+	}
+	return &pod, nil
+}
+
+// validatePods denies pods whose secret annotations the init container
+// would fail on, listing every problem so they can all be fixed at once.
+func validatePods(ar v1.AdmissionReview) *v1.AdmissionResponse {
+	klog.V(2).Info("validating pods")
+	pod, err := decodePod(ar)
+	if err != nil {
+		klog.Error(err)
+		return toV1AdmissionResponse(err)
+	}
+	if !hasSecretAnnotations(pod) {
+		return &v1.AdmissionResponse{Allowed: true}
+	}
+	problems, _ := checkPod(pod)
+	if len(problems) > 0 {
+		return &v1.AdmissionResponse{
+			Result: &metav1.Status{
+				Status:  metav1.StatusFailure,
+				Reason:  metav1.StatusReasonInvalid,
+				Code:    422,
+				Message: "invalid secret annotations: " + strings.Join(problems, "; "),
+			},
+		}
+	}
+	return &v1.AdmissionResponse{Allowed: true}
+}
+
+// podWarnings returns the warnings shown to the user applying the pod
+func podWarnings(ar v1.AdmissionReview) []string {
+	pod, err := decodePod(ar)
+	if err != nil || !hasSecretAnnotations(pod) {
+		return nil
+	}
+	_, warnings := checkPod(pod)
+	return warnings
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	v1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func podReview(t *testing.T, annotations map[string]string) v1.AdmissionReview {
+	pod := corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Annotations: annotations},
+		Spec: corev1.PodSpec{
+			InitContainers: []corev1.Container{{Name: "migrate"}},
+			Containers:     []corev1.Container{{Name: "app"}, {Name: "proxy"}},
+		},
+	}
+	raw, err := json.Marshal(pod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v1.AdmissionReview{Request: &v1.AdmissionRequest{
+		Namespace: "default",
+		Resource:  metav1.GroupVersionResource{Version: "v1", Resource: "pods"},
+		Object:    runtime.RawExtension{Raw: raw},
+	}}
+}
+
+func TestValidatePods(t *testing.T) {
+	const dbARN = "arn:aws:secretsmanager:us-east-1:123456789012:secret:db-AbCdEf"
+	testCases := []struct {
+		name        string
+		annotations map[string]string
+		// every string the denial should contain, none when allowed
+		denied []string
+	}{
+		{
+			name: "no annotations",
+		},
+		{
+			name: "valid secrets",
+			annotations: map[string]string{
+				"secrets.k8s.aws/db":                  dbARN + "#password=DB_PASSWORD",
+				"secrets.k8s.aws/db.role-arn":         "arn:aws:iam::123456789012:role/reader",
+				"secrets.k8s.aws/db.session-name":     "app",
+				"secrets.k8s.aws/db.containers":       "app",
+				"secrets.k8s.aws/api":                 "api-key",
+				"secrets.k8s.aws/api.region":          "eu-west-1",
+				"secrets.k8s.aws/api.format":          "json",
+				"parameters.k8s.aws/config":           "/app/config/*",
+				"parameters.k8s.aws/url":              "arn:aws:ssm:us-east-1:123456789012:parameter/app/url",
+				"parameters.k8s.aws/url.version-id":   "3",
+				"injector.secrets.k8s.aws/containers": "proxy",
+				"injector.secrets.k8s.aws/file-name":  "env",
+				"injector.secrets.k8s.aws/mount-path": "/secrets",
+				"injector.secrets.k8s.aws/file-mode":  "0400",
+				"unrelated.example.com/annotation":    "kept",
+				"secrets.k8s.aws/api.arrays":          "index",
+				"secrets.k8s.aws/api.keys":            "token, user=API_USER",
+				"parameters.k8s.aws/url.file":         "config/url",
+				"parameters.k8s.aws/config.separator": "_",
+				"secrets.k8s.aws/db.external-id":      "abc",
+			},
+		},
+		{
+			name: "malformed ARNs",
+			annotations: map[string]string{
+				"secrets.k8s.aws/db":     "arn:aws:secretsmanager:us-east-1:123456789012:db",
+				"secrets.k8s.aws/api":    "arn:aws:ssm:us-east-1:123456789012:parameter/api",
+				"parameters.k8s.aws/url": "arn:aws:ssm:us-east-1:12345:parameter/app/*",
+				"secrets.k8s.aws/colon":  "arn:aws:secretsmanager:us-east-1:999999999999:secret:x:111111111111:secret:payments/db",
+			},
+			denied: []string{
+				"secret db: arn:aws:secretsmanager:us-east-1:123456789012:db does not name a secret",
+				"secret api: arn:aws:ssm:us-east-1:123456789012:parameter/api is not a secrets manager ARN",
+				"secret url: arn:aws:ssm:us-east-1:12345:parameter/app/*: parameter hierarchies are referenced by path",
+				`has an invalid secret name "x:111111111111:secret:payments/db"`,
+			},
+		},
+		{
+			name: "regions",
+			annotations: map[string]string{
+				"secrets.k8s.aws/db":         dbARN,
+				"secrets.k8s.aws/db.region":  "eu-west-1",
+				"secrets.k8s.aws/api":        "api-key",
+				"secrets.k8s.aws/api.region": "Europe",
+				"secrets.k8s.aws/bad":        "arn:aws:secretsmanager:useast:123456789012:secret:bad",
+			},
+			denied: []string{
+				"secret db: region eu-west-1 does not match the region us-east-1 of its ARN",
+				`secret api: invalid region "Europe"`,
+				`has an invalid region "useast"`,
+			},
+		},
+		{
+			name: "options",
+			annotations: map[string]string{
+				"secrets.k8s.aws/db":                 dbARN + "#password,password",
+				"secrets.k8s.aws/db.format":          "toml",
+				"secrets.k8s.aws/db.arrays":          "flatten",
+				"secrets.k8s.aws/db.role-arn":        "reader",
+				"secrets.k8s.aws/db.file":            "../db",
+				"secrets.k8s.aws/api":                "api key",
+				"secrets.k8s.aws/api.session-name":   "app",
+				"parameters.k8s.aws/url":             "app/url",
+				"parameters.k8s.aws/conf":            "/app/*",
+				"parameters.k8s.aws/conf.version-id": "2",
+				"parameters.k8s.aws/key":             "/app/key",
+				"parameters.k8s.aws/key.version-id":  "latest",
+			},
+			denied: []string{
+				"duplicate key name password",
+				`unknown format "toml"`,
+				`unknown arrays setting "flatten"`,
+				`invalid role-arn "reader"`,
+				`invalid file "../db"`,
+				`"api key" is neither an ARN nor a valid secret name`,
+				"secret api: external-id and session-name need a role-arn",
+				`parameter "app/url" must start with /`,
+				"secret conf: versions can't be selected for a parameter hierarchy",
+				`parameter versions are numbers, got version-id "latest"`,
+			},
+		},
+		{
+			name: "unknown container",
+			annotations: map[string]string{
+				"secrets.k8s.aws/db":            dbARN,
+				"secrets.k8s.aws/db.containers": "app,worker",
+			},
+			denied: []string{`secret db lists container "worker" but the pod has no such container`},
+		},
+		{
+			name: "invalid pod option",
+			annotations: map[string]string{
+				"secrets.k8s.aws/db":                 dbARN,
+				"injector.secrets.k8s.aws/file-mode": "rw",
+			},
+			denied: []string{`invalid value "rw" for injector.secrets.k8s.aws/file-mode`},
+		},
+		{
+			name: "valid templates",
+			annotations: map[string]string{
+				"secrets.k8s.aws/db":                       dbARN,
+				"injector.secrets.k8s.aws/template.db.env": `DB={{ .db.password | b64enc }} {{ jsonPath "$.host" .db | toJSON }} {{ default "x" .db.user | b64dec }}`,
+			},
+		},
+		{
+			name: "invalid templates",
+			annotations: map[string]string{
+				"secrets.k8s.aws/db":                              dbARN,
+				"injector.secrets.k8s.aws/template.unclosed.conf": "{{ .db.password",
+				"injector.secrets.k8s.aws/template.unknown.conf":  "{{ .db.password | sha256 }}",
+			},
+			denied: []string{
+				"invalid template injector.secrets.k8s.aws/template.unclosed.conf: template: unclosed.conf:1: unclosed action",
+				`invalid template injector.secrets.k8s.aws/template.unknown.conf: template: unknown.conf:1: function "sha256" not defined`,
+			},
+		},
+		{
+			name: "options of a missing secret",
+			annotations: map[string]string{
+				"secrets.k8s.aws/db.region": "us-east-1",
+			},
+			denied: []string{`options for secret "db" but secrets.k8s.aws/db is not set`},
+		},
+	}
+	for _, testcase := range testCases {
+		response := validatePods(podReview(t, testcase.annotations))
+		if len(testcase.denied) == 0 {
+			if !response.Allowed {
+				t.Errorf("%s: expected the pod to be allowed, got %s", testcase.name, response.Result.Message)
+			}
+			continue
+		}
+		if response.Allowed {
+			t.Errorf("%s: expected the pod to be denied", testcase.name)
+			continue
+		}
+		if response.Result.Reason != metav1.StatusReasonInvalid {
+			t.Errorf("%s: expected reason %s, got %s", testcase.name, metav1.StatusReasonInvalid, response.Result.Reason)
+		}
+		for _, message := range testcase.denied {
+			if !strings.Contains(response.Result.Message, message) {
+				t.Errorf("%s: expected the denial to contain %q, got %s", testcase.name, message, response.Result.Message)
+			}
+		}
+	}
+}
+
+func TestValidatePodsPolicy(t *testing.T) {
+	p, err := parsePolicy([]byte(testPolicy))
+	if err != nil {
+		t.Fatal(err)
+	}
+	injectionPolicy = &policyLoader{current: p}
+	defer func() { injectionPolicy = nil }()
+
+	response := validatePods(podReview(t, map[string]string{"secrets.k8s.aws/db": "payments/db"}))
+	if response.Allowed || !strings.Contains(response.Result.Message, "policy doesn't allow") {
+		t.Errorf("expected the policy to deny the pod, got %+v", response)
+	}
+}
+
+func TestPodWarnings(t *testing.T) {
+	warnings := podWarnings(podReview(t, map[string]string{
+		"secrets.k8s.aws/db":                        "arn:aws:secretsmanager:us-east-1:123456789012:secret:db-AbCdEf",
+		"secrets.k8s.aws/api":                       "api-key",
+		"injector.secrets.k8s.aws/refresh-interval": "5m",
+	}))
+	expected := []string{"secret api is referenced by name", "refresh-interval is only used by the sidecar"}
+	if len(warnings) != len(expected) {
+		t.Fatalf("expected %d warnings, got %q", len(expected), warnings)
+	}
+	for i, warning := range warnings {
+		if !strings.Contains(warning, expected[i]) {
+			t.Errorf("expected warning %d to contain %q, got %q", i, expected[i], warning)
+		}
+	}
+
+	if warnings := podWarnings(podReview(t, nil)); warnings != nil {
+		t.Errorf("expected no warnings for a pod without secrets, got %q", warnings)
+	}
+}
+
+func TestAddWarnings(t *testing.T) {
+	review := []byte(`{"kind":"AdmissionReview","response":{"uid":"1","allowed":true}}`)
+	out, err := addWarnings(review, []string{"first", "second"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded struct {
+		Kind     string
+		Response struct {
+			UID      string
+			Allowed  bool
+			Warnings []string
+		}
+	}
+	if err := json.Unmarshal(out, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Kind != "AdmissionReview" || decoded.Response.UID != "1" || !decoded.Response.Allowed {
+		t.Errorf("expected the review to be kept, got %s", out)
+	}
+	if !reflect.DeepEqual(decoded.Response.Warnings, []string{"first", "second"}) {
+		t.Errorf("expected the warnings to be set, got %s", out)
+	}
+
+	if out, err := addWarnings(review, nil); err != nil || string(out) != string(review) {
+		t.Errorf("expected the review to be unchanged without warnings, got %s, %v", out, err)
+	}
+}
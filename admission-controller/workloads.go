@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	v1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog"
+)
+
+// workloadTemplates is the path of the pod template in the workloads the
+// webhook checks, by resource. CronJobs are batch/v1beta1 before
+// Kubernetes 1.21.
+var workloadTemplates = map[metav1.GroupVersionResource][]string{
+	{Group: "apps", Version: "v1", Resource: "deployments"}:    {"spec", "template"},
+	{Group: "apps", Version: "v1", Resource: "statefulsets"}:   {"spec", "template"},
+	{Group: "apps", Version: "v1", Resource: "daemonsets"}:     {"spec", "template"},
+	{Group: "batch", Version: "v1", Resource: "jobs"}:          {"spec", "template"},
+	{Group: "batch", Version: "v1", Resource: "cronjobs"}:      {"spec", "jobTemplate", "spec", "template"},
+	{Group: "batch", Version: "v1beta1", Resource: "cronjobs"}: {"spec", "jobTemplate", "spec", "template"},
+}
+
+// templatePod returns the pod the workload's template makes, in the
+// workload's namespace, and the JSON pointer to the template. The template
+// is found by path rather than by decoding the workload, so any version of
+// the workloads with the same layout is handled alike.
+func templatePod(ar v1.AdmissionReview) (*corev1.Pod, string, error) {
+	path, ok := workloadTemplates[ar.Request.Resource]
+	if !ok {
+		return nil, "", fmt.Errorf("unexpected resource %s", ar.Request.Resource)
+	}
+	var node interface{}
+	if err := json.Unmarshal(ar.Request.Object.Raw, &node); err != nil {
+		return nil, "", err
+	}
+	for _, key := range path {
+		object, ok := node.(map[string]interface{})
+		if !ok {
+			return nil, "", fmt.Errorf("%s has no pod template at %s", ar.Request.Resource.Resource, strings.Join(path, "."))
+		}
+		node = object[key]
+	}
+	data, err := json.Marshal(node)
+	if err != nil {
+		return nil, "", err
+	}
+	var template corev1.PodTemplateSpec
+	if err := json.Unmarshal(data, &template); err != nil {
+		return nil, "", err
+	}
+	pod := &corev1.Pod{ObjectMeta: template.ObjectMeta, Spec: template.Spec}
+	pod.Namespace = ar.Request.Namespace
+	return pod, "/" + strings.Join(path, "/"), nil
+}
+
+// validateWorkloads denies workloads whose pod template has secret
+// annotations the pods it makes would be denied for, so the error shows
+// when the workload is applied rather than as events of its ReplicaSet.
+func validateWorkloads(ar v1.AdmissionReview) *v1.AdmissionResponse {
+	klog.V(2).Info("validating workloads")
+	pod, _, err := templatePod(ar)
+	if err != nil {
+		klog.Error(err)
+		return toV1AdmissionResponse(err)
+	}
+	if !hasSecretAnnotations(pod) {
+		return &v1.AdmissionResponse{Allowed: true}
+	}
+	problems, _ := checkPod(pod)
+	if len(problems) > 0 {
+		return &v1.AdmissionResponse{
+			Result: &metav1.Status{
+				Status:  metav1.StatusFailure,
+				Reason:  metav1.StatusReasonInvalid,
+				Code:    422,
+				Message: "invalid secret annotations in the pod template: " + strings.Join(problems, "; "),
+			},
+		}
+	}
+	return &v1.AdmissionResponse{Allowed: true}
+}
+
+// workloadWarnings returns the warnings about the workload's pod template
+func workloadWarnings(ar v1.AdmissionReview) []string {
+	pod, _, err := templatePod(ar)
+	if err != nil || !hasSecretAnnotations(pod) {
+		return nil
+	}
+	_, warnings := checkPod(pod)
+	return warnings
+}
+
+// previewWorkloads patches the pod template of dry-run requests as the
+// pods it makes will be patched, so kubectl diff and server-side dry runs
+// show the injected containers. Workloads actually stored are left alone,
+// their pods being mutated when they are created.
+func previewWorkloads(ar v1.AdmissionReview) *v1.AdmissionResponse {
+	return previewWorkloadPatch(ar, needsInitContainer, injectSecrets)
+}
+
+// previewWorkloadsSidecar previews the sidecar as previewWorkloads does
+// the init container
+func previewWorkloadsSidecar(ar v1.AdmissionReview) *v1.AdmissionResponse {
+	return previewWorkloadPatch(ar, needsSidecar, addSidecar)
+}
+
+// previewWorkloadPatch responds to dry-run requests with the patch mutate
+// makes to the pod of the workload's template, moved under the template.
+func previewWorkloadPatch(ar v1.AdmissionReview, shouldPatchPod func(*corev1.Pod) bool, mutate func(*corev1.Pod) error) *v1.AdmissionResponse {
+	reviewResponse := v1.AdmissionResponse{Allowed: true}
+	if ar.Request.DryRun == nil || !*ar.Request.DryRun {
+		return &reviewResponse
+	}
+	klog.V(2).Info("previewing workloads")
+	pod, templatePath, err := templatePod(ar)
+	if err != nil {
+		klog.Error(err)
+		return toV1AdmissionResponse(err)
+	}
+	if !shouldPatchPod(pod) {
+		return &reviewResponse
+	}
+	desired := pod.DeepCopy()
+	if err := mutate(desired); err != nil {
+		klog.Error(err)
+		return toV1AdmissionResponse(err)
+	}
+	// the namespace set on the pod isn't part of the template, and is the
+	// same on both sides so it doesn't show in the patch
+	ops, err := createPatch(
+		corev1.PodTemplateSpec{ObjectMeta: pod.ObjectMeta, Spec: pod.Spec},
+		corev1.PodTemplateSpec{ObjectMeta: desired.ObjectMeta, Spec: desired.Spec},
+		setSeccompProfiles,
+	)
+	if err != nil {
+		klog.Error(err)
+		return toV1AdmissionResponse(err)
+	}
+	for i := range ops {
+		ops[i].Path = templatePath + ops[i].Path
+	}
+	if err := setPatch(&reviewResponse, ops); err != nil {
+		klog.Error(err)
+		return toV1AdmissionResponse(err)
+	}
+	return &reviewResponse
+}
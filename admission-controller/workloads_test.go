@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	v1 "k8s.io/api/admission/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	batchv1beta1 "k8s.io/api/batch/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func podTemplate(annotations map[string]string) corev1.PodTemplateSpec {
+	return corev1.PodTemplateSpec{
+		ObjectMeta: metav1.ObjectMeta{Annotations: annotations, Labels: map[string]string{"app": "web"}},
+		Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "app", Image: "app"}}},
+	}
+}
+
+func workloadReview(t *testing.T, resource metav1.GroupVersionResource, workload interface{}, dryRun bool) v1.AdmissionReview {
+	raw, err := json.Marshal(workload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v1.AdmissionReview{Request: &v1.AdmissionRequest{
+		Namespace: "default",
+		Resource:  resource,
+		Object:    runtime.RawExtension{Raw: raw},
+		DryRun:    &dryRun,
+	}}
+}
+
+var (
+	deploymentsResource = metav1.GroupVersionResource{Group: "apps", Version: "v1", Resource: "deployments"}
+	cronJobsResource    = metav1.GroupVersionResource{Group: "batch", Version: "v1beta1", Resource: "cronjobs"}
+)
+
+func TestValidateWorkloads(t *testing.T) {
+	valid := map[string]string{"secrets.k8s.aws/db": "arn:aws:secretsmanager:us-east-1:123456789012:secret:db-AbCdEf"}
+	invalid := map[string]string{"secrets.k8s.aws/db": "db", "secrets.k8s.aws/db.region": "Europe"}
+
+	testCases := []struct {
+		name     string
+		resource metav1.GroupVersionResource
+		workload interface{}
+		allowed  bool
+	}{
+		{
+			name: "valid deployment", resource: deploymentsResource, allowed: true,
+			workload: appsv1.Deployment{Spec: appsv1.DeploymentSpec{Template: podTemplate(valid)}},
+		},
+		{
+			name: "invalid deployment", resource: deploymentsResource,
+			workload: appsv1.Deployment{Spec: appsv1.DeploymentSpec{Template: podTemplate(invalid)}},
+		},
+		{
+			name: "invalid statefulset", resource: metav1.GroupVersionResource{Group: "apps", Version: "v1", Resource: "statefulsets"},
+			workload: appsv1.StatefulSet{Spec: appsv1.StatefulSetSpec{Template: podTemplate(invalid)}},
+		},
+		{
+			name: "invalid job", resource: metav1.GroupVersionResource{Group: "batch", Version: "v1", Resource: "jobs"},
+			workload: batchv1.Job{Spec: batchv1.JobSpec{Template: podTemplate(invalid)}},
+		},
+		{
+			name: "valid cronjob", resource: cronJobsResource, allowed: true,
+			workload: batchv1beta1.CronJob{Spec: batchv1beta1.CronJobSpec{JobTemplate: batchv1beta1.JobTemplateSpec{
+				Spec: batchv1.JobSpec{Template: podTemplate(valid)},
+			}}},
+		},
+		{
+			name: "invalid cronjob", resource: cronJobsResource,
+			workload: batchv1beta1.CronJob{Spec: batchv1beta1.CronJobSpec{JobTemplate: batchv1beta1.JobTemplateSpec{
+				Spec: batchv1.JobSpec{Template: podTemplate(invalid)},
+			}}},
+		},
+		{
+			name: "no secrets", resource: deploymentsResource, allowed: true,
+			workload: appsv1.Deployment{Spec: appsv1.DeploymentSpec{Template: podTemplate(nil)}},
+		},
+	}
+	for _, testcase := range testCases {
+		response := validateWorkloads(workloadReview(t, testcase.resource, testcase.workload, false))
+		if response.Allowed != testcase.allowed {
+			t.Errorf("%s: expected allowed %v, got %+v", testcase.name, testcase.allowed, response.Result)
+			continue
+		}
+		if !testcase.allowed && !strings.Contains(response.Result.Message, `pod template: secret db: invalid region "Europe"`) {
+			t.Errorf("%s: expected the denial to name the problem, got %s", testcase.name, response.Result.Message)
+		}
+	}
+
+	response := validateWorkloads(workloadReview(t, metav1.GroupVersionResource{Version: "v1", Resource: "pods"}, corev1.Pod{}, false))
+	if response.Allowed {
+		t.Error("expected pods to be rejected by the workloads handler")
+	}
+}
+
+func TestPreviewWorkloads(t *testing.T) {
+	sidecarImage = "test-image"
+	annotations := map[string]string{"secrets.k8s.aws/db": "arn:aws:secretsmanager:us-east-1:123456789012:secret:db-AbCdEf"}
+	deployment := appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "web"},
+		Spec:       appsv1.DeploymentSpec{Template: podTemplate(annotations)},
+	}
+	cronJob := batchv1beta1.CronJob{Spec: batchv1beta1.CronJobSpec{JobTemplate: batchv1beta1.JobTemplateSpec{
+		Spec: batchv1.JobSpec{Template: podTemplate(annotations)},
+	}}}
+
+	preview := func(review v1.AdmissionReview, preview func(v1.AdmissionReview) *v1.AdmissionResponse, into interface{}) bool {
+		t.Helper()
+		response := preview(review)
+		if !response.Allowed {
+			t.Fatalf("expected the workload to be allowed, got %+v", response.Result)
+		}
+		if response.PatchType == nil {
+			return false
+		}
+		var ops []patchOperation
+		if err := json.Unmarshal(response.Patch, &ops); err != nil {
+			t.Fatal(err)
+		}
+		applyRawPatch(t, review.Request.Object.Raw, ops, into)
+		return true
+	}
+
+	patched := appsv1.Deployment{}
+	if !preview(workloadReview(t, deploymentsResource, deployment, true), previewWorkloads, &patched) {
+		t.Fatal("expected a dry run to be patched")
+	}
+	template := patched.Spec.Template
+	if len(template.Spec.InitContainers) != 1 || template.Spec.InitContainers[0].Name != initContainerName {
+		t.Errorf("expected the init container in the template, got %+v", template.Spec.InitContainers)
+	}
+	if len(template.Spec.Volumes) != 1 || template.Spec.Volumes[0].Name != secretsVolumeName {
+		t.Errorf("expected the secrets volume in the template, got %+v", template.Spec.Volumes)
+	}
+	if patched.Name != "web" || template.Namespace != "" || len(template.Labels) != 1 {
+		t.Errorf("expected only the template's spec to change, got %+v", patched)
+	}
+
+	patched = appsv1.Deployment{}
+	if !preview(workloadReview(t, deploymentsResource, deployment, true), previewWorkloadsSidecar, &patched) {
+		t.Fatal("expected a dry run to be patched with the sidecar")
+	}
+	if !hasContainer(patched.Spec.Template.Spec.Containers, sidecarContainerName) || !hasContainer(patched.Spec.Template.Spec.InitContainers, initContainerName) {
+		t.Errorf("expected the sidecar and init container in the template, got %+v", patched.Spec.Template.Spec)
+	}
+
+	patchedCronJob := batchv1beta1.CronJob{}
+	if !preview(workloadReview(t, cronJobsResource, cronJob, true), previewWorkloads, &patchedCronJob) {
+		t.Fatal("expected a dry run of a cronjob to be patched")
+	}
+	if !hasContainer(patchedCronJob.Spec.JobTemplate.Spec.Template.Spec.InitContainers, initContainerName) {
+		t.Errorf("expected the init container in the job template, got %+v", patchedCronJob.Spec.JobTemplate.Spec.Template.Spec)
+	}
+
+	if preview(workloadReview(t, deploymentsResource, deployment, false), previewWorkloads, &patched) {
+		t.Error("expected a stored workload not to be patched")
+	}
+	deployment.Spec.Template = podTemplate(nil)
+	if preview(workloadReview(t, deploymentsResource, deployment, true), previewWorkloads, &patched) {
+		t.Error("expected a workload without secrets not to be patched")
+	}
+}
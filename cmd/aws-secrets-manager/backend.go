@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+)
+
+// services secrets can be fetched from
+const (
+	backendSecretsManager = "secretsmanager"
+	backendParameterStore = "ssm"
+)
+
+// backend fetches secrets from one AWS service
+type backend interface {
+	// validate checks the spec references something the service could
+	// hold, before any call is made.
+	validate(spec secretSpec) error
+
+	// fetch retrieves the secret value for a spec, retrying as the
+	// policy allows until the context is done.
+	fetch(ctx context.Context, clients *clientCache, policy retryPolicy, spec secretSpec) (secretValue, error)
+}
+
+// versioner is implemented by backends which can tell the version of a
+// secret without fetching its value, so refreshing a secret which hasn't
+// changed costs less.
+type versioner interface {
+	// version returns the version of the secret the spec selects, as
+	// set on the values fetch returns.
+	version(ctx context.Context, clients *clientCache, policy retryPolicy, spec secretSpec) (string, error)
+}
+
+// backends by the name secrets select them with
+var backends = map[string]backend{
+	backendSecretsManager: secretsManagerBackend{},
+	backendParameterStore: parameterStoreBackend{},
+}
+
+// backendFor returns the backend of the spec, secrets manager unless the
+// spec picks another one. collectSpecs rejects unknown backends.
+func backendFor(spec secretSpec) backend {
+	if b, ok := backends[spec.Backend]; ok {
+		return b
+	}
+	return backends[backendSecretsManager]
+}
+
+// fetchSecret retrieves the secret value for a spec from its backend
+func fetchSecret(ctx context.Context, clients *clientCache, policy retryPolicy, spec secretSpec) (secretValue, error) {
+	return backendFor(spec).fetch(ctx, clients, policy, spec)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"regexp"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/aws/aws-sdk-go/service/ssm"
+)
+
+// session name used when assuming a role if the secret doesn't set one
+const defaultSessionName = "aws-secret-sidecar-injector"
+
+// characters STS accepts in a role session name
+var sessionNamePattern = regexp.MustCompile(`^[\w+=,.@-]{2,64}$`)
+
+// roleKey identifies the credentials of an assumed role
+type roleKey struct {
+	roleARN     string
+	externalID  string
+	sessionName string
+}
+
+// clientKey identifies the clients of a region and role
+type clientKey struct {
+	region string
+	role   roleKey
+}
+
+// clientCache hands out one client per service, region and role so that
+// secrets in the same region share a client. Assumed role credentials are
+// shared by all the secrets using the role, whatever their region and
+// service, so the role is only assumed once.
+type clientCache struct {
+	sess           *session.Session
+	mu             sync.Mutex
+	secretsManager map[clientKey]*secretsmanager.SecretsManager
+	parameterStore map[clientKey]*ssm.SSM
+	roles          map[roleKey]*credentials.Credentials
+}
+
+func newClientCache(sess *session.Session) *clientCache {
+	return &clientCache{
+		sess:           sess,
+		secretsManager: map[clientKey]*secretsmanager.SecretsManager{},
+		parameterStore: map[clientKey]*ssm.SSM{},
+		roles:          map[roleKey]*credentials.Credentials{},
+	}
+}
+
+func specKey(spec secretSpec) clientKey {
+	return clientKey{
+		region: spec.Region,
+		role:   roleKey{roleARN: spec.RoleARN, externalID: spec.ExternalID, sessionName: spec.SessionName},
+	}
+}
+
+// getSecretsManager returns the secrets manager client for the spec's
+// region and role
+func (c *clientCache) getSecretsManager(spec secretSpec) *secretsmanager.SecretsManager {
+	key := specKey(spec)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if svc, ok := c.secretsManager[key]; ok {
+		return svc
+	}
+	svc := secretsmanager.New(c.sess, c.config(key))
+	c.secretsManager[key] = svc
+	return svc
+}
+
+// getParameterStore returns the SSM client for the spec's region and role
+func (c *clientCache) getParameterStore(spec secretSpec) *ssm.SSM {
+	key := specKey(spec)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if svc, ok := c.parameterStore[key]; ok {
+		return svc
+	}
+	svc := ssm.New(c.sess, c.config(key))
+	c.parameterStore[key] = svc
+	return svc
+}
+
+// config of the clients for the key. Must be called with the lock held.
+func (c *clientCache) config(key clientKey) *aws.Config {
+	// retries are done by retryPolicy
+	config := &aws.Config{
+		Region:     aws.String(key.region),
+		MaxRetries: aws.Int(0),
+	}
+	if key.role.roleARN != "" {
+		config.Credentials = c.roleCredentials(key)
+	}
+	return config
+}
+
+// roleCredentials returns the credentials for assuming the key's role
+// with the session's own credentials, IRSA in a pod. The credentials are
+// only fetched from STS when first used, and refreshed before they
+// expire. Must be called with the lock held.
+func (c *clientCache) roleCredentials(key clientKey) *credentials.Credentials {
+	if creds, ok := c.roles[key.role]; ok {
+		return creds
+	}
+	// STS is called in the region of the first secret using the role
+	stsSess := c.sess.Copy(&aws.Config{Region: aws.String(key.region)})
+	creds := stscreds.NewCredentials(stsSess, key.role.roleARN, func(p *stscreds.AssumeRoleProvider) {
+		p.RoleSessionName = key.role.sessionName
+		if key.role.externalID != "" {
+			p.ExternalID = aws.String(key.role.externalID)
+		}
+	})
+	c.roles[key.role] = creds
+	return creds
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const assumeRoleResponse = `<AssumeRoleResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+  <AssumeRoleResult>
+    <Credentials>
+      <AccessKeyId>ASIAASSUMED</AccessKeyId>
+      <SecretAccessKey>assumed-secret</SecretAccessKey>
+      <SessionToken>assumed-token</SessionToken>
+      <Expiration>%s</Expiration>
+    </Credentials>
+    <AssumedRoleUser>
+      <Arn>arn:aws:sts::210987654321:assumed-role/secrets-reader/%s</Arn>
+      <AssumedRoleId>AROAEXAMPLE:%s</AssumedRoleId>
+    </AssumedRoleUser>
+  </AssumeRoleResult>
+  <ResponseMetadata><RequestId>1</RequestId></ResponseMetadata>
+</AssumeRoleResponse>`
+
+func TestAssumeRoleIsShared(t *testing.T) {
+	var assumes, fetches int32
+	var badAuth int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Amz-Target") == "" {
+			// STS speaks the query protocol
+			r.ParseForm()
+			if r.Form.Get("Action") != "AssumeRole" || r.Form.Get("RoleArn") != "arn:aws:iam::210987654321:role/secrets-reader" || r.Form.Get("ExternalId") != "ext-123" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			atomic.AddInt32(&assumes, 1)
+			session := r.Form.Get("RoleSessionName")
+			fmt.Fprintf(w, assumeRoleResponse, time.Now().Add(time.Hour).UTC().Format(time.RFC3339), session, session)
+			return
+		}
+		atomic.AddInt32(&fetches, 1)
+		if !strings.Contains(r.Header.Get("Authorization"), "Credential=ASIAASSUMED/") {
+			atomic.AddInt32(&badAuth, 1)
+		}
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		fmt.Fprintf(w, `{"ARN":%q,"Name":"db","SecretString":"{}"}`, testSecretArn)
+	}))
+	defer server.Close()
+	clients := testClients(t, server.URL)
+
+	policy := retryPolicy{maxAttempts: 1}
+	specs := []secretSpec{
+		{Name: "east", ARN: "arn:aws:secretsmanager:us-east-1:210987654321:secret:db", Region: "us-east-1"},
+		{Name: "west", ARN: "arn:aws:secretsmanager:us-west-2:210987654321:secret:db", Region: "us-west-2"},
+		{Name: "east-again", ARN: "arn:aws:secretsmanager:us-east-1:210987654321:secret:api", Region: "us-east-1"},
+	}
+	for i := range specs {
+		specs[i].RoleARN = "arn:aws:iam::210987654321:role/secrets-reader"
+		specs[i].ExternalID = "ext-123"
+		specs[i].SessionName = defaultSessionName
+		if _, err := fetchSecret(context.Background(), clients, policy, specs[i]); err != nil {
+			t.Fatalf("%s: %v", specs[i].Name, err)
+		}
+	}
+
+	if assumes != 1 {
+		t.Errorf("expected the role to be assumed once, got %d", assumes)
+	}
+	if fetches != 3 || badAuth != 0 {
+		t.Errorf("expected 3 fetches with the assumed credentials, got %d with %d using other credentials", fetches, badAuth)
+	}
+
+	// secrets without a role keep using the session's credentials
+	withRole := clients.getSecretsManager(specs[0])
+	withoutRole := clients.getSecretsManager(secretSpec{Region: "us-east-1"})
+	if withRole == withoutRole || withoutRole.Config.Credentials == withRole.Config.Credentials {
+		t.Errorf("expected secrets without a role not to share the assumed credentials")
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+// env vars overriding the endpoint of a service, AWS_ENDPOINT_URL applies
+// to all of them.
+const (
+	endpointEnv               = "AWS_ENDPOINT_URL"
+	secretsManagerEndpointEnv = "AWS_ENDPOINT_URL_SECRETS_MANAGER"
+	ssmEndpointEnv            = "AWS_ENDPOINT_URL_SSM"
+	stsEndpointEnv            = "AWS_ENDPOINT_URL_STS"
+)
+
+// placeholder replaced by the region of the client in endpoint URLs, for
+// endpoints which differ per region like FIPS or VPC endpoints.
+const regionPlaceholder = "{region}"
+
+// endpointOverrides maps a service's endpoints ID to the URL to use for
+// it instead of the one the SDK would pick.
+type endpointOverrides map[string]string
+
+// defaultEndpoint returns the env var setting the endpoint of a service,
+// falling back on the one for all services.
+func defaultEndpoint(getenv func(string) string, env string) string {
+	if value := getenv(env); value != "" {
+		return value
+	}
+	return getenv(endpointEnv)
+}
+
+// newEndpointOverrides checks the secrets manager, SSM and STS endpoint
+// URLs, empty URLs are left to the SDK.
+func newEndpointOverrides(secretsManagerURL, ssmURL, stsURL string) (endpointOverrides, error) {
+	overrides := endpointOverrides{}
+	for service, endpoint := range map[string]string{
+		secretsmanager.EndpointsID: secretsManagerURL,
+		ssm.EndpointsID:            ssmURL,
+		sts.EndpointsID:            stsURL,
+	} {
+		if endpoint == "" {
+			continue
+		}
+		u, err := url.Parse(strings.Replace(endpoint, regionPlaceholder, "us-east-1", -1))
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return nil, fmt.Errorf("invalid %s endpoint %q, expected an http or https URL", service, endpoint)
+		}
+		overrides[service] = endpoint
+	}
+	return overrides, nil
+}
+
+// EndpointFor implements endpoints.Resolver. Overridden endpoints are
+// signed for the region the client was made for.
+func (o endpointOverrides) EndpointFor(service, region string, opts ...func(*endpoints.Options)) (endpoints.ResolvedEndpoint, error) {
+	endpoint, ok := o[service]
+	if !ok {
+		return endpoints.DefaultResolver().EndpointFor(service, region, opts...)
+	}
+	return endpoints.ResolvedEndpoint{
+		URL:           strings.Replace(endpoint, regionPlaceholder, region, -1),
+		SigningRegion: region,
+		SigningMethod: "v4",
+	}, nil
+}
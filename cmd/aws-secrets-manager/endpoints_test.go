@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/aws-samples/aws-secret-sidecar-injector/fakeaws"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+func TestEndpointOverrides(t *testing.T) {
+	overrides, err := newEndpointOverrides("https://secretsmanager-fips.{region}.amazonaws.com", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	endpoint, err := overrides.EndpointFor("secretsmanager", "us-gov-west-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if endpoint.URL != "https://secretsmanager-fips.us-gov-west-1.amazonaws.com" || endpoint.SigningRegion != "us-gov-west-1" {
+		t.Errorf("unexpected secrets manager endpoint %+v", endpoint)
+	}
+	endpoint, err = overrides.EndpointFor("sts", "eu-west-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sdk, _ := endpoints.DefaultResolver().EndpointFor("sts", "eu-west-1"); endpoint.URL != sdk.URL {
+		t.Errorf("expected the SDK's STS endpoint %s, got %s", sdk.URL, endpoint.URL)
+	}
+
+	for _, invalid := range []string{"secretsmanager.internal", "ftp://example.com", "https://", "http://%zz"} {
+		if _, err := newEndpointOverrides(invalid, "", ""); err == nil {
+			t.Errorf("expected %q to be rejected", invalid)
+		}
+		if _, err := newEndpointOverrides("", "", invalid); err == nil {
+			t.Errorf("expected %q to be rejected as an STS endpoint", invalid)
+		}
+	}
+
+	env := map[string]string{endpointEnv: "http://all", stsEndpointEnv: "http://sts"}
+	getenv := func(name string) string { return env[name] }
+	if e := defaultEndpoint(getenv, secretsManagerEndpointEnv); e != "http://all" {
+		t.Errorf("expected the endpoint for all services, got %q", e)
+	}
+	if e := defaultEndpoint(getenv, stsEndpointEnv); e != "http://sts" {
+		t.Errorf("expected the STS endpoint, got %q", e)
+	}
+}
+
+func TestFetchFromFake(t *testing.T) {
+	server := fakeaws.NewServer()
+	defer server.Close()
+	arn, _ := server.PutSecretString("db", `{"password":"old"}`)
+	server.PutSecretString("db", `{"password":"new"}`)
+	server.FailNext("GetSecretValue", fakeaws.ErrCodeThrottling, 1)
+
+	resolver, err := newEndpointOverrides(server.URL, server.URL, server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess, err := session.NewSession(&aws.Config{
+		EndpointResolver: resolver,
+		Credentials:      credentials.NewStaticCredentials("AKID", "SECRET", ""),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	clients := newClientCache(sess)
+	policy := retryPolicy{maxAttempts: 2}
+
+	testCases := []struct {
+		spec     secretSpec
+		expected string
+	}{
+		{spec: secretSpec{Name: "current", ARN: arn, VersionStage: "AWSCURRENT"}, expected: `{"password":"new"}`},
+		{spec: secretSpec{Name: "previous", ARN: "db", VersionStage: "AWSPREVIOUS"}, expected: `{"password":"old"}`},
+		{spec: secretSpec{
+			Name:         "assumed",
+			ARN:          arn,
+			VersionStage: "AWSCURRENT",
+			RoleARN:      "arn:aws:iam::123456789012:role/secrets-reader",
+			SessionName:  defaultSessionName,
+		}, expected: `{"password":"new"}`},
+	}
+	for _, testcase := range testCases {
+		testcase.spec.Region = "us-east-1"
+		value, err := fetchSecret(context.Background(), clients, policy, testcase.spec)
+		if err != nil {
+			t.Errorf("%s: %v", testcase.spec.Name, err)
+			continue
+		}
+		if string(value.data) != testcase.expected {
+			t.Errorf("%s: expected %s, got %s", testcase.spec.Name, testcase.expected, value.data)
+		}
+	}
+
+	if calls := server.Calls("GetSecretValue"); calls != 4 {
+		t.Errorf("expected 4 calls including the throttled one, got %d", calls)
+	}
+	if calls := server.Calls("AssumeRole"); calls != 1 {
+		t.Errorf("expected the role to be assumed once, got %d", calls)
+	}
+	requests := server.Requests()
+	if last := requests[len(requests)-1]; last.Action != "GetSecretValue" || !strings.HasPrefix(last.AccessKeyID, fakeaws.AssumedKeyPrefix) {
+		t.Errorf("expected the last fetch to use the assumed role, got %+v", last)
+	}
+
+	_, err = fetchSecret(context.Background(), clients, policy, secretSpec{Name: "missing", ARN: "missing", Region: "us-east-1"})
+	if code := awsErrorCode(err); code != exitNotFound {
+		t.Errorf("expected a missing secret to exit with %d, got %d (%v)", exitNotFound, code, err)
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/aws/aws-sdk-go/service/ssm"
+)
+
+// exit codes, one per class of failure so the init container's exit
+// status says why the secrets couldn't be loaded.
+const (
+	exitUnknown       = 1
+	exitInvalidConfig = 2
+	exitAccessDenied  = 3
+	exitNotFound      = 4
+	exitDecryption    = 5
+	exitThrottled     = 6
+	exitMalformed     = 7
+	exitWriteFailure  = 8
+	exitTimeout       = 9
+)
+
+// failure classes as they appear in the logs
+var classNames = map[int]string{
+	exitUnknown:       "unknown",
+	exitInvalidConfig: "invalid_config",
+	exitAccessDenied:  "access_denied",
+	exitNotFound:      "not_found",
+	exitDecryption:    "decryption_failure",
+	exitThrottled:     "throttled",
+	exitMalformed:     "malformed_payload",
+	exitWriteFailure:  "write_failure",
+	exitTimeout:       "timeout",
+}
+
+// default file kubernetes reads the termination message from, and the
+// most it keeps of it.
+const (
+	defaultTerminationLog = "/dev/termination-log"
+	maxTerminationSize    = 4096
+)
+
+// fetchError is a failure to load a secret along with its exit code
+type fetchError struct {
+	code   int
+	secret string
+	err    error
+}
+
+func (e *fetchError) Error() string {
+	if e.secret == "" {
+		return e.err.Error()
+	}
+	return fmt.Sprintf("%s: %v", e.secret, e.err)
+}
+
+func (e *fetchError) Unwrap() error {
+	return e.err
+}
+
+func newError(code int, secret string, err error) *fetchError {
+	return &fetchError{code: code, secret: secret, err: err}
+}
+
+// malformedError marks errors caused by the secret's contents rather than
+// by writing it out.
+type malformedError struct {
+	err error
+}
+
+func (e *malformedError) Error() string {
+	return e.err.Error()
+}
+
+func malformed(format string, args ...interface{}) error {
+	return &malformedError{err: fmt.Errorf(format, args...)}
+}
+
+// awsErrorCode maps the error code returned by AWS to an exit code.
+// Values AWS returned which can't be used are malformed.
+func awsErrorCode(err error) int {
+	var merr *malformedError
+	if errors.As(err, &merr) {
+		return exitMalformed
+	}
+	var aerr awserr.Error
+	if !errors.As(err, &aerr) {
+		return exitUnknown
+	}
+	switch aerr.Code() {
+	case "AccessDeniedException", "AccessDenied", "UnrecognizedClientException",
+		"ExpiredTokenException", "InvalidClientTokenId", "NoCredentialProviders",
+		"WebIdentityErr":
+		return exitAccessDenied
+	case secretsmanager.ErrCodeResourceNotFoundException, ssm.ErrCodeParameterNotFound,
+		ssm.ErrCodeParameterVersionNotFound:
+		return exitNotFound
+	case secretsmanager.ErrCodeDecryptionFailure, ssm.ErrCodeInvalidKeyId:
+		return exitDecryption
+	case "ThrottlingException", "TooManyRequestsException", "RequestLimitExceeded":
+		return exitThrottled
+	case secretsmanager.ErrCodeInvalidParameterException:
+		return exitInvalidConfig
+	case request.CanceledErrorCode:
+		// only the deadline cancels requests
+		return exitTimeout
+	}
+	return exitUnknown
+}
+
+// writeErrorCode tells apart secrets which can't be written in the format
+// asked for from failures writing the files.
+func writeErrorCode(err error) int {
+	var merr *malformedError
+	if errors.As(err, &merr) {
+		return exitMalformed
+	}
+	return exitWriteFailure
+}
+
+// writeTerminationMessage leaves the reason for failing where kubernetes
+// picks it up for kubectl describe pod. Kubernetes only keeps the first
+// 4096 bytes.
+func writeTerminationMessage(path string, ferr *fetchError) {
+	if path == "" {
+		return
+	}
+	message := fmt.Sprintf("%s: %s", classNames[ferr.code], ferr.Error())
+	if len(message) > maxTerminationSize {
+		message = message[:maxTerminationSize]
+	}
+	ioutil.WriteFile(path, []byte(message), 0644)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+func TestErrorCodes(t *testing.T) {
+	testCases := []struct {
+		err      error
+		expected int
+	}{
+		{awserr.New("AccessDeniedException", "not allowed", nil), exitAccessDenied},
+		{awserr.New("ResourceNotFoundException", "no such secret", nil), exitNotFound},
+		{awserr.New("DecryptionFailure", "kms said no", nil), exitDecryption},
+		{awserr.New("ThrottlingException", "slow down", nil), exitThrottled},
+		{awserr.New("InvalidParameterException", "bad stage", nil), exitInvalidConfig},
+		{awserr.New("ParameterNotFound", "", nil), exitNotFound},
+		{awserr.New("ParameterVersionNotFound", "no version 3", nil), exitNotFound},
+		{awserr.New("InvalidKeyId", "key disabled", nil), exitDecryption},
+		{awserr.New("InternalServiceError", "oops", nil), exitUnknown},
+		{malformed("parameter db has parameters below it"), exitMalformed},
+		{errors.New("connection reset"), exitUnknown},
+	}
+	for _, testcase := range testCases {
+		if code := awsErrorCode(testcase.err); code != testcase.expected {
+			t.Errorf("%v: expected exit code %d, got %d", testcase.err, testcase.expected, code)
+		}
+	}
+
+	if code := writeErrorCode(malformed("secret is not a JSON object")); code != exitMalformed {
+		t.Errorf("expected malformed payloads to exit with %d, got %d", exitMalformed, code)
+	}
+	if code := writeErrorCode(&os.PathError{Op: "open", Path: "/tmp/secret", Err: os.ErrPermission}); code != exitWriteFailure {
+		t.Errorf("expected write failures to exit with %d, got %d", exitWriteFailure, code)
+	}
+}
+
+func TestFailureLog(t *testing.T) {
+	var out bytes.Buffer
+	log := &logger{out: &out}
+	spec := secretSpec{Name: "db", ARN: "arn:aws:secretsmanager:us-east-1:123456789012:secret:db-AbCdEf"}
+	log.failure(spec, newError(exitNotFound, spec.Name, awserr.New("ResourceNotFoundException", "no such secret", nil)))
+
+	var line logLine
+	if err := json.Unmarshal(out.Bytes(), &line); err != nil {
+		t.Fatalf("log line is not JSON: %v: %s", err, out.String())
+	}
+	expected := logLine{Time: line.Time, Level: "error", Message: "no such secret", Secret: "db", ARN: spec.ARN, Class: "not_found", Code: "ResourceNotFoundException"}
+	if line != expected {
+		t.Errorf("\nexpected %#v\n, got %#v", expected, line)
+	}
+}
+
+func TestTerminationMessage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "termination")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "termination-log")
+
+	writeTerminationMessage(path, newError(exitAccessDenied, "db", errors.New("not allowed")))
+	got, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "access_denied: db: not allowed" {
+		t.Errorf("unexpected termination message %q", got)
+	}
+
+	writeTerminationMessage(path, newError(exitUnknown, "db", errors.New(strings.Repeat("x", 2*maxTerminationSize))))
+	got, err = ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != maxTerminationSize {
+		t.Errorf("expected the termination message to be cut to %d bytes, got %d", maxTerminationSize, len(got))
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+)
+
+// how arrays in a secret are handled when it is flattened into key/values
+const (
+	// fail, an array has no natural key/value representation
+	arraysError = "error"
+	// keep the array as a compact JSON string
+	arraysJSON = "json"
+	// flatten the array like an object keyed by the element index
+	arraysIndex = "index"
+)
+
+// default separator between the keys of nested objects, so that
+// {"DB_CREDS": {"HOST": "x"}} becomes DB_CREDS__HOST=x
+const defaultSeparator = "__"
+
+func validArrays(arrays string) bool {
+	switch arrays {
+	case arraysError, arraysJSON, arraysIndex:
+		return true
+	}
+	return false
+}
+
+// flattener turns arbitrary JSON into flat key/values
+type flattener struct {
+	separator string
+	arrays    string
+	values    map[string]string
+}
+
+// flattenSecret parses the secret as a JSON object and flattens it. Scalars
+// are stringified, numbers keep their exact JSON text and null becomes an
+// empty string. Nested objects are flattened by joining the keys with the
+// separator, arrays are handled as set by arrays.
+func flattenSecret(output, separator, arrays string) (map[string]string, error) {
+	decoder := json.NewDecoder(bytes.NewReader([]byte(output)))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, malformed("secret is not valid JSON: %v", err)
+	}
+	object, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, malformed("secret is not a JSON object")
+	}
+
+	f := &flattener{separator: separator, arrays: arrays, values: map[string]string{}}
+	for k, v := range object {
+		if err := f.add(k, v); err != nil {
+			return nil, err
+		}
+	}
+	return f.values, nil
+}
+
+func (f *flattener) add(key string, value interface{}) error {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for k, child := range v {
+			if err := f.add(key+f.separator+k, child); err != nil {
+				return err
+			}
+		}
+		return nil
+	case []interface{}:
+		switch f.arrays {
+		case arraysJSON:
+			data, err := json.Marshal(v)
+			if err != nil {
+				return err
+			}
+			return f.set(key, string(data))
+		case arraysIndex:
+			for i, child := range v {
+				if err := f.add(key+f.separator+strconv.Itoa(i), child); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		return malformed("key %q holds an array, set arrays to json or index to write it", key)
+	case string:
+		return f.set(key, v)
+	case json.Number:
+		return f.set(key, v.String())
+	case bool:
+		return f.set(key, strconv.FormatBool(v))
+	case nil:
+		return f.set(key, "")
+	}
+	return malformed("key %q holds a value of unsupported type %T", key, value)
+}
+
+func (f *flattener) set(key, value string) error {
+	if _, ok := f.values[key]; ok {
+		return malformed("key %q is set twice after flattening nested keys", key)
+	}
+	f.values[key] = value
+	return nil
+}
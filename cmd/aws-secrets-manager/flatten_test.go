@@ -0,0 +1,94 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFlattenSecret(t *testing.T) {
+	testCases := []struct {
+		name      string
+		secret    string
+		separator string
+		arrays    string
+		expected  map[string]string
+		err       bool
+	}{
+		{
+			name:     "rds style secret",
+			secret:   `{"username":"admin","password":"hunter2","engine":"postgres","host":"db.example.com","port":5432,"dbInstanceIdentifier":"db"}`,
+			expected: map[string]string{"username": "admin", "password": "hunter2", "engine": "postgres", "host": "db.example.com", "port": "5432", "dbInstanceIdentifier": "db"},
+		},
+		{
+			name:     "scalars keep their json text",
+			secret:   `{"big":12345678901234567890,"float":1.50,"exp":1e3,"yes":true,"no":false,"nothing":null}`,
+			expected: map[string]string{"big": "12345678901234567890", "float": "1.50", "exp": "1e3", "yes": "true", "no": "false", "nothing": ""},
+		},
+		{
+			name:     "nested objects",
+			secret:   `{"DB_CREDS":{"HOST":"db","AUTH":{"USER":"admin"}}}`,
+			expected: map[string]string{"DB_CREDS__HOST": "db", "DB_CREDS__AUTH__USER": "admin"},
+		},
+		{
+			name:      "custom separator",
+			secret:    `{"db":{"host":"db"}}`,
+			separator: "_",
+			expected:  map[string]string{"db_host": "db"},
+		},
+		{
+			name:   "arrays fail by default",
+			secret: `{"hosts":["a","b"]}`,
+			arrays: arraysError,
+			err:    true,
+		},
+		{
+			name:     "arrays as json",
+			secret:   `{"hosts":["a",1,{"b":true}]}`,
+			arrays:   arraysJSON,
+			expected: map[string]string{"hosts": `["a",1,{"b":true}]`},
+		},
+		{
+			name:     "arrays by index",
+			secret:   `{"hosts":["a",{"port":1}]}`,
+			arrays:   arraysIndex,
+			expected: map[string]string{"hosts__0": "a", "hosts__1__port": "1"},
+		},
+		{
+			name:   "flattened key collides",
+			secret: `{"a__b":"1","a":{"b":"2"}}`,
+			err:    true,
+		},
+		{
+			name:   "not an object",
+			secret: `["a"]`,
+			err:    true,
+		},
+		{
+			name:   "not json",
+			secret: `hunter2`,
+			err:    true,
+		},
+	}
+	for _, testcase := range testCases {
+		if testcase.separator == "" {
+			testcase.separator = defaultSeparator
+		}
+		if testcase.arrays == "" {
+			testcase.arrays = arraysError
+		}
+		values, err := flattenSecret(testcase.secret, testcase.separator, testcase.arrays)
+		if testcase.err {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %#v", testcase.name, values)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", testcase.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(values, testcase.expected) {
+			t.Errorf("%s:\nexpected %#v\n, got %#v", testcase.name, testcase.expected, values)
+		}
+	}
+}
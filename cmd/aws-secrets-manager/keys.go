@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// keysSeparator splits a secret reference into the secret and the keys
+// to select from it, as in arn#password=DB_PASSWORD,username=DB_USER.
+// Neither secret nor parameter names can contain it.
+const keysSeparator = "#"
+
+// keyMapping selects a key of the secret and the name it is written as
+type keyMapping struct {
+	key  string
+	name string
+}
+
+// parseKeys parses a comma separated list of key[=name] entries, the key
+// keeping its name when none is given.
+func parseKeys(keys string) ([]keyMapping, error) {
+	var mappings []keyMapping
+	names := map[string]string{}
+	for _, entry := range strings.Split(keys, ",") {
+		mapping := keyMapping{key: strings.TrimSpace(entry)}
+		if i := strings.Index(entry, "="); i >= 0 {
+			mapping.key = strings.TrimSpace(entry[:i])
+			mapping.name = strings.TrimSpace(entry[i+1:])
+		} else {
+			mapping.name = mapping.key
+		}
+		if mapping.key == "" || mapping.name == "" {
+			return nil, fmt.Errorf("invalid key %q, expected key or key=name", entry)
+		}
+		if other, ok := names[mapping.name]; ok {
+			return nil, fmt.Errorf("duplicate key name %s for %q and %q", mapping.name, other, mapping.key)
+		}
+		names[mapping.name] = mapping.key
+		mappings = append(mappings, mapping)
+	}
+	return mappings, nil
+}
+
+// selectKeys keeps only the keys of the secret the spec asks for, renamed
+// as asked. A key missing from the secret is an error rather than an
+// unset variable the app only notices later.
+func selectKeys(spec secretSpec, value secretValue) (secretValue, error) {
+	if spec.Keys == "" {
+		return value, nil
+	}
+	mappings, err := parseKeys(spec.Keys)
+	if err != nil {
+		return value, err
+	}
+	var object map[string]json.RawMessage
+	if value.binary || json.Unmarshal(value.data, &object) != nil {
+		return value, malformed("keys are selected but the secret is not a JSON object")
+	}
+	selected := map[string]json.RawMessage{}
+	for _, mapping := range mappings {
+		v, ok := object[mapping.key]
+		if !ok {
+			return value, malformed("the secret has no key %q", mapping.key)
+		}
+		selected[mapping.name] = v
+	}
+	data, err := json.Marshal(selected)
+	if err != nil {
+		return value, err
+	}
+	return secretValue{data: data, version: value.version}, nil
+}
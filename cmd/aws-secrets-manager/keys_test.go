@@ -0,0 +1,43 @@
+package main
+
+import "testing"
+
+func TestSelectKeys(t *testing.T) {
+	secret := secretValue{data: []byte(`{"username":"admin","password":"hunter2","host":{"name":"db.internal","port":5432}}`), version: "v1"}
+	testCases := []struct {
+		keys     string
+		value    secretValue
+		expected string
+		err      bool
+	}{
+		{keys: "", value: secret, expected: string(secret.data)},
+		{keys: "password=DB_PASSWORD", value: secret, expected: `{"DB_PASSWORD":"hunter2"}`},
+		{keys: "password=DB_PASSWORD, username=DB_USER, host", value: secret, expected: `{"DB_PASSWORD":"hunter2","DB_USER":"admin","host":{"name":"db.internal","port":5432}}`},
+		{keys: "password=A,password=B", value: secret, expected: `{"A":"hunter2","B":"hunter2"}`},
+		{keys: "passwd", value: secret, err: true},
+		{keys: "password", value: secretValue{data: []byte("hunter2")}, err: true},
+		{keys: "password", value: secretValue{data: []byte(`{"password":"x"}`), binary: true}, err: true},
+	}
+	for _, testcase := range testCases {
+		value, err := selectKeys(secretSpec{Name: "db", Keys: testcase.keys}, testcase.value)
+		if testcase.err {
+			if writeErrorCode(err) != exitMalformed {
+				t.Errorf("%q: expected a malformed error, got %v", testcase.keys, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error %v", testcase.keys, err)
+			continue
+		}
+		if string(value.data) != testcase.expected || value.version != testcase.value.version {
+			t.Errorf("%q: expected %s, got %s", testcase.keys, testcase.expected, value.data)
+		}
+	}
+
+	for _, keys := range []string{"a,", "=A", "a=", "a=X,b=X"} {
+		if _, err := parseKeys(keys); err == nil {
+			t.Errorf("%q: expected an error", keys)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+// logLine is a single structured log line
+type logLine struct {
+	Time    string `json:"time"`
+	Level   string `json:"level"`
+	Message string `json:"message"`
+	Secret  string `json:"secret,omitempty"`
+	ARN     string `json:"arn,omitempty"`
+	Class   string `json:"class,omitempty"`
+	Code    string `json:"code,omitempty"`
+}
+
+// logger writes JSON log lines
+type logger struct {
+	out io.Writer
+}
+
+func (l *logger) log(line logLine) {
+	line.Time = time.Now().UTC().Format(time.RFC3339)
+	data, err := json.Marshal(line)
+	if err != nil {
+		return
+	}
+	l.out.Write(append(data, '\n'))
+}
+
+func (l *logger) info(spec secretSpec, message string) {
+	l.log(logLine{Level: "info", Message: message, Secret: spec.Name, ARN: spec.ARN})
+}
+
+// failure logs the error with its class and the AWS error code if any
+func (l *logger) failure(spec secretSpec, ferr *fetchError) {
+	line := logLine{
+		Level:   "error",
+		Message: ferr.err.Error(),
+		Secret:  spec.Name,
+		ARN:     spec.ARN,
+		Class:   classNames[ferr.code],
+	}
+	var aerr awserr.Error
+	if errors.As(ferr.err, &aerr) {
+		line.Code = aerr.Code()
+		line.Message = aerr.Message()
+	}
+	l.log(line)
+}
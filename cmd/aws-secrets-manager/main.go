@@ -1,113 +1,170 @@
 package main
 
 import (
-	"encoding/base64"
-	"encoding/json"
+	"context"
+	"flag"
 	"fmt"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/arn"
-	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/ec2metadata"
 	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/secretsmanager"
 )
 
 func main() {
-	secretArn := os.Getenv("SECRET_ARN")
-	var AWSRegion string
+	var refs, templateRefs secretFlags
+	var templateDir string
+	var manifestPath, format, terminationLog string
+	var policy retryPolicy
+	var timeout time.Duration
+	var secretsManagerEndpoint, ssmEndpoint, stsEndpoint string
+	var outputDir, outputFile, fileMode, fileUID, fileGID string
+	var watch, checkVersion bool
+	var refreshInterval time.Duration
+	var reloadProcess, reloadSignal, reloadURL string
+	flag.Var(&refs, "secret", "Secret to fetch, as [name=]arn. May be repeated.")
+	flag.StringVar(&manifestPath, "manifest", "", "JSON or YAML file listing the secrets to fetch.")
+	flag.StringVar(&format, "format", os.Getenv("SECRETS_FORMAT"),
+		"Default output format: export, dotenv, raw, json, yaml or files.")
+	flag.StringVar(&outputDir, "output-dir", envOrDefault("SECRETS_OUTPUT_DIR", defaultOutputDir),
+		"Directory relative output paths are taken from.")
+	flag.StringVar(&outputFile, "output-file", envOrDefault("SECRETS_OUTPUT_FILE", defaultOutputFile),
+		"File in the output dir the export and dotenv formats collect the secrets in.")
+	flag.StringVar(&fileMode, "file-mode", envOrDefault("SECRETS_FILE_MODE", defaultFileMode),
+		"Mode of the files written, in octal.")
+	flag.StringVar(&fileUID, "file-uid", os.Getenv("SECRETS_FILE_UID"),
+		"User id to give the files written. Left to the fetcher's user when empty.")
+	flag.StringVar(&fileGID, "file-gid", os.Getenv("SECRETS_FILE_GID"),
+		"Group id to give the files written. Left to the fetcher's group when empty.")
+	flag.Var(&templateRefs, "template", "Template rendering the secrets, as output=file. May be repeated.")
+	flag.StringVar(&templateDir, "template-dir", os.Getenv("SECRETS_TEMPLATE_DIR"),
+		"Directory of templates, each rendering to the file of the same name in the output dir.")
+	flag.StringVar(&terminationLog, "termination-log", defaultTerminationLog,
+		"File the reason for failing is written to. Empty to disable.")
+	flag.IntVar(&policy.maxAttempts, "max-attempts", 5,
+		"Most calls made to AWS for one secret, including the first.")
+	flag.DurationVar(&policy.baseDelay, "retry-base-delay", 200*time.Millisecond,
+		"Delay before the first retry, doubled on every retry after it.")
+	flag.DurationVar(&policy.maxDelay, "retry-max-delay", 5*time.Second,
+		"Upper bound on the delay between two retries.")
+	flag.Float64Var(&policy.jitter, "retry-jitter", 0.5,
+		"Fraction of the retry delay which is randomized, between 0 and 1.")
+	flag.DurationVar(&timeout, "timeout", time.Minute,
+		"Deadline for fetching all the secrets, retries included.")
+	flag.StringVar(&secretsManagerEndpoint, "secretsmanager-endpoint", defaultEndpoint(os.Getenv, secretsManagerEndpointEnv),
+		"URL of the secrets manager endpoint, like a VPC or FIPS endpoint. {region} is replaced by the secret's region.")
+	flag.StringVar(&ssmEndpoint, "ssm-endpoint", defaultEndpoint(os.Getenv, ssmEndpointEnv),
+		"URL of the SSM endpoint parameters are fetched from. {region} is replaced by the parameter's region.")
+	flag.StringVar(&stsEndpoint, "sts-endpoint", defaultEndpoint(os.Getenv, stsEndpointEnv),
+		"URL of the STS endpoint used to assume roles. {region} is replaced by the region.")
+	flag.BoolVar(&watch, "watch", false,
+		"Keep running as a sidecar, refreshing the files whenever the secrets change.")
+	flag.DurationVar(&refreshInterval, "refresh-interval", 5*time.Minute,
+		"How often the secrets are refreshed with -watch.")
+	flag.BoolVar(&checkVersion, "check-version", true,
+		"With -watch, check the version of secrets manager secrets with DescribeSecret and only fetch them again when it changed.")
+	flag.StringVar(&reloadProcess, "reload-process", "",
+		"Name of the app's process to signal when the secrets change. The pod must share its process namespace.")
+	flag.StringVar(&reloadSignal, "reload-signal", "HUP",
+		"Signal sent to the reload process.")
+	flag.StringVar(&reloadURL, "reload-url", "",
+		"URL POSTed to when the secrets change, like an app's reload endpoint.")
+	flag.Parse()
 
-	if arn.IsARN(secretArn) {
-		arnobj, _ := arn.Parse(secretArn)
-		AWSRegion = arnobj.Region
-	} else {
-		fmt.Println("Not a valid ARN")
-		os.Exit(1)
+	log := &logger{out: os.Stderr}
+	fail := func(spec secretSpec, ferr *fetchError) {
+		log.failure(spec, ferr)
+		writeTerminationMessage(terminationLog, ferr)
+		os.Exit(ferr.code)
 	}
 
-	sess, err := session.NewSession()
-	svc := secretsmanager.New(sess, &aws.Config{
-		Region: aws.String(AWSRegion),
-	})
-
-	input := &secretsmanager.GetSecretValueInput{
-		SecretId:     aws.String(secretArn),
-		VersionStage: aws.String("AWSCURRENT"),
+	if policy.maxAttempts < 1 || policy.jitter < 0 || policy.jitter > 1 {
+		fail(secretSpec{}, newError(exitInvalidConfig, "", fmt.Errorf("max-attempts must be at least 1 and retry-jitter between 0 and 1")))
 	}
 
-	result, err := svc.GetSecretValue(input)
+	reload, err := newReloader(reloadProcess, reloadSignal, reloadURL)
 	if err != nil {
-		if aerr, ok := err.(awserr.Error); ok {
-			switch aerr.Code() {
-			case secretsmanager.ErrCodeResourceNotFoundException:
-				fmt.Println(secretsmanager.ErrCodeResourceNotFoundException, aerr.Error())
-			case secretsmanager.ErrCodeInvalidParameterException:
-				fmt.Println(secretsmanager.ErrCodeInvalidParameterException, aerr.Error())
-			case secretsmanager.ErrCodeInvalidRequestException:
-				fmt.Println(secretsmanager.ErrCodeInvalidRequestException, aerr.Error())
-			case secretsmanager.ErrCodeDecryptionFailure:
-				fmt.Println(secretsmanager.ErrCodeDecryptionFailure, aerr.Error())
-			case secretsmanager.ErrCodeInternalServiceError:
-				fmt.Println(secretsmanager.ErrCodeInternalServiceError, aerr.Error())
-			default:
-				fmt.Println(aerr.Error())
-			}
-		} else {
-			// Print the error, cast err to awserr.Error to get the Code and
-			// Message from an error.
-			fmt.Println(err.Error())
-		}
-		return
+		fail(secretSpec{}, newError(exitInvalidConfig, "", err))
 	}
-	// Decrypts secret using the associated KMS CMK.
-	// Depending on whether the secret is a string or binary, one of these fields will be populated.
-	var secretString, decodedBinarySecret string
-	if result.SecretString != nil {
-		secretString = *result.SecretString
-		writeOutput(secretString)
-	} else {
-		decodedBinarySecretBytes := make([]byte, base64.StdEncoding.DecodedLen(len(result.SecretBinary)))
-		len, err := base64.StdEncoding.Decode(decodedBinarySecretBytes, result.SecretBinary)
-		if err != nil {
-			fmt.Println("Base64 Decode Error:", err)
-			return
-		}
-		decodedBinarySecret = string(decodedBinarySecretBytes[:len])
-		writeOutput(decodedBinarySecret)
+	if !watch && reload.enabled() {
+		fail(secretSpec{}, newError(exitInvalidConfig, "", fmt.Errorf("reload-process and reload-url need -watch")))
+	}
+	if watch && refreshInterval <= 0 {
+		fail(secretSpec{}, newError(exitInvalidConfig, "", fmt.Errorf("refresh-interval must be positive")))
 	}
-}
 
-func writeEnvFile(key, value string) {
-	f, err := os.OpenFile("/tmp/secret", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	out, err := newOutputConfig(outputDir, outputFile, fileMode, fileUID, fileGID)
+	if err != nil {
+		fail(secretSpec{}, newError(exitInvalidConfig, "", err))
+	}
 
+	specs, err := collectSpecs(os.Getenv, manifestPath, format, refs, out)
 	if err != nil {
-		return
+		fail(secretSpec{}, newError(exitInvalidConfig, "", err))
 	}
-	defer f.Close()
 
-	f.WriteString(fmt.Sprintf("export %s=%s;\n", key, value))
-}
+	templates, err := collectTemplates(os.Getenv, templateDir, templateRefs, out)
+	if err != nil {
+		fail(secretSpec{}, newError(exitInvalidConfig, "", err))
+	}
 
-func writeOutput(output string) {
-	// coming in as json. parse and extract the key and value for
-	// writing to temp file as a structure env file
-	var uj map[string]string
-	if err := json.Unmarshal([]byte(output), &uj); err != nil {
-		return
+	for _, spec := range specs {
+		if err := backendFor(spec).validate(spec); err != nil {
+			fail(spec, newError(exitInvalidConfig, spec.Name, err))
+		}
 	}
 
-	f, err := os.OpenFile("/tmp/secret", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	resolver, err := newEndpointOverrides(secretsManagerEndpoint, ssmEndpoint, stsEndpoint)
 	if err != nil {
-		return
+		fail(secretSpec{}, newError(exitInvalidConfig, "", err))
+	}
+	sess, err := session.NewSessionWithOptions(session.Options{
+		Config: aws.Config{EndpointResolver: resolver},
+	})
+	if err != nil {
+		fail(secretSpec{}, newError(exitInvalidConfig, "", err))
 	}
-	defer f.Close()
 
-	// the json read in should only ever have 1 key value pair,
-	// however, iterate over it just in case anyhow.
-	for k, v := range uj {
-		f.WriteString(
-			fmt.Sprintf("export %s=%s;\n", k, v),
-		)
+	regions := &regionResolver{getenv: os.Getenv, metadata: ec2metadata.New(sess).Region}
+	for i := range specs {
+		if specs[i].Region, err = regions.resolve(specs[i]); err != nil {
+			fail(specs[i], newError(exitInvalidConfig, specs[i].Name, err))
+		}
 	}
+	clients := newClientCache(sess)
 
+	s := &syncer{specs: specs, templates: templates, clients: clients, policy: policy, out: out, log: log, checkVersion: checkVersion}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	_, ferr := s.refresh(ctx)
+	cancel()
+	if ferr != nil {
+		writeTerminationMessage(terminationLog, ferr)
+		os.Exit(ferr.code)
+	}
+	if !watch {
+		return
+	}
+
+	// refresh until the pod is stopped
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		<-stop
+		cancel()
+	}()
+	s.watch(ctx, refreshInterval, timeout, reload)
+}
+
+// envOrDefault returns the value of the env var, or the default when it
+// isn't set.
+func envOrDefault(name, value string) string {
+	if env := os.Getenv(name); env != "" {
+		return env
+	}
+	return value
 }
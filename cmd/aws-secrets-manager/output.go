@@ -0,0 +1,542 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// supported output formats
+const (
+	// export KEY=VALUE; lines which can be sourced by a shell
+	formatExport = "export"
+	// KEY=VALUE lines as read by python-dotenv and most other dotenv
+	// libraries
+	formatDotenv = "dotenv"
+	// the secret value verbatim
+	formatRaw = "raw"
+	// the secret as pretty printed JSON
+	formatJSON = "json"
+	// the secret as YAML
+	formatYAML = "yaml"
+	// a directory holding one file per key of the secret
+	formatFiles = "files"
+	// nothing, for secrets only used by templates
+	formatNone = "none"
+)
+
+// outputConfig sets where and how the secrets are written. It is the same
+// for all the secrets, which may share the one file.
+type outputConfig struct {
+	// dir relative output paths are taken from, the volume shared with
+	// the app containers
+	dir string
+	// file the export and dotenv formats collect the secrets in,
+	// relative to dir
+	file string
+	// mode of the files written
+	mode os.FileMode
+	// owner of the files written, -1 leaves them owned by the
+	// fetcher's user
+	uid, gid int
+}
+
+// newOutputConfig checks and parses the output settings as given on the
+// command line. The mode is in octal, an empty uid or gid leaves the
+// owner as is.
+func newOutputConfig(dir, file, mode, uid, gid string) (outputConfig, error) {
+	out := outputConfig{dir: filepath.Clean(dir), file: filepath.Clean(file)}
+	if !filepath.IsAbs(out.dir) {
+		return out, fmt.Errorf("output dir %q is not an absolute path", dir)
+	}
+	if file == "" || filepath.IsAbs(out.file) || out.file == ".." || strings.HasPrefix(out.file, "../") {
+		return out, fmt.Errorf("output file %q is not a path inside the output dir", file)
+	}
+	perm, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil || perm > 0777 {
+		return out, fmt.Errorf("file mode %q is not an octal permission like 0640", mode)
+	}
+	out.mode = os.FileMode(perm)
+	for _, id := range []struct {
+		value string
+		dest  *int
+	}{{uid, &out.uid}, {gid, &out.gid}} {
+		*id.dest = -1
+		if id.value == "" {
+			continue
+		}
+		if *id.dest, err = strconv.Atoi(id.value); err != nil || *id.dest < 0 {
+			return out, fmt.Errorf("file owner %q is not a numeric id", id.value)
+		}
+	}
+	return out, nil
+}
+
+// secretValue is a secret as returned by secrets manager
+type secretValue struct {
+	data   []byte
+	binary bool
+	// version the value was fetched from, when the backend tells it
+	version string
+}
+
+// equal returns true when both values would be written the same
+func (v secretValue) equal(other secretValue) bool {
+	return v.binary == other.binary && bytes.Equal(v.data, other.data)
+}
+
+// isObject returns true when the secret is a JSON object, which is what
+// the key/value formats need.
+func (v secretValue) isObject() bool {
+	var object map[string]json.RawMessage
+	return !v.binary && json.Unmarshal(v.data, &object) == nil
+}
+
+// keyValueFormat returns true for formats which write the secret as
+// key/values and so need it to be a JSON object.
+func keyValueFormat(format string) bool {
+	return format == formatExport || format == formatDotenv || format == formatFiles
+}
+
+// appendFormat returns true for formats where several secrets are
+// merged into the same file.
+func appendFormat(format string) bool {
+	return format == formatExport || format == formatDotenv
+}
+
+func validFormat(format string) bool {
+	switch format {
+	case formatExport, formatDotenv, formatRaw, formatJSON, formatYAML, formatFiles, formatNone:
+		return true
+	}
+	return false
+}
+
+// secretWriter renders the secrets into the files they go to and writes
+// them all at once when flushed. Secrets sharing an export or dotenv file
+// are merged into it, so the files come out the same whatever order the
+// secrets are added in and however many times the fetcher runs.
+type secretWriter struct {
+	out outputConfig
+	// content of each file, by path
+	files map[string][]byte
+	// variables of the export and dotenv files, by path
+	env map[string]*envFile
+	// directories of the files format, by path
+	dirs map[string]bool
+	// name of the secret writing each path
+	owners map[string]string
+}
+
+// envFile holds the variables set by the secrets sharing an export or
+// dotenv file.
+type envFile struct {
+	format string
+	vars   map[string]string
+	// name of the secret setting each variable
+	secrets map[string]string
+}
+
+func newSecretWriter(out outputConfig) *secretWriter {
+	return &secretWriter{
+		out:    out,
+		files:  map[string][]byte{},
+		env:    map[string]*envFile{},
+		dirs:   map[string]bool{},
+		owners: map[string]string{},
+	}
+}
+
+// add renders the secret value to the spec's output in the spec's format.
+// Plain text and binary secrets can't be written as key/values, so for
+// those formats they are written verbatim to the spec's file instead.
+func (w *secretWriter) add(spec secretSpec, value secretValue) error {
+	if keyValueFormat(spec.Format) && !value.isObject() {
+		return w.addFile(spec, spec.File, value.data)
+	}
+
+	switch spec.Format {
+	case formatExport, formatDotenv:
+		return w.addEnv(spec, string(value.data))
+	case formatRaw:
+		return w.addFile(spec, spec.Output, value.data)
+	case formatJSON:
+		data, err := renderJSON(string(value.data))
+		if err != nil {
+			return err
+		}
+		return w.addFile(spec, spec.Output, data)
+	case formatYAML:
+		data, err := renderYAML(string(value.data))
+		if err != nil {
+			return err
+		}
+		return w.addFile(spec, spec.Output, data)
+	case formatFiles:
+		return w.addFiles(spec, string(value.data))
+	case formatNone:
+		return nil
+	}
+	return fmt.Errorf("unknown output format %q", spec.Format)
+}
+
+// claim records the secret or template named by owner as the one writing
+// path. Only export and dotenv files can be shared, two secrets writing
+// any other file would leave it holding whichever came last.
+func (w *secretWriter) claim(owner, path string) error {
+	if other, ok := w.owners[path]; ok {
+		return malformed("%s and %s are both written to %s", other, owner, path)
+	}
+	w.owners[path] = owner
+	return nil
+}
+
+func (w *secretWriter) addFile(spec secretSpec, path string, data []byte) error {
+	if err := w.claim("secret "+spec.Name, path); err != nil {
+		return err
+	}
+	w.files[path] = data
+	return nil
+}
+
+// addTemplate renders the template with the secrets' data to its output
+func (w *secretWriter) addTemplate(t secretTemplate, data map[string]interface{}) error {
+	var b bytes.Buffer
+	if err := t.tmpl.Execute(&b, data); err != nil {
+		return malformed("rendering template %s: %v", t.Name, err)
+	}
+	if err := w.claim("template "+t.Name, t.Output); err != nil {
+		return err
+	}
+	w.files[t.Output] = b.Bytes()
+	return nil
+}
+
+// addEnv merges the keys of the secret into the variables of the export or
+// dotenv file at the spec's output. It is an error for two secrets to set
+// the same variable, as one would silently win over the other.
+func (w *secretWriter) addEnv(spec secretSpec, output string) error {
+	// coming in as json. parse and extract the key and value for
+	// writing to temp file as a structure env file
+	uj, err := flattenSecret(output, spec.Separator, spec.Arrays)
+	if err != nil {
+		return err
+	}
+	vars, err := envVars(uj)
+	if err != nil {
+		return err
+	}
+
+	file, ok := w.env[spec.Output]
+	if !ok {
+		if err := w.claim("secret "+spec.Name, spec.Output); err != nil {
+			return err
+		}
+		file = &envFile{format: spec.Format, vars: map[string]string{}, secrets: map[string]string{}}
+		w.env[spec.Output] = file
+	}
+	if file.format != spec.Format {
+		return malformed("secret %s is written to %s as %s but %s writes it as %s", spec.Name, spec.Output, spec.Format, w.owners[spec.Output], file.format)
+	}
+	for name, value := range vars {
+		if other, ok := file.secrets[name]; ok {
+			return malformed("secrets %s and %s both set %s in %s", other, spec.Name, name, spec.Output)
+		}
+		file.vars[name] = value
+		file.secrets[name] = spec.Name
+	}
+	return nil
+}
+
+// addFiles adds a file per key of the secret to the directory at the
+// spec's output, named after the key.
+func (w *secretWriter) addFiles(spec secretSpec, output string) error {
+	uj, err := flattenSecret(output, spec.Separator, spec.Arrays)
+	if err != nil {
+		return err
+	}
+	if err := w.claim("secret "+spec.Name, spec.Output); err != nil {
+		return err
+	}
+	w.dirs[spec.Output] = true
+	for _, k := range sortedKeys(uj) {
+		if k == "" || k == "." || k == ".." || strings.ContainsAny(k, "/\x00") {
+			return malformed("key %q can't be used as a file name", k)
+		}
+		if err := w.addFile(spec, filepath.Join(spec.Output, k), []byte(uj[k])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// flush writes all the files added so far, in a stable order, returning
+// whether any of them changed. Each file is replaced whole so the app
+// never sees a partly written one, and the files of keys removed from a
+// secret since an earlier run are removed from its files directory.
+func (w *secretWriter) flush() (bool, error) {
+	for path, file := range w.env {
+		w.files[path] = []byte(renderEnv(file.format, file.vars))
+	}
+
+	dirs := make([]string, 0, len(w.dirs))
+	for dir := range w.dirs {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+	for _, dir := range dirs {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return false, err
+		}
+		if err := setOwnership(dir, w.out, 0755); err != nil {
+			return false, err
+		}
+	}
+
+	paths := make([]string, 0, len(w.files))
+	for path := range w.files {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	changed := false
+	for _, path := range paths {
+		written, err := writeFile(path, w.files[path], w.out)
+		if err != nil {
+			return false, err
+		}
+		changed = changed || written
+	}
+	for _, dir := range dirs {
+		removed, err := w.prune(dir)
+		if err != nil {
+			return false, err
+		}
+		changed = changed || removed
+	}
+	return changed, nil
+}
+
+// prune removes the files of a files directory which no longer belong to
+// a key of the secret, returning whether it removed any. Hidden files,
+// like the temporary ones of writeFile, and directories are left alone,
+// as is the whole output dir when a secret is written there.
+func (w *secretWriter) prune(dir string) (bool, error) {
+	if filepath.Clean(dir) == filepath.Clean(w.out.dir) {
+		return false, nil
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return false, err
+	}
+	removed := false
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+		if _, ok := w.files[path]; ok || strings.HasPrefix(entry.Name(), ".") || !entry.Mode().IsRegular() {
+			continue
+		}
+		if err := os.Remove(path); err != nil {
+			return false, err
+		}
+		removed = true
+	}
+	return removed, nil
+}
+
+// sortedKeys returns the keys of the secret in a stable order
+func sortedKeys(uj map[string]string) []string {
+	keys := make([]string, 0, len(uj))
+	for k := range uj {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// shellName matches keys which can be used as shell variable names
+var shellName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+var invalidNameChars = regexp.MustCompile(`[^A-Za-z0-9_]`)
+
+// envName turns a key of the secret into a valid shell variable name by
+// replacing anything but letters, digits and underscores with underscores.
+func envName(key string) (string, error) {
+	if shellName.MatchString(key) {
+		return key, nil
+	}
+	name := invalidNameChars.ReplaceAllString(key, "_")
+	if name == "" || name[0] >= '0' && name[0] <= '9' {
+		name = "_" + name
+	}
+	if strings.Trim(name, "_") == "" {
+		return "", malformed("key %q can't be used as a variable name", key)
+	}
+	return name, nil
+}
+
+// shellQuote single quotes the value so the shell takes it literally.
+// Single quotes inside the value are closed, escaped and reopened.
+func shellQuote(value string) string {
+	return "'" + strings.Replace(value, "'", `'\''`, -1) + "'"
+}
+
+// dotenvQuote quotes the value for python-dotenv. Values without a single
+// quote, backslash or line break are single quoted, which dotenv libraries
+// read as is, without expanding variables. The others are double quoted
+// with the \\, \", \n and \r escapes python-dotenv decodes, line breaks
+// being escaped as it reads files with universal newlines. python-dotenv
+// expands ${NAME} in those unless loaded with interpolate=False, and takes
+// a backslash ending the value as escaping the closing quote.
+func dotenvQuote(value string) string {
+	if !strings.ContainsAny(value, "'\\\n\r") {
+		return "'" + value + "'"
+	}
+	return `"` + strings.NewReplacer(
+		`\`, `\\`,
+		`"`, `\"`,
+		"\n", `\n`,
+		"\r", `\r`,
+	).Replace(value) + `"`
+}
+
+// envVars turns the keys of the secret into variable names. Keys which
+// aren't valid variable names are sanitized, and it is an error for two
+// keys to end up with the same name.
+func envVars(uj map[string]string) (map[string]string, error) {
+	vars := map[string]string{}
+	seen := map[string]string{}
+	for _, k := range sortedKeys(uj) {
+		name, err := envName(k)
+		if err != nil {
+			return nil, err
+		}
+		if other, ok := seen[name]; ok {
+			return nil, malformed("keys %q and %q both map to the variable %s", other, k, name)
+		}
+		seen[name] = k
+
+		v := uj[k]
+		if strings.ContainsRune(v, 0) {
+			return nil, malformed("value of key %q contains a NUL byte which can't be set in the environment", k)
+		}
+		vars[name] = v
+	}
+	return vars, nil
+}
+
+// renderEnv renders the variables as export or dotenv lines, sorted by
+// name.
+func renderEnv(format string, vars map[string]string) string {
+	var b strings.Builder
+	for _, name := range sortedKeys(vars) {
+		if format == formatDotenv {
+			fmt.Fprintf(&b, "%s=%s\n", name, dotenvQuote(vars[name]))
+		} else {
+			fmt.Fprintf(&b, "export %s=%s;\n", name, shellQuote(vars[name]))
+		}
+	}
+	return b.String()
+}
+
+func renderJSON(output string) ([]byte, error) {
+	var value interface{}
+	if err := decodeJSON([]byte(output), &value); err != nil {
+		return nil, malformed("secret is not valid JSON: %v", err)
+	}
+	pretty, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(pretty, '\n'), nil
+}
+
+func renderYAML(output string) ([]byte, error) {
+	var value interface{}
+	if err := decodeJSON([]byte(output), &value); err != nil {
+		return nil, malformed("secret is not valid JSON: %v", err)
+	}
+	return yaml.Marshal(yamlNumbers(value))
+}
+
+// yamlNumbers replaces the JSON numbers in value by integers where they
+// are, so they are written as such rather than as quoted strings or in
+// the exponent form of floats. Integers too large for 64 bits and
+// fractions are written as floats.
+func yamlNumbers(value interface{}) interface{} {
+	switch v := value.(type) {
+	case json.Number:
+		if i, err := strconv.ParseInt(string(v), 10, 64); err == nil {
+			return i
+		}
+		if u, err := strconv.ParseUint(string(v), 10, 64); err == nil {
+			return u
+		}
+		f, _ := v.Float64()
+		return f
+	case map[string]interface{}:
+		for key, item := range v {
+			v[key] = yamlNumbers(item)
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = yamlNumbers(item)
+		}
+	}
+	return value
+}
+
+// writeFile replaces the file at path with data, creating the directories
+// leading to it as needed, and returns whether the content changed. The
+// data goes to a temporary file in the same directory which is renamed
+// over the file once complete, so a crash midway leaves either the old
+// file or the new one. A file already holding the data is left alone.
+func writeFile(path string, data []byte, out outputConfig) (bool, error) {
+	if current, err := ioutil.ReadFile(path); err == nil && bytes.Equal(current, data) {
+		return false, setOwnership(path, out, out.mode)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return false, err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".")
+	if err != nil {
+		return false, err
+	}
+	// only does anything when the rename didn't happen
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return false, err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return false, err
+	}
+	if err := tmp.Close(); err != nil {
+		return false, err
+	}
+	if err := setOwnership(tmp.Name(), out, out.mode); err != nil {
+		return false, err
+	}
+	return true, os.Rename(tmp.Name(), path)
+}
+
+// setOwnership sets the mode of the path, which the umask or an earlier
+// file may have left different, and its owner when one is configured.
+func setOwnership(path string, out outputConfig, mode os.FileMode) error {
+	if err := os.Chmod(path, mode); err != nil {
+		return err
+	}
+	if out.uid < 0 && out.gid < 0 {
+		return nil
+	}
+	return os.Chown(path, out.uid, out.gid)
+}
@@ -0,0 +1,489 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// output settings of the fetcher when no flags are given
+var testOutput = outputConfig{dir: defaultOutputDir, file: defaultOutputFile, mode: 0644, uid: -1, gid: -1}
+
+// writeSecret writes a single secret the way the fetcher writes them all
+func writeSecret(spec secretSpec, value secretValue, out outputConfig) error {
+	w := newSecretWriter(out)
+	if err := w.add(spec, value); err != nil {
+		return err
+	}
+	_, err := w.flush()
+	return err
+}
+
+func TestWriteSecretFormats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "secrets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	secret := `{"username":"admin","password":"hunter2"}`
+	testCases := []struct {
+		format   string
+		expected string
+	}{
+		{formatExport, "export password='hunter2';\nexport username='admin';\n"},
+		{formatDotenv, "password='hunter2'\nusername='admin'\n"},
+		{formatRaw, secret},
+		{formatJSON, "{\n  \"password\": \"hunter2\",\n  \"username\": \"admin\"\n}\n"},
+		{formatYAML, "password: hunter2\nusername: admin\n"},
+	}
+	for _, testcase := range testCases {
+		spec := secretSpec{Name: "db", Format: testcase.format, Output: filepath.Join(dir, testcase.format)}
+		if err := writeSecret(spec, secretValue{data: []byte(secret)}, testOutput); err != nil {
+			t.Errorf("%s: %v", testcase.format, err)
+			continue
+		}
+		got, err := ioutil.ReadFile(spec.Output)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != testcase.expected {
+			t.Errorf("%s:\nexpected %q\n, got %q", testcase.format, testcase.expected, got)
+		}
+	}
+
+	spec := secretSpec{Name: "db", Format: formatFiles, Output: filepath.Join(dir, "files")}
+	if err := writeSecret(spec, secretValue{data: []byte(secret)}, testOutput); err != nil {
+		t.Fatal(err)
+	}
+	for key, value := range map[string]string{"username": "admin", "password": "hunter2"} {
+		got, err := ioutil.ReadFile(filepath.Join(spec.Output, key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != value {
+			t.Errorf("files %s: expected %q, got %q", key, value, got)
+		}
+	}
+
+	spec = secretSpec{Name: "db", Format: formatFiles, Output: filepath.Join(dir, "escape")}
+	if err := writeSecret(spec, secretValue{data: []byte(`{"../passwd":"x"}`)}, testOutput); err == nil {
+		t.Errorf("expected a key with a path separator to be rejected")
+	}
+}
+
+func TestRenderNumbers(t *testing.T) {
+	secret := `{"account":123456789012,"ratio":1000000,"id":9007199254740993,"rate":0.25,"big":18446744073709551615}`
+	got, err := renderJSON(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "{\n  \"account\": 123456789012,\n  \"big\": 18446744073709551615,\n  \"id\": 9007199254740993,\n  \"rate\": 0.25,\n  \"ratio\": 1000000\n}\n"
+	if string(got) != expected {
+		t.Errorf("json: expected %q, got %q", expected, got)
+	}
+	got, err = renderYAML(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = "account: 123456789012\nbig: 18446744073709551615\nid: 9007199254740993\nrate: 0.25\nratio: 1000000\n"
+	if string(got) != expected {
+		t.Errorf("yaml: expected %q, got %q", expected, got)
+	}
+
+	for _, render := range []func(string) ([]byte, error){renderJSON, renderYAML} {
+		if _, err := render(`{"a":1} {"b":2}`); err == nil {
+			t.Errorf("expected data after the JSON value to be rejected")
+		}
+	}
+}
+
+func TestWriteSecretsMerged(t *testing.T) {
+	dir, err := ioutil.TempDir("", "secrets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "secret")
+	values := map[string]secretValue{
+		"db":  {data: []byte(`{"DB_USER":"admin","DB_PASSWORD":"hunter2"}`)},
+		"api": {data: []byte(`{"API_KEY":"abc"}`)},
+	}
+	expected := "export API_KEY='abc';\nexport DB_PASSWORD='hunter2';\nexport DB_USER='admin';\n"
+	// a file left over from an earlier run is replaced, not appended to,
+	// whatever order the secrets come in
+	if err := ioutil.WriteFile(path, []byte("export STALE='1';\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, order := range [][]string{{"db", "api"}, {"api", "db"}, {"db", "api"}} {
+		w := newSecretWriter(testOutput)
+		for _, name := range order {
+			if err := w.add(secretSpec{Name: name, Format: formatExport, Output: path}, values[name]); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := w.flush(); err != nil {
+			t.Fatal(err)
+		}
+		got, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != expected {
+			t.Errorf("%v:\nexpected %q\n, got %q", order, expected, got)
+		}
+	}
+	// the temporary files are all renamed into place
+	if files, err := ioutil.ReadDir(dir); err != nil || len(files) != 1 {
+		t.Errorf("expected only the secret file to be left, got %d files (%v)", len(files), err)
+	}
+
+	conflicts := [][]secretSpec{
+		// the same variable from two secrets
+		{{Name: "db", Format: formatExport, Output: path}, {Name: "db2", Format: formatExport, Output: path}},
+		// export and dotenv lines in the same file
+		{{Name: "db", Format: formatExport, Output: path}, {Name: "api", Format: formatDotenv, Output: path}},
+		// two secrets written to the same file
+		{{Name: "db", Format: formatJSON, Output: path}, {Name: "api", Format: formatRaw, Output: path}},
+		{{Name: "db", Format: formatExport, Output: path}, {Name: "api", Format: formatJSON, Output: path}},
+	}
+	values["db2"] = secretValue{data: []byte(`{"DB_USER":"root"}`)}
+	for _, specs := range conflicts {
+		w := newSecretWriter(testOutput)
+		err := w.add(specs[0], values[specs[0].Name])
+		if err == nil {
+			err = w.add(specs[1], values[specs[1].Name])
+		}
+		if writeErrorCode(err) != exitMalformed {
+			t.Errorf("%s and %s: expected a malformed error, got %v", specs[0].Format, specs[1].Format, err)
+		}
+	}
+}
+
+func TestWriteFilesRemovesKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "secrets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	out := outputConfig{dir: dir, file: "secret", mode: 0644, uid: -1, gid: -1}
+	spec := secretSpec{Name: "db", Format: formatFiles, Output: filepath.Join(dir, "db"), Separator: defaultSeparator, Arrays: arraysError}
+
+	if err := writeSecret(spec, secretValue{data: []byte(`{"user":"admin","password":"hunter2"}`)}, out); err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(filepath.Join(dir, "db", ".hidden"), []byte("kept"), 0644)
+	os.Mkdir(filepath.Join(dir, "db", "sub"), 0755)
+	w := newSecretWriter(out)
+	if err := w.add(spec, secretValue{data: []byte(`{"user":"admin"}`)}); err != nil {
+		t.Fatal(err)
+	}
+	if changed, err := w.flush(); err != nil || !changed {
+		t.Fatalf("expected the removed key to be a change, got %v (%v)", changed, err)
+	}
+	files, err := ioutil.ReadDir(filepath.Join(dir, "db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, file := range files {
+		names = append(names, file.Name())
+	}
+	if expected := []string{".hidden", "sub", "user"}; !reflect.DeepEqual(names, expected) {
+		t.Errorf("expected %v to be left, got %v", expected, names)
+	}
+}
+
+func TestOutputConfig(t *testing.T) {
+	out, err := newOutputConfig("/var/run/secrets/app/", "env/app.env", "0440", "1000", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := outputConfig{dir: "/var/run/secrets/app", file: "env/app.env", mode: 0440, uid: 1000, gid: -1}
+	if out != expected {
+		t.Errorf("expected %+v, got %+v", expected, out)
+	}
+
+	invalid := [][5]string{
+		{"relative", "secret", "0644", "", ""},
+		{"/tmp", "", "0644", "", ""},
+		{"/tmp", "../secret", "0644", "", ""},
+		{"/tmp", "/etc/secret", "0644", "", ""},
+		{"/tmp", "secret", "644x", "", ""},
+		{"/tmp", "secret", "01777", "", ""},
+		{"/tmp", "secret", "0644", "app", ""},
+		{"/tmp", "secret", "0644", "", "-2"},
+	}
+	for _, args := range invalid {
+		if _, err := newOutputConfig(args[0], args[1], args[2], args[3], args[4]); err == nil {
+			t.Errorf("%v: expected an error", args)
+		}
+	}
+}
+
+func TestWriteSecretMode(t *testing.T) {
+	dir, err := ioutil.TempDir("", "secrets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// only root can give files away, so the files are given to the
+	// test's own user and group
+	out := outputConfig{dir: dir, file: "secret", mode: 0640, uid: os.Getuid(), gid: os.Getgid()}
+	secret := []byte(`{"password":"hunter2"}`)
+	specs := []secretSpec{
+		{Name: "export", Format: formatExport, Output: filepath.Join(dir, "secret")},
+		{Name: "json", Format: formatJSON, Output: filepath.Join(dir, "db.json")},
+		{Name: "files", Format: formatFiles, Output: filepath.Join(dir, "files")},
+	}
+	// a file left behind with another mode gets the configured one
+	if err := ioutil.WriteFile(filepath.Join(dir, "db.json"), nil, 0666); err != nil {
+		t.Fatal(err)
+	}
+	for _, spec := range specs {
+		if err := writeSecret(spec, secretValue{data: secret}, out); err != nil {
+			t.Fatalf("%s: %v", spec.Name, err)
+		}
+	}
+	for _, path := range []string{"secret", "db.json", "files/password"} {
+		info, err := os.Stat(filepath.Join(dir, path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm() != 0640 {
+			t.Errorf("%s: expected mode 0640, got %o", path, info.Mode().Perm())
+		}
+	}
+}
+
+func TestWriteSecretNotAnObject(t *testing.T) {
+	dir, err := ioutil.TempDir("", "secrets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	testCases := []struct {
+		name  string
+		value secretValue
+	}{
+		{name: "plain text", value: secretValue{data: []byte("hunter2\n")}},
+		{name: "json but not an object", value: secretValue{data: []byte(`["a","b"]`)}},
+		{name: "binary", value: secretValue{data: []byte{0x30, 0x82, 0x00, 0xff, '\n', 0x00}, binary: true}},
+		{name: "binary which looks like json", value: secretValue{data: []byte(`{"a":"b"}`), binary: true}},
+	}
+	for _, format := range []string{formatExport, formatDotenv, formatFiles} {
+		for _, testcase := range testCases {
+			spec := secretSpec{
+				Name:   "cert",
+				Format: format,
+				Output: filepath.Join(dir, "secret"),
+				File:   filepath.Join(dir, "cert.pem"),
+			}
+			if err := writeSecret(spec, testcase.value, testOutput); err != nil {
+				t.Errorf("%s %s: %v", format, testcase.name, err)
+				continue
+			}
+			got, err := ioutil.ReadFile(spec.File)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, testcase.value.data) {
+				t.Errorf("%s %s: expected %q, got %q", format, testcase.name, testcase.value.data, got)
+			}
+			if _, err := os.Stat(spec.Output); err == nil {
+				t.Errorf("%s %s: expected nothing written to the output", format, testcase.name)
+			}
+		}
+	}
+}
+
+// adversarialSecret holds values which break naive quoting
+var adversarialSecret = map[string]string{
+	"plain":          "hunter2",
+	"spaces":         "correct horse battery staple",
+	"single_quote":   "it's",
+	"double_quote":   `say "hi"`,
+	"command":        "$(touch /tmp/pwned)",
+	"backticks":      "`touch /tmp/pwned`",
+	"variable":       "$HOME ${PATH}",
+	"semicolon":      "a; rm -rf /",
+	"newline":        "line1\nline2\n",
+	"backslash":      `C:\path\n`,
+	"empty":          "",
+	"only_quotes":    `''""''`,
+	"glob":           "*",
+	"unicode":        "p\u00e4ss\u2603",
+	"tab_and_cr":     "a\tb\rc",
+	"trailing_space": "value ",
+}
+
+func TestExportIsShellSafe(t *testing.T) {
+	sh, err := exec.LookPath("sh")
+	if err != nil {
+		t.Skip("no shell to source the output with")
+	}
+	dir, err := ioutil.TempDir("", "secrets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	secret, err := json.Marshal(adversarialSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "secret")
+	spec := secretSpec{Name: "adversarial", Format: formatExport, Output: path}
+	if err := writeSecret(spec, secretValue{data: secret}, testOutput); err != nil {
+		t.Fatal(err)
+	}
+
+	// source the file in a clean environment and dump what it set
+	cmd := exec.Command(sh, "-c", `. "$0" && env -0`, path)
+	cmd.Env = []string{}
+	cmd.Dir = dir
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("sourcing the secret failed: %v", err)
+	}
+
+	env := map[string]string{}
+	for _, entry := range bytes.Split(out, []byte{0}) {
+		if kv := strings.SplitN(string(entry), "=", 2); len(kv) == 2 {
+			env[kv[0]] = kv[1]
+		}
+	}
+	for k, v := range adversarialSecret {
+		if got, ok := env[k]; !ok || got != v {
+			t.Errorf("%s: expected %q, got %q", k, v, got)
+		}
+	}
+	if _, err := os.Stat("/tmp/pwned"); err == nil {
+		t.Errorf("sourcing the secret executed code")
+	}
+}
+
+// python-dotenv's grammar for the lines the dotenv format writes
+var (
+	dotenvBinding       = regexp.MustCompile(`^([A-Za-z_][A-Za-z0-9_]*)=`)
+	dotenvSingleQuoted  = regexp.MustCompile(`^'((?:\\'|[^'])*)'\n`)
+	dotenvDoubleQuoted  = regexp.MustCompile(`^"((?:\\"|[^"])*)"\n`)
+	dotenvSingleEscapes = regexp.MustCompile(`\\[\\']`)
+	dotenvDoubleEscapes = regexp.MustCompile(`\\[\\'"abfnrtv]`)
+	dotenvInterpolation = regexp.MustCompile(`\$\{[^}:]*(?::-[^}]*)?\}`)
+)
+
+// readDotenv reads a dotenv file as python-dotenv does, failing the test
+// for what it would read differently from what was written.
+func readDotenv(t *testing.T, data string) map[string]string {
+	t.Helper()
+	// python-dotenv opens the file with universal newlines
+	data = strings.NewReplacer("\r\n", "\n", "\r", "\n").Replace(data)
+	decoded := map[string]string{"a": "\a", "b": "\b", "f": "\f", "n": "\n", "r": "\r", "t": "\t", "v": "\v"}
+	env := map[string]string{}
+	for data != "" {
+		binding := dotenvBinding.FindStringSubmatch(data)
+		if binding == nil {
+			t.Fatalf("expected a binding at %q", data)
+		}
+		data = data[len(binding[0]):]
+		if m := dotenvSingleQuoted.FindStringSubmatch(data); m != nil {
+			env[binding[1]] = dotenvSingleEscapes.ReplaceAllStringFunc(m[1], func(escape string) string {
+				return escape[1:]
+			})
+			data = data[len(m[0]):]
+			continue
+		}
+		m := dotenvDoubleQuoted.FindStringSubmatch(data)
+		if m == nil {
+			t.Fatalf("%s: expected a quoted value at %q", binding[1], data)
+		}
+		if dotenvInterpolation.MatchString(m[1]) {
+			t.Errorf("%s: %q would have variables expanded", binding[1], m[1])
+		}
+		env[binding[1]] = dotenvDoubleEscapes.ReplaceAllStringFunc(m[1], func(escape string) string {
+			if c, ok := decoded[escape[1:]]; ok {
+				return c
+			}
+			return escape[1:]
+		})
+		data = data[len(m[0]):]
+	}
+	return env
+}
+
+func TestDotenvRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "secrets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	secret, err := json.Marshal(adversarialSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "secret")
+	spec := secretSpec{Name: "adversarial", Format: formatDotenv, Output: path}
+	if err := writeSecret(spec, secretValue{data: secret}, testOutput); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env := readDotenv(t, string(data)); !reflect.DeepEqual(env, adversarialSecret) {
+		t.Errorf("expected %q, got %q", adversarialSecret, env)
+	}
+
+	// values needing no escapes are single quoted, so no dotenv library
+	// expands the variables in them
+	if !strings.Contains(string(data), "variable='$HOME ${PATH}'\n") {
+		t.Errorf("expected the variables to be single quoted, got %s", data)
+	}
+}
+
+func TestEnvNames(t *testing.T) {
+	testCases := []struct {
+		key      string
+		expected string
+		err      bool
+	}{
+		{key: "DB_PASSWORD", expected: "DB_PASSWORD"},
+		{key: "db-password", expected: "db_password"},
+		{key: "db.host", expected: "db_host"},
+		{key: "1password", expected: "_1password"},
+		{key: "$(reboot)", expected: "__reboot_"},
+		{key: "", err: true},
+		{key: "---", err: true},
+	}
+	for _, testcase := range testCases {
+		name, err := envName(testcase.key)
+		if testcase.err {
+			if err == nil {
+				t.Errorf("%q: expected an error, got %q", testcase.key, name)
+			}
+			continue
+		}
+		if err != nil || name != testcase.expected {
+			t.Errorf("%q: expected %q, got %q (%v)", testcase.key, testcase.expected, name, err)
+		}
+	}
+
+	if _, err := envVars(map[string]string{"db-host": "a", "db_host": "b"}); err == nil {
+		t.Errorf("expected colliding keys to be rejected")
+	}
+	if _, err := envVars(map[string]string{"nul": "a\x00b"}); err == nil {
+		t.Errorf("expected a NUL byte in a value to be rejected")
+	}
+}
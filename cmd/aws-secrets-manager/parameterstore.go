@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ssm"
+)
+
+// suffixes of parameter references naming a hierarchy rather than a
+// single parameter: the parameters right under the path, or all the
+// parameters below it.
+const (
+	pathSuffix          = "/*"
+	recursivePathSuffix = "/**"
+)
+
+// characters parameter store allows in parameter names, which are at most
+// 2048 characters long
+var parameterNamePattern = regexp.MustCompile(`^[A-Za-z0-9_./-]+$`)
+
+const maxParameterName = 2048
+
+// parameterStoreBackend fetches parameters from AWS Systems Manager
+// Parameter Store. A reference is a parameter name or ARN, or a path
+// ending in /* or /** to fetch a whole hierarchy.
+type parameterStoreBackend struct{}
+
+// parameterRef is what a parameter reference points at
+type parameterRef struct {
+	// name of the parameter, or the path of the hierarchy
+	name      string
+	byPath    bool
+	recursive bool
+}
+
+func parseParameterRef(ref string) parameterRef {
+	parsed := parameterRef{name: ref}
+	switch {
+	case strings.HasSuffix(ref, recursivePathSuffix):
+		parsed = parameterRef{name: strings.TrimSuffix(ref, recursivePathSuffix), byPath: true, recursive: true}
+	case strings.HasSuffix(ref, pathSuffix):
+		parsed = parameterRef{name: strings.TrimSuffix(ref, pathSuffix), byPath: true}
+	}
+	if parsed.byPath && parsed.name == "" {
+		parsed.name = "/"
+	}
+	return parsed
+}
+
+func (parameterStoreBackend) validate(spec secretSpec) error {
+	ref := parseParameterRef(spec.ARN)
+	if strings.HasPrefix(ref.name, "arn:") {
+		if ref.byPath {
+			return fmt.Errorf("%s: parameter hierarchies are referenced by path, not ARN", spec.ARN)
+		}
+		arnobj, err := arn.Parse(ref.name)
+		if err != nil {
+			return fmt.Errorf("not a valid ARN: %s", spec.ARN)
+		}
+		if arnobj.Service != "ssm" || !strings.HasPrefix(arnobj.Resource, "parameter/") || arnobj.Resource == "parameter/" {
+			return fmt.Errorf("%s is not a parameter ARN", spec.ARN)
+		}
+		if !regionPattern.MatchString(arnobj.Region) {
+			return fmt.Errorf("%s has an invalid region %q", spec.ARN, arnobj.Region)
+		}
+	} else {
+		if !parameterNamePattern.MatchString(ref.name) || len(ref.name) > maxParameterName {
+			return fmt.Errorf("%q is neither an ARN nor a valid parameter name", spec.ARN)
+		}
+		// names in a hierarchy have to be fully qualified
+		if (ref.byPath || strings.Contains(ref.name, "/")) && !strings.HasPrefix(ref.name, "/") {
+			return fmt.Errorf("parameter %q must start with /", spec.ARN)
+		}
+	}
+
+	if ref.byPath && (spec.VersionID != "" || spec.VersionStage != "") {
+		return fmt.Errorf("%s: versions can't be selected for a parameter hierarchy", spec.ARN)
+	}
+	if spec.VersionID != "" && spec.VersionStage != "" {
+		return fmt.Errorf("%s: a parameter is selected by either version or label, not both", spec.ARN)
+	}
+	if spec.VersionID != "" {
+		if version, err := strconv.Atoi(spec.VersionID); err != nil || version < 1 {
+			return fmt.Errorf("%s: parameter versions are numbers, got %q", spec.ARN, spec.VersionID)
+		}
+	}
+	return nil
+}
+
+func (parameterStoreBackend) fetch(ctx context.Context, clients *clientCache, policy retryPolicy, spec secretSpec) (secretValue, error) {
+	svc := clients.getParameterStore(spec)
+	ref := parseParameterRef(spec.ARN)
+	if ref.byPath {
+		return fetchParameterPath(ctx, svc, policy, ref)
+	}
+
+	// parameter store selects versions and labels with a name suffix
+	name := ref.name
+	if spec.VersionID != "" {
+		name += ":" + spec.VersionID
+	} else if spec.VersionStage != "" {
+		name += ":" + spec.VersionStage
+	}
+	input := &ssm.GetParameterInput{
+		Name:           aws.String(name),
+		WithDecryption: aws.Bool(true),
+	}
+
+	var result *ssm.GetParameterOutput
+	var err error
+	err = policy.do(ctx, func(ctx context.Context) error {
+		result, err = svc.GetParameterWithContext(ctx, input)
+		return err
+	})
+	if err != nil {
+		return secretValue{}, err
+	}
+	return secretValue{data: []byte(aws.StringValue(result.Parameter.Value))}, nil
+}
+
+// fetchParameterPath fetches every parameter of a hierarchy into a JSON
+// object, nested like the hierarchy, so /app/prod/db/host fetched with
+// /app/prod/** becomes {"db": {"host": "..."}}. Each page is retried on
+// its own.
+func fetchParameterPath(ctx context.Context, svc *ssm.SSM, policy retryPolicy, ref parameterRef) (secretValue, error) {
+	input := &ssm.GetParametersByPathInput{
+		Path:           aws.String(ref.name),
+		Recursive:      aws.Bool(ref.recursive),
+		WithDecryption: aws.Bool(true),
+	}
+
+	values := map[string]interface{}{}
+	found := 0
+	for {
+		var page *ssm.GetParametersByPathOutput
+		var err error
+		err = policy.do(ctx, func(ctx context.Context) error {
+			page, err = svc.GetParametersByPathWithContext(ctx, input)
+			return err
+		})
+		if err != nil {
+			return secretValue{}, err
+		}
+		for _, param := range page.Parameters {
+			name := strings.TrimPrefix(aws.StringValue(param.Name), strings.TrimSuffix(ref.name, "/")+"/")
+			if err := setParameter(values, strings.Split(name, "/"), aws.StringValue(param.Value)); err != nil {
+				return secretValue{}, err
+			}
+			found++
+		}
+		if aws.StringValue(page.NextToken) == "" {
+			break
+		}
+		input.NextToken = page.NextToken
+	}
+
+	if found == 0 {
+		return secretValue{}, awserr.New(ssm.ErrCodeParameterNotFound, "no parameters found under "+ref.name, nil)
+	}
+	data, err := json.Marshal(values)
+	if err != nil {
+		return secretValue{}, err
+	}
+	return secretValue{data: data}, nil
+}
+
+// setParameter sets the value at the path of keys, creating the objects
+// along the way.
+func setParameter(values map[string]interface{}, keys []string, value string) error {
+	for i, key := range keys[:len(keys)-1] {
+		switch child := values[key].(type) {
+		case nil:
+			nested := map[string]interface{}{}
+			values[key] = nested
+			values = nested
+		case map[string]interface{}:
+			values = child
+		default:
+			return malformed("parameter %s has parameters below it", strings.Join(keys[:i+1], "/"))
+		}
+	}
+	last := keys[len(keys)-1]
+	if _, ok := values[last]; ok {
+		return malformed("parameter %s has parameters below it", strings.Join(keys, "/"))
+	}
+	values[last] = value
+	return nil
+}
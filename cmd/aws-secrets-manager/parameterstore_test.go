@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/aws-samples/aws-secret-sidecar-injector/fakeaws"
+)
+
+func TestValidateParameterRef(t *testing.T) {
+	testCases := []struct {
+		spec  secretSpec
+		valid bool
+	}{
+		{secretSpec{ARN: "/app/prod/db"}, true},
+		{secretSpec{ARN: "db-password"}, true},
+		{secretSpec{ARN: "/app/prod/*"}, true},
+		{secretSpec{ARN: "/app/**"}, true},
+		{secretSpec{ARN: "/*"}, true},
+		{secretSpec{ARN: "arn:aws:ssm:us-east-1:123456789012:parameter/app/prod/db"}, true},
+		{secretSpec{ARN: "/app/prod/db", VersionID: "3"}, true},
+		{secretSpec{ARN: "/app/prod/db", VersionStage: "stable"}, true},
+		{secretSpec{ARN: "app/prod/db"}, false},
+		{secretSpec{ARN: "app/*"}, false},
+		{secretSpec{ARN: "/app/prod db"}, false},
+		{secretSpec{ARN: "arn:aws:ssm:us-east-1:123456789012:parameter/app/*"}, false},
+		{secretSpec{ARN: "arn:aws:secretsmanager:us-east-1:123456789012:secret:db"}, false},
+		{secretSpec{ARN: "arn:aws:ssm:nowhere:123456789012:parameter/db"}, false},
+		{secretSpec{ARN: "/app/prod/*", VersionID: "3"}, false},
+		{secretSpec{ARN: "/app/prod/db", VersionID: "v3"}, false},
+		{secretSpec{ARN: "/app/prod/db", VersionID: "3", VersionStage: "stable"}, false},
+	}
+	for _, testcase := range testCases {
+		err := parameterStoreBackend{}.validate(testcase.spec)
+		if testcase.valid && err != nil {
+			t.Errorf("%+v: unexpected error %v", testcase.spec, err)
+		}
+		if !testcase.valid && err == nil {
+			t.Errorf("%+v: expected an error", testcase.spec)
+		}
+	}
+}
+
+func TestFetchParameters(t *testing.T) {
+	server := fakeaws.NewServer()
+	defer server.Close()
+	server.PutParameter("/app/prod/db/host", fakeaws.TypeString, "db.internal")
+	server.PutParameter("/app/prod/db/password", fakeaws.TypeSecureString, "hunter1")
+	server.PutParameter("/app/prod/db/password", fakeaws.TypeSecureString, "hunter2")
+	server.LabelParameter("/app/prod/db/password", 1, "previous")
+	server.PutParameter("/app/prod/api-key", fakeaws.TypeSecureString, "abc")
+	// more than a page of GetParametersByPath
+	for i := 0; i < 12; i++ {
+		server.PutParameter(fmt.Sprintf("/app/flags/flag%02d", i), fakeaws.TypeString, "on")
+	}
+	server.PutParameter("/app/broken", fakeaws.TypeString, "value")
+	server.PutParameter("/app/broken/child", fakeaws.TypeString, "value")
+	server.FailNext("GetParametersByPath", fakeaws.ErrCodeThrottling, 1)
+
+	clients := testClients(t, server.URL)
+	policy := retryPolicy{maxAttempts: 2}
+
+	testCases := []struct {
+		spec     secretSpec
+		expected string
+		exit     int
+	}{
+		{spec: secretSpec{ARN: "/app/prod/db/host"}, expected: "db.internal"},
+		{spec: secretSpec{ARN: "/app/prod/db/password"}, expected: "hunter2"},
+		{spec: secretSpec{ARN: "/app/prod/db/password", VersionID: "1"}, expected: "hunter1"},
+		{spec: secretSpec{ARN: "/app/prod/db/password", VersionStage: "previous"}, expected: "hunter1"},
+		{spec: secretSpec{ARN: "arn:aws:ssm:us-east-1:123456789012:parameter/app/prod/api-key"}, expected: "abc"},
+		{spec: secretSpec{ARN: "/app/prod/*"}, expected: `{"api-key":"abc"}`},
+		{spec: secretSpec{ARN: "/app/prod/**"}, expected: `{"api-key":"abc","db":{"host":"db.internal","password":"hunter2"}}`},
+		{spec: secretSpec{ARN: "/app/flags/*"}, expected: `{"flag00":"on","flag01":"on","flag02":"on","flag03":"on","flag04":"on","flag05":"on","flag06":"on","flag07":"on","flag08":"on","flag09":"on","flag10":"on","flag11":"on"}`},
+		{spec: secretSpec{ARN: "/app/missing"}, exit: exitNotFound},
+		{spec: secretSpec{ARN: "/app/prod/db/password", VersionID: "7"}, exit: exitNotFound},
+		{spec: secretSpec{ARN: "/app/missing/*"}, exit: exitNotFound},
+		{spec: secretSpec{ARN: "/app/**"}, exit: exitMalformed},
+	}
+	for _, testcase := range testCases {
+		testcase.spec.Backend = backendParameterStore
+		testcase.spec.Region = "us-east-1"
+		value, err := fetchSecret(context.Background(), clients, policy, testcase.spec)
+		if testcase.exit != 0 {
+			if code := awsErrorCode(err); code != testcase.exit {
+				t.Errorf("%s: expected exit code %d, got %d (%v)", testcase.spec.ARN, testcase.exit, code, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", testcase.spec.ARN, err)
+			continue
+		}
+		if string(value.data) != testcase.expected {
+			t.Errorf("%s: expected %s, got %s", testcase.spec.ARN, testcase.expected, value.data)
+		}
+	}
+
+	// a page at a time, plus the throttled call, plus the other paths
+	if calls := server.Calls("GetParametersByPath"); calls != 7 {
+		t.Errorf("expected 7 calls to GetParametersByPath, got %d", calls)
+	}
+	for _, req := range server.Requests() {
+		if req.Params["WithDecryption"] != true {
+			t.Errorf("expected %s to ask for decryption, got %v", req.Action, req.Params)
+		}
+	}
+}
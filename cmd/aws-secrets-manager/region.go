@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws/arn"
+)
+
+var (
+	// characters secrets manager allows in secret names
+	secretNamePattern = regexp.MustCompile(`^[A-Za-z0-9/_+=.@-]{1,512}$`)
+	// region names like us-east-1 or us-gov-west-1
+	regionPattern = regexp.MustCompile(`^[a-z]{2}(-[a-z]+)+-[0-9]+$`)
+)
+
+// validateSecretRef checks the secret is referenced by a full or partial
+// secrets manager ARN, or by a name secrets manager would accept.
+func validateSecretRef(ref string) error {
+	if !strings.HasPrefix(ref, "arn:") {
+		if !secretNamePattern.MatchString(ref) {
+			return fmt.Errorf("%q is neither an ARN nor a valid secret name", ref)
+		}
+		return nil
+	}
+
+	arnobj, err := arn.Parse(ref)
+	if err != nil {
+		return fmt.Errorf("not a valid ARN: %s", ref)
+	}
+	if arnobj.Service != "secretsmanager" {
+		return fmt.Errorf("%s is not a secrets manager ARN", ref)
+	}
+	if !strings.HasPrefix(arnobj.Resource, "secret:") || arnobj.Resource == "secret:" {
+		return fmt.Errorf("%s does not name a secret", ref)
+	}
+	if !regionPattern.MatchString(arnobj.Region) {
+		return fmt.Errorf("%s has an invalid region %q", ref, arnobj.Region)
+	}
+	return nil
+}
+
+// regionResolver works out which region each secret lives in. Instance
+// metadata is only asked once, and only if it is needed.
+type regionResolver struct {
+	getenv   func(string) string
+	metadata func() (string, error)
+
+	once           sync.Once
+	metadataRegion string
+	metadataErr    error
+}
+
+// resolve picks the region for the secret. In order of precedence:
+//
+//  1. the region of the secret's ARN
+//  2. the region set for the secret
+//  3. the AWS_REGION env var
+//  4. the AWS_DEFAULT_REGION env var
+//  5. the region of the instance, from instance metadata
+//
+// An explicit region which doesn't match the ARN's is an error.
+func (r *regionResolver) resolve(spec secretSpec) (string, error) {
+	if spec.Region != "" && !regionPattern.MatchString(spec.Region) {
+		return "", fmt.Errorf("invalid region %q", spec.Region)
+	}
+
+	if arnobj, err := arn.Parse(spec.ARN); err == nil {
+		if spec.Region != "" && spec.Region != arnobj.Region {
+			return "", fmt.Errorf("region %s does not match the region of %s", spec.Region, spec.ARN)
+		}
+		return arnobj.Region, nil
+	}
+
+	if spec.Region != "" {
+		return spec.Region, nil
+	}
+	for _, env := range []string{"AWS_REGION", "AWS_DEFAULT_REGION"} {
+		if region := r.getenv(env); region != "" {
+			if !regionPattern.MatchString(region) {
+				return "", fmt.Errorf("invalid region %q in %s", region, env)
+			}
+			return region, nil
+		}
+	}
+
+	r.once.Do(func() {
+		r.metadataRegion, r.metadataErr = r.metadata()
+	})
+	if r.metadataErr != nil {
+		return "", fmt.Errorf("no region set for %s and none available from instance metadata: %v", spec.ARN, r.metadataErr)
+	}
+	return r.metadataRegion, nil
+}
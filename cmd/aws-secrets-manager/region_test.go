@@ -0,0 +1,125 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestValidateSecretRef(t *testing.T) {
+	testCases := []struct {
+		ref string
+		err bool
+	}{
+		{ref: "arn:aws:secretsmanager:us-east-1:123456789012:secret:db-AbCdEf"},
+		{ref: "arn:aws:secretsmanager:us-east-1:123456789012:secret:db"},
+		{ref: "arn:aws-us-gov:secretsmanager:us-gov-west-1:123456789012:secret:prod/db"},
+		{ref: "prod/db"},
+		{ref: "db.password+user=x@example_1"},
+		{ref: "arn:aws:ssm:us-east-1:123456789012:parameter/db", err: true},
+		{ref: "arn:aws:secretsmanager:us-east-1:123456789012:secret:", err: true},
+		{ref: "arn:aws:secretsmanager::123456789012:secret:db", err: true},
+		{ref: "arn:aws:secretsmanager", err: true},
+		{ref: "db password", err: true},
+		{ref: "", err: true},
+	}
+	for _, testcase := range testCases {
+		err := validateSecretRef(testcase.ref)
+		if testcase.err && err == nil {
+			t.Errorf("%q: expected an error", testcase.ref)
+		}
+		if !testcase.err && err != nil {
+			t.Errorf("%q: unexpected error %v", testcase.ref, err)
+		}
+	}
+}
+
+func TestResolveRegion(t *testing.T) {
+	testCases := []struct {
+		name     string
+		spec     secretSpec
+		env      map[string]string
+		metadata string
+		expected string
+		err      bool
+	}{
+		{
+			name:     "region from the arn wins",
+			spec:     secretSpec{ARN: "arn:aws:secretsmanager:eu-west-1:123456789012:secret:db"},
+			env:      map[string]string{"AWS_REGION": "us-east-1"},
+			expected: "eu-west-1",
+		},
+		{
+			name:     "explicit region matching the arn",
+			spec:     secretSpec{ARN: "arn:aws:secretsmanager:eu-west-1:123456789012:secret:db", Region: "eu-west-1"},
+			expected: "eu-west-1",
+		},
+		{
+			name: "explicit region conflicting with the arn",
+			spec: secretSpec{ARN: "arn:aws:secretsmanager:eu-west-1:123456789012:secret:db", Region: "us-east-1"},
+			err:  true,
+		},
+		{
+			name:     "explicit region for a name",
+			spec:     secretSpec{ARN: "prod/db", Region: "ap-southeast-2"},
+			env:      map[string]string{"AWS_REGION": "us-east-1"},
+			expected: "ap-southeast-2",
+		},
+		{
+			name:     "AWS_REGION before AWS_DEFAULT_REGION",
+			spec:     secretSpec{ARN: "prod/db"},
+			env:      map[string]string{"AWS_REGION": "us-east-1", "AWS_DEFAULT_REGION": "us-west-2"},
+			expected: "us-east-1",
+		},
+		{
+			name:     "AWS_DEFAULT_REGION",
+			spec:     secretSpec{ARN: "prod/db"},
+			env:      map[string]string{"AWS_DEFAULT_REGION": "us-west-2"},
+			expected: "us-west-2",
+		},
+		{
+			name:     "instance metadata",
+			spec:     secretSpec{ARN: "prod/db"},
+			metadata: "ca-central-1",
+			expected: "ca-central-1",
+		},
+		{
+			name: "no region anywhere",
+			spec: secretSpec{ARN: "prod/db"},
+			err:  true,
+		},
+		{
+			name: "invalid explicit region",
+			spec: secretSpec{ARN: "prod/db", Region: "mars"},
+			err:  true,
+		},
+	}
+	for _, testcase := range testCases {
+		calls := 0
+		r := &regionResolver{
+			getenv: func(key string) string { return testcase.env[key] },
+			metadata: func() (string, error) {
+				calls++
+				if testcase.metadata == "" {
+					return "", errors.New("no instance metadata")
+				}
+				return testcase.metadata, nil
+			},
+		}
+		region, err := r.resolve(testcase.spec)
+		if testcase.err {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %q", testcase.name, region)
+			}
+			continue
+		}
+		if err != nil || region != testcase.expected {
+			t.Errorf("%s: expected %q, got %q (%v)", testcase.name, testcase.expected, region, err)
+		}
+
+		// metadata is only asked once however many secrets need it
+		r.resolve(testcase.spec)
+		if calls > 1 {
+			t.Errorf("%s: instance metadata asked %d times", testcase.name, calls)
+		}
+	}
+}
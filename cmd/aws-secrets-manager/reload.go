@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// signals the app can be sent when the secrets change
+var reloadSignals = map[string]syscall.Signal{
+	"HUP":  syscall.SIGHUP,
+	"USR1": syscall.SIGUSR1,
+	"USR2": syscall.SIGUSR2,
+	"INT":  syscall.SIGINT,
+	"QUIT": syscall.SIGQUIT,
+	"TERM": syscall.SIGTERM,
+}
+
+// reloader tells the app the secrets changed, by signalling its process
+// and/or calling an HTTP hook. The zero value does nothing.
+type reloader struct {
+	// name of the app's process, which the fetcher only sees when the
+	// pod shares its process namespace
+	process string
+	signal  syscall.Signal
+	// URL POSTed to on every change
+	url    string
+	client *http.Client
+	// where processes are looked up, /proc outside of tests
+	procDir string
+}
+
+// newReloader checks the reload settings as given on the command line.
+// The signal is a name like HUP or SIGHUP.
+func newReloader(process, signal, hookURL string) (*reloader, error) {
+	r := &reloader{process: process, url: hookURL, client: http.DefaultClient, procDir: "/proc"}
+	if process != "" {
+		sig, ok := reloadSignals[strings.TrimPrefix(strings.ToUpper(signal), "SIG")]
+		if !ok {
+			return nil, fmt.Errorf("unknown reload signal %q", signal)
+		}
+		r.signal = sig
+	}
+	if hookURL != "" {
+		u, err := url.Parse(hookURL)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return nil, fmt.Errorf("invalid reload URL %q, expected an http or https URL", hookURL)
+		}
+	}
+	return r, nil
+}
+
+// enabled returns true when the reloader has anything to do
+func (r *reloader) enabled() bool {
+	return r.process != "" || r.url != ""
+}
+
+// reload signals the app's processes and calls the hook, both are tried
+// even when the first fails.
+func (r *reloader) reload(ctx context.Context) error {
+	var errs []string
+	if r.process != "" {
+		if err := r.signalProcess(); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if r.url != "" {
+		if err := r.callHook(ctx); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("reloading the app: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func (r *reloader) signalProcess() error {
+	pids, err := findProcesses(r.procDir, r.process)
+	if err != nil {
+		return err
+	}
+	if len(pids) == 0 {
+		return fmt.Errorf("no process named %s, the pod must share its process namespace", r.process)
+	}
+	for _, pid := range pids {
+		if err := syscall.Kill(pid, r.signal); err != nil {
+			return fmt.Errorf("signalling process %d: %v", pid, err)
+		}
+	}
+	return nil
+}
+
+func (r *reloader) callHook(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("reload hook %s returned %s", r.url, resp.Status)
+	}
+	return nil
+}
+
+// findProcesses returns the IDs of the processes in procDir whose command
+// or executable is named name, leaving out the fetcher itself.
+func findProcesses(procDir, name string) ([]int, error) {
+	entries, err := ioutil.ReadDir(procDir)
+	if err != nil {
+		return nil, err
+	}
+	var pids []int
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil || pid == os.Getpid() {
+			continue
+		}
+		// processes may exit while they are looked at
+		comm, _ := ioutil.ReadFile(filepath.Join(procDir, entry.Name(), "comm"))
+		cmdline, _ := ioutil.ReadFile(filepath.Join(procDir, entry.Name(), "cmdline"))
+		argv0 := strings.SplitN(string(cmdline), "\x00", 2)[0]
+		if strings.TrimSpace(string(comm)) == name || (argv0 != "" && filepath.Base(argv0) == name) {
+			pids = append(pids, pid)
+		}
+	}
+	return pids, nil
+}
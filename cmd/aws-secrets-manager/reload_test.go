@@ -0,0 +1,72 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+)
+
+func TestNewReloader(t *testing.T) {
+	r, err := newReloader("nginx", "SIGUSR1", "http://localhost:8080/-/reload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.signal != syscall.SIGUSR1 || !r.enabled() {
+		t.Errorf("unexpected reloader %+v", r)
+	}
+	if r, err := newReloader("", "HUP", ""); err != nil || r.enabled() {
+		t.Errorf("expected a reloader doing nothing, got %+v (%v)", r, err)
+	}
+
+	for _, args := range [][3]string{
+		{"nginx", "RELOAD", ""},
+		{"", "HUP", "localhost:8080"},
+		{"", "HUP", "ftp://localhost/reload"},
+	} {
+		if _, err := newReloader(args[0], args[1], args[2]); err == nil {
+			t.Errorf("%v: expected an error", args)
+		}
+	}
+}
+
+func TestFindProcesses(t *testing.T) {
+	dir, err := ioutil.TempDir("", "proc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	processes := map[string][2]string{
+		"1":  {"pause\n", "/pause\x00"},
+		"7":  {"nginx\n", "/usr/sbin/nginx\x00-g\x00daemon off;\x00"},
+		"12": {"nginx\n", "nginx: worker process\x00"},
+		"20": {"python3\n", "/usr/bin/python3\x00nginx\x00"},
+		// a thread name longer than comm allows
+		"31": {"my-long-app-nam\n", "/app/my-long-app-name\x00"},
+	}
+	for pid, files := range processes {
+		if err := os.Mkdir(filepath.Join(dir, pid), 0755); err != nil {
+			t.Fatal(err)
+		}
+		ioutil.WriteFile(filepath.Join(dir, pid, "comm"), []byte(files[0]), 0644)
+		ioutil.WriteFile(filepath.Join(dir, pid, "cmdline"), []byte(files[1]), 0644)
+	}
+	os.Mkdir(filepath.Join(dir, "self"), 0755)
+
+	for name, expected := range map[string][]int{
+		"nginx":            {12, 7},
+		"my-long-app-name": {31},
+		"missing":          nil,
+	} {
+		pids, err := findProcesses(dir, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(pids, expected) {
+			t.Errorf("%s: expected %v, got %v", name, expected, pids)
+		}
+	}
+}
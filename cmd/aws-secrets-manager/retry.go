@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+// retryPolicy decides how often and how long to wait between calls to
+// AWS. The SDK's own retries are turned off so this is the only policy.
+type retryPolicy struct {
+	// most calls made for one secret, including the first
+	maxAttempts int
+	// delay before the first retry, doubled on every retry after it
+	baseDelay time.Duration
+	// upper bound on the delay between two calls
+	maxDelay time.Duration
+	// fraction of the delay which is randomized, between 0 and 1
+	jitter float64
+}
+
+// error codes worth retrying. Everything else, like a missing secret or
+// being denied access, won't get better by asking again.
+var retryableCodes = map[string]bool{
+	"ThrottlingException":      true,
+	"TooManyRequestsException": true,
+	"RequestLimitExceeded":     true,
+	"InternalServiceError":     true,
+	"InternalFailure":          true,
+	"ServiceUnavailable":       true,
+	"RequestTimeout":           true,
+	"RequestTimeoutException":  true,
+	// the IRSA token may not be there yet or STS may be unreachable
+	// while the pod's network comes up
+	"IDPCommunicationError": true,
+	"InvalidIdentityToken":  true,
+	"WebIdentityErr":        true,
+	"NoCredentialProviders": true,
+	// network errors and responses cut short
+	request.ErrCodeRequestError:    true,
+	request.ErrCodeResponseTimeout: true,
+	request.ErrCodeSerialization:   true,
+}
+
+// retryable returns true for errors which may go away on their own
+func retryable(err error) bool {
+	var aerr awserr.Error
+	if !errors.As(err, &aerr) {
+		return false
+	}
+	if aerr.Code() == request.CanceledErrorCode {
+		return false
+	}
+	if retryableCodes[aerr.Code()] {
+		return true
+	}
+	// request errors wrap the network error which caused them
+	return aerr.OrigErr() != nil && retryable(aerr.OrigErr())
+}
+
+var (
+	randMu sync.Mutex
+	random = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+// delay returns how long to wait before the given retry, starting at 1
+func (p retryPolicy) delay(retry int) time.Duration {
+	d := p.baseDelay
+	for i := 1; i < retry && d < p.maxDelay; i++ {
+		d *= 2
+	}
+	if d > p.maxDelay {
+		d = p.maxDelay
+	}
+	if p.jitter > 0 {
+		randMu.Lock()
+		f := random.Float64()
+		randMu.Unlock()
+		d -= time.Duration(float64(d) * p.jitter * f)
+	}
+	return d
+}
+
+// do calls fn until it succeeds, fails with an error which isn't worth
+// retrying, runs out of attempts or the context is done. The last error
+// from fn is returned.
+func (p retryPolicy) do(ctx context.Context, fn func(ctx context.Context) error) error {
+	var err error
+	for attempt := 1; ; attempt++ {
+		err = fn(ctx)
+		if err == nil || !retryable(err) || attempt >= p.maxAttempts {
+			return err
+		}
+
+		timer := time.NewTimer(p.delay(attempt))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+	}
+}
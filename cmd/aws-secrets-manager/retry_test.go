@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+const testSecretArn = "arn:aws:secretsmanager:us-east-1:123456789012:secret:db-AbCdEf"
+
+// fakeSecretsManager fails the first calls with the given error code and
+// then returns the secret. It counts the calls made to it.
+func fakeSecretsManager(failures int32, code string, calls *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		if atomic.AddInt32(calls, 1) <= failures {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, `{"__type":%q,"message":"injected failure"}`, code)
+			return
+		}
+		fmt.Fprintf(w, `{"ARN":%q,"Name":"db","SecretString":"{\"password\":\"hunter2\"}","VersionId":"v1"}`, testSecretArn)
+	}))
+}
+
+func testClients(t *testing.T, endpoint string) *clientCache {
+	sess, err := session.NewSession(&aws.Config{
+		Endpoint:    aws.String(endpoint),
+		Region:      aws.String("us-east-1"),
+		Credentials: credentials.NewStaticCredentials("AKID", "SECRET", ""),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newClientCache(sess)
+}
+
+func TestFetchRetries(t *testing.T) {
+	policy := retryPolicy{maxAttempts: 4, baseDelay: time.Millisecond, maxDelay: 5 * time.Millisecond, jitter: 0.5}
+	testCases := []struct {
+		name     string
+		failures int32
+		code     string
+		calls    int32
+		exit     int
+	}{
+		{name: "no failures", failures: 0, code: "ThrottlingException", calls: 1},
+		{name: "throttled then ok", failures: 2, code: "ThrottlingException", calls: 3},
+		{name: "internal error then ok", failures: 3, code: "InternalServiceError", calls: 4},
+		{name: "throttled too often", failures: 10, code: "ThrottlingException", calls: 4, exit: exitThrottled},
+		{name: "not found is permanent", failures: 10, code: "ResourceNotFoundException", calls: 1, exit: exitNotFound},
+		{name: "access denied is permanent", failures: 10, code: "AccessDeniedException", calls: 1, exit: exitAccessDenied},
+	}
+	for _, testcase := range testCases {
+		var calls int32
+		server := fakeSecretsManager(testcase.failures, testcase.code, &calls)
+		clients := testClients(t, server.URL)
+
+		value, err := fetchSecret(context.Background(), clients, policy, secretSpec{Name: "db", ARN: testSecretArn, Region: "us-east-1"})
+		server.Close()
+
+		if calls != testcase.calls {
+			t.Errorf("%s: expected %d calls, got %d", testcase.name, testcase.calls, calls)
+		}
+		if testcase.exit != 0 {
+			if err == nil {
+				t.Errorf("%s: expected an error", testcase.name)
+			} else if code := awsErrorCode(err); code != testcase.exit {
+				t.Errorf("%s: expected exit code %d, got %d (%v)", testcase.name, testcase.exit, code, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", testcase.name, err)
+			continue
+		}
+		if string(value.data) != `{"password":"hunter2"}` {
+			t.Errorf("%s: unexpected secret %q", testcase.name, value.data)
+		}
+	}
+}
+
+func TestFetchDeadline(t *testing.T) {
+	var calls int32
+	server := fakeSecretsManager(1000, "ThrottlingException", &calls)
+	defer server.Close()
+	clients := testClients(t, server.URL)
+
+	policy := retryPolicy{maxAttempts: 1000, baseDelay: 10 * time.Millisecond, maxDelay: 10 * time.Millisecond}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err := fetchSecret(ctx, clients, policy, secretSpec{Name: "db", ARN: testSecretArn, Region: "us-east-1"})
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected to give up at the deadline, took %v", elapsed)
+	}
+	if calls >= 1000 {
+		t.Errorf("expected the deadline to stop the retries, made %d calls", calls)
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	policy := retryPolicy{baseDelay: 100 * time.Millisecond, maxDelay: time.Second}
+	expected := []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond, 800 * time.Millisecond, time.Second, time.Second}
+	for i, e := range expected {
+		if d := policy.delay(i + 1); d != e {
+			t.Errorf("retry %d: expected %v, got %v", i+1, e, d)
+		}
+	}
+
+	policy.jitter = 0.5
+	for i := 1; i < 100; i++ {
+		if d := policy.delay(3); d < 200*time.Millisecond || d > 400*time.Millisecond {
+			t.Fatalf("jittered delay %v out of range", d)
+		}
+	}
+}
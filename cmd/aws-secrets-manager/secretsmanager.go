@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+)
+
+// secretsManagerBackend fetches secrets from AWS Secrets Manager
+type secretsManagerBackend struct{}
+
+func (secretsManagerBackend) validate(spec secretSpec) error {
+	return validateSecretRef(spec.ARN)
+}
+
+func (secretsManagerBackend) fetch(ctx context.Context, clients *clientCache, policy retryPolicy, spec secretSpec) (secretValue, error) {
+	svc := clients.getSecretsManager(spec)
+
+	input := &secretsmanager.GetSecretValueInput{
+		SecretId: aws.String(spec.ARN),
+	}
+	if spec.VersionStage != "" {
+		input.VersionStage = aws.String(spec.VersionStage)
+	}
+	if spec.VersionID != "" {
+		input.VersionId = aws.String(spec.VersionID)
+	}
+
+	var result *secretsmanager.GetSecretValueOutput
+	var err error
+	err = policy.do(ctx, func(ctx context.Context) error {
+		result, err = svc.GetSecretValueWithContext(ctx, input)
+		return err
+	})
+	if err != nil {
+		return secretValue{}, err
+	}
+	// Decrypts secret using the associated KMS CMK.
+	// Depending on whether the secret is a string or binary, one of these fields will be populated.
+	// The SDK already base64 decodes SecretBinary, so the bytes are used as is.
+	version := aws.StringValue(result.VersionId)
+	if result.SecretString != nil {
+		return secretValue{data: []byte(*result.SecretString), version: version}, nil
+	}
+	return secretValue{data: result.SecretBinary, binary: true, version: version}, nil
+}
+
+// version returns the ID of the version the spec selects, from the
+// secret's metadata. Secrets pinned to a version ID never change.
+func (secretsManagerBackend) version(ctx context.Context, clients *clientCache, policy retryPolicy, spec secretSpec) (string, error) {
+	if spec.VersionID != "" {
+		return spec.VersionID, nil
+	}
+	svc := clients.getSecretsManager(spec)
+
+	input := &secretsmanager.DescribeSecretInput{
+		SecretId: aws.String(spec.ARN),
+	}
+	var result *secretsmanager.DescribeSecretOutput
+	var err error
+	err = policy.do(ctx, func(ctx context.Context) error {
+		result, err = svc.DescribeSecretWithContext(ctx, input)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	for id, stages := range result.VersionIdsToStages {
+		for _, stage := range stages {
+			if aws.StringValue(stage) == spec.VersionStage {
+				return id, nil
+			}
+		}
+	}
+	return "", awserr.New(secretsmanager.ErrCodeResourceNotFoundException,
+		fmt.Sprintf("no version of the secret has the stage %s", spec.VersionStage), nil)
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"gopkg.in/yaml.v2"
+)
+
+// default location the secrets are written to. This is the in memory
+// volume the admission controller mounts into the init container, unless
+// the pod moves it.
+const (
+	defaultOutputDir  = "/tmp"
+	defaultOutputFile = "secret"
+	defaultOutput     = defaultOutputDir + "/" + defaultOutputFile
+	defaultFileMode   = "0644"
+)
+
+// version of the secret fetched when no stage or version id is given
+const defaultVersionStage = "AWSCURRENT"
+
+// secretSpec describes a single secret to fetch and where to put it.
+type secretSpec struct {
+	// Name is a friendly name for the secret, used in logs
+	Name string `json:"name" yaml:"name"`
+
+	// ARN of the secret in secrets manager. A partial ARN, without the
+	// random suffix, or the secret's name work too. For parameter store
+	// the name or ARN of the parameter, or a path ending in /* or /**,
+	// see parameterstore.go.
+	ARN string `json:"arn" yaml:"arn"`
+
+	// Backend is the service the secret is fetched from, secretsmanager
+	// or ssm for parameter store. Defaults to secretsmanager.
+	Backend string `json:"backend,omitempty" yaml:"backend,omitempty"`
+
+	// Region the secret lives in when it isn't referenced by ARN. See
+	// regionResolver for where it comes from when not set.
+	Region string `json:"region,omitempty" yaml:"region,omitempty"`
+
+	// RoleARN is a role to assume before fetching the secret, for
+	// secrets in another account. The session's own credentials are
+	// used when not set.
+	RoleARN string `json:"roleArn,omitempty" yaml:"roleArn,omitempty"`
+
+	// ExternalID to pass when assuming the role, if the role asks for one
+	ExternalID string `json:"externalId,omitempty" yaml:"externalId,omitempty"`
+
+	// SessionName of the assumed role session. Defaults to
+	// aws-secret-sidecar-injector.
+	SessionName string `json:"sessionName,omitempty" yaml:"sessionName,omitempty"`
+
+	// VersionStage is the staging label of the version to fetch, like
+	// AWSPENDING or AWSPREVIOUS. Defaults to AWSCURRENT unless a
+	// VersionID is set. Parameters take it as a parameter label, and
+	// default to their latest version.
+	VersionStage string `json:"versionStage,omitempty" yaml:"versionStage,omitempty"`
+
+	// VersionID pins the secret to a specific version, a version number
+	// for parameters.
+	VersionID string `json:"versionId,omitempty" yaml:"versionId,omitempty"`
+
+	// Output is the file the secret gets written to. Relative paths are
+	// taken from the output dir, /tmp by default. Defaults to the output
+	// file, /tmp/secret by default, for the export and dotenv formats,
+	// which collect all the secrets into the one file, and to
+	// /tmp/<name> otherwise.
+	Output string `json:"output,omitempty" yaml:"output,omitempty"`
+
+	// File the secret is written to verbatim when it is plain text or
+	// binary and the format needs a JSON object. Relative paths are
+	// taken from the output dir. Defaults to /tmp/<name>.
+	File string `json:"file,omitempty" yaml:"file,omitempty"`
+
+	// Format the secret is written in, see output.go. Defaults to export.
+	Format string `json:"format,omitempty" yaml:"format,omitempty"`
+
+	// Separator joins the keys of nested objects when the secret is
+	// flattened into key/values. Defaults to __.
+	Separator string `json:"separator,omitempty" yaml:"separator,omitempty"`
+
+	// Arrays sets how arrays are flattened, see flatten.go. Defaults
+	// to error.
+	Arrays string `json:"arrays,omitempty" yaml:"arrays,omitempty"`
+
+	// Keys selects keys of a JSON secret and renames them, as a comma
+	// separated list of key[=name] entries, see keys.go. May also be
+	// given after a # in the ARN. All the keys are kept when not set.
+	Keys string `json:"keys,omitempty" yaml:"keys,omitempty"`
+}
+
+// secretFlags collects repeated --secret flags of the form [name=]arn
+type secretFlags []string
+
+func (s *secretFlags) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *secretFlags) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+// prefix of references to parameter store parameters in lists and flags
+const parameterRefPrefix = backendParameterStore + ":"
+
+// parseSecretRef parses a single secret reference of the form [name=]arn.
+// When no name is given, the name is taken from the ARN's resource.
+// Parameters are referenced as [name=]ssm:<parameter>.
+func parseSecretRef(ref string) (secretSpec, error) {
+	ref = strings.TrimSpace(ref)
+	spec := secretSpec{ARN: ref}
+
+	// Anything before the first = is a name, unless the reference is an
+	// ARN: the names of secrets can contain a =, so their ARNs can too.
+	// Refer to such a secret by name as name=secret-name. The keys after
+	// a # have their own =.
+	if i := strings.Index(ref, "="); i >= 0 && !strings.HasPrefix(ref, "arn:") && !strings.Contains(ref[:i], keysSeparator) {
+		spec.Name = strings.TrimSpace(ref[:i])
+		spec.ARN = strings.TrimSpace(ref[i+1:])
+	}
+	if strings.HasPrefix(spec.ARN, parameterRefPrefix) {
+		spec.Backend = backendParameterStore
+		spec.ARN = strings.TrimPrefix(spec.ARN, parameterRefPrefix)
+	}
+	if spec.ARN == "" {
+		return spec, fmt.Errorf("empty secret reference %q", ref)
+	}
+	return spec, nil
+}
+
+// parseSecretList parses a comma separated list of secret references.
+// The list can't tell the keys selected from a secret, themselves comma
+// separated, from more secrets, so the entries after one selecting keys
+// must be ARNs or parameters rather than the further keys they likely are.
+func parseSecretList(list string) ([]secretSpec, error) {
+	var specs []secretSpec
+	keys := ""
+	for _, ref := range strings.Split(list, ",") {
+		if strings.TrimSpace(ref) == "" {
+			continue
+		}
+		spec, err := parseSecretRef(ref)
+		if err != nil {
+			return nil, err
+		}
+		if keys != "" && !strings.HasPrefix(spec.ARN, "arn:") && spec.Backend != backendParameterStore {
+			return nil, fmt.Errorf("ambiguous secret reference %q after %q selecting keys, list several keys in SECRETS or refer to the next secret by ARN", strings.TrimSpace(ref), keys)
+		}
+		keys = ""
+		if strings.Contains(spec.ARN, keysSeparator) {
+			keys = strings.TrimSpace(ref)
+		}
+		specs = append(specs, spec)
+	}
+	return specs, nil
+}
+
+// parseManifest parses a JSON or YAML list of secret specs. YAML is a
+// superset of JSON, so the one parser handles both.
+func parseManifest(data []byte) ([]secretSpec, error) {
+	var specs []secretSpec
+	if err := yaml.Unmarshal(data, &specs); err != nil {
+		return nil, fmt.Errorf("unable to parse secrets manifest: %v", err)
+	}
+	return specs, nil
+}
+
+// loadManifest reads and parses a secrets manifest from disk
+func loadManifest(path string) ([]secretSpec, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read secrets manifest: %v", err)
+	}
+	return parseManifest(data)
+}
+
+// secretName derives a name for the secret from its ARN. Secrets manager
+// ARNs look like arn:aws:secretsmanager:region:account:secret:name-AbCdEf
+// and parameter ARNs like arn:aws:ssm:region:account:parameter/app/name.
+// Secrets referenced by name are named after it, parameter paths after the
+// path without its leading / or trailing /* or /**.
+func secretName(secretArn string) string {
+	name := secretArn
+	if arnobj, err := arn.Parse(secretArn); err == nil {
+		name = strings.TrimPrefix(strings.TrimPrefix(arnobj.Resource, "secret:"), "parameter/")
+	}
+	name = strings.TrimSuffix(strings.TrimSuffix(name, recursivePathSuffix), pathSuffix)
+	return strings.Trim(name, "/")
+}
+
+// fileName turns a secret name into something usable as a file name
+func fileName(name string) string {
+	return strings.NewReplacer("/", "-", "\x00", "").Replace(name)
+}
+
+// outputPath resolves a path relative to the output dir. Absolute paths
+// are taken as is, relative ones can't leave the output dir.
+func outputPath(path string, out outputConfig) (string, error) {
+	if filepath.IsAbs(path) {
+		return filepath.Clean(path), nil
+	}
+	path = filepath.Clean(path)
+	if path == ".." || strings.HasPrefix(path, "../") {
+		return "", fmt.Errorf("outside of %s", out.dir)
+	}
+	return filepath.Join(out.dir, path), nil
+}
+
+// collectSpecs gathers the secrets to fetch from all the supported sources
+// and fills in the defaults. Sources are, in order, the legacy SECRET_ARN
+// env var, the comma separated SECRET_ARNS env var, an inline manifest in
+// the SECRETS env var, a manifest file and repeated --secret flags.
+// The format is applied to every secret which doesn't set its own, and
+// outputs are placed as the output config says.
+func collectSpecs(getenv func(string) string, manifestPath, format string, refs []string, out outputConfig) ([]secretSpec, error) {
+	var specs []secretSpec
+
+	if secretArn := getenv("SECRET_ARN"); secretArn != "" {
+		specs = append(specs, secretSpec{
+			Name:         "secret",
+			ARN:          secretArn,
+			Backend:      getenv("SECRET_BACKEND"),
+			Region:       getenv("SECRET_REGION"),
+			RoleARN:      getenv("SECRET_ROLE_ARN"),
+			ExternalID:   getenv("SECRET_EXTERNAL_ID"),
+			SessionName:  getenv("SECRET_SESSION_NAME"),
+			VersionStage: getenv("SECRET_VERSION_STAGE"),
+			VersionID:    getenv("SECRET_VERSION_ID"),
+			Format:       getenv("SECRET_FORMAT"),
+			File:         getenv("SECRET_FILE"),
+		})
+	}
+
+	list, err := parseSecretList(getenv("SECRET_ARNS"))
+	if err != nil {
+		return nil, err
+	}
+	specs = append(specs, list...)
+
+	if inline := getenv("SECRETS"); inline != "" {
+		manifest, err := parseManifest([]byte(inline))
+		if err != nil {
+			return nil, err
+		}
+		specs = append(specs, manifest...)
+	}
+
+	if manifestPath == "" {
+		manifestPath = getenv("SECRETS_MANIFEST")
+	}
+	if manifestPath != "" {
+		manifest, err := loadManifest(manifestPath)
+		if err != nil {
+			return nil, err
+		}
+		specs = append(specs, manifest...)
+	}
+
+	for _, ref := range refs {
+		spec, err := parseSecretRef(ref)
+		if err != nil {
+			return nil, err
+		}
+		specs = append(specs, spec)
+	}
+
+	if len(specs) == 0 {
+		return nil, fmt.Errorf("no secrets specified")
+	}
+
+	for i := range specs {
+		if specs[i].ARN == "" {
+			return nil, fmt.Errorf("secret %d has no arn", i)
+		}
+		if j := strings.Index(specs[i].ARN, keysSeparator); j >= 0 {
+			if specs[i].Keys != "" {
+				return nil, fmt.Errorf("secret %s sets keys both in its arn and on their own", specs[i].ARN)
+			}
+			specs[i].ARN, specs[i].Keys = specs[i].ARN[:j], specs[i].ARN[j+1:]
+		}
+		if specs[i].Name == "" {
+			specs[i].Name = secretName(specs[i].ARN)
+		}
+		if specs[i].Backend == "" {
+			specs[i].Backend = backendSecretsManager
+		}
+		if _, ok := backends[specs[i].Backend]; !ok {
+			return nil, fmt.Errorf("secret %s has an unknown backend %q", specs[i].Name, specs[i].Backend)
+		}
+		if specs[i].RoleARN != "" {
+			if roleArn, err := arn.Parse(specs[i].RoleARN); err != nil || roleArn.Service != "iam" || !strings.HasPrefix(roleArn.Resource, "role/") {
+				return nil, fmt.Errorf("secret %s has an invalid role ARN %q", specs[i].Name, specs[i].RoleARN)
+			}
+			if specs[i].SessionName == "" {
+				specs[i].SessionName = defaultSessionName
+			}
+			if !sessionNamePattern.MatchString(specs[i].SessionName) {
+				return nil, fmt.Errorf("secret %s has an invalid session name %q", specs[i].Name, specs[i].SessionName)
+			}
+		} else if specs[i].ExternalID != "" || specs[i].SessionName != "" {
+			return nil, fmt.Errorf("secret %s sets an external id or session name without a role ARN", specs[i].Name)
+		}
+		if specs[i].Backend == backendSecretsManager && specs[i].VersionStage == "" && specs[i].VersionID == "" {
+			specs[i].VersionStage = defaultVersionStage
+		}
+		if specs[i].Format == "" {
+			specs[i].Format = format
+		}
+		if specs[i].Format == "" {
+			specs[i].Format = formatExport
+		}
+		if !validFormat(specs[i].Format) {
+			return nil, fmt.Errorf("secret %s has an unknown format %q", specs[i].Name, specs[i].Format)
+		}
+		if specs[i].Separator == "" {
+			specs[i].Separator = defaultSeparator
+		}
+		if specs[i].Arrays == "" {
+			specs[i].Arrays = arraysError
+		}
+		if !validArrays(specs[i].Arrays) {
+			return nil, fmt.Errorf("secret %s has an unknown arrays setting %q", specs[i].Name, specs[i].Arrays)
+		}
+		if specs[i].Keys != "" {
+			if _, err := parseKeys(specs[i].Keys); err != nil {
+				return nil, fmt.Errorf("secret %s has %v", specs[i].Name, err)
+			}
+		}
+		if specs[i].Output == "" {
+			if appendFormat(specs[i].Format) {
+				specs[i].Output = out.file
+			} else {
+				specs[i].Output = fileName(specs[i].Name)
+			}
+		}
+		if specs[i].Output, err = outputPath(specs[i].Output, out); err != nil {
+			return nil, fmt.Errorf("secret %s has an output %v", specs[i].Name, err)
+		}
+
+		if specs[i].File == "" {
+			specs[i].File = fileName(specs[i].Name)
+		}
+		if specs[i].File, err = outputPath(specs[i].File, out); err != nil {
+			return nil, fmt.Errorf("secret %s has a file %v", specs[i].Name, err)
+		}
+	}
+
+	return specs, nil
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCollectSpecs(t *testing.T) {
+	testCases := []struct {
+		name     string
+		env      map[string]string
+		format   string
+		refs     []string
+		output   *outputConfig
+		expected []secretSpec
+		err      bool
+	}{
+		{
+			name: "legacy single arn",
+			env: map[string]string{
+				"SECRET_ARN": "arn:aws:secretsmanager:us-east-1:123456789012:secret:db-AbCdEf",
+			},
+			expected: []secretSpec{
+				{Name: "secret", ARN: "arn:aws:secretsmanager:us-east-1:123456789012:secret:db-AbCdEf", Backend: backendSecretsManager, VersionStage: defaultVersionStage, Output: defaultOutput, Format: formatExport, Separator: defaultSeparator, Arrays: arraysError, File: "/tmp/secret"},
+			},
+		},
+		{
+			name: "comma separated list",
+			env: map[string]string{
+				"SECRET_ARNS": "db=arn:aws:secretsmanager:us-east-1:123456789012:secret:db-AbCdEf, arn:aws:secretsmanager:us-west-2:123456789012:secret:api-key-GhIjKl",
+			},
+			expected: []secretSpec{
+				{Name: "db", ARN: "arn:aws:secretsmanager:us-east-1:123456789012:secret:db-AbCdEf", Backend: backendSecretsManager, VersionStage: defaultVersionStage, Output: defaultOutput, Format: formatExport, Separator: defaultSeparator, Arrays: arraysError, File: "/tmp/db"},
+				{Name: "api-key-GhIjKl", ARN: "arn:aws:secretsmanager:us-west-2:123456789012:secret:api-key-GhIjKl", Backend: backendSecretsManager, VersionStage: defaultVersionStage, Output: defaultOutput, Format: formatExport, Separator: defaultSeparator, Arrays: arraysError, File: "/tmp/api-key-GhIjKl"},
+			},
+		},
+		{
+			name: "inline json manifest and flags",
+			env: map[string]string{
+				"SECRETS": `[{"name":"db","arn":"arn:aws:secretsmanager:us-east-1:123456789012:secret:db-AbCdEf","output":"/tmp/db"}]`,
+			},
+			refs: []string{"api=arn:aws:secretsmanager:us-east-1:123456789012:secret:api-GhIjKl"},
+			expected: []secretSpec{
+				{Name: "db", ARN: "arn:aws:secretsmanager:us-east-1:123456789012:secret:db-AbCdEf", Backend: backendSecretsManager, VersionStage: defaultVersionStage, Output: "/tmp/db", Format: formatExport, Separator: defaultSeparator, Arrays: arraysError, File: "/tmp/db"},
+				{Name: "api", ARN: "arn:aws:secretsmanager:us-east-1:123456789012:secret:api-GhIjKl", Backend: backendSecretsManager, VersionStage: defaultVersionStage, Output: defaultOutput, Format: formatExport, Separator: defaultSeparator, Arrays: arraysError, File: "/tmp/api"},
+			},
+		},
+		{
+			name: "inline yaml manifest",
+			env: map[string]string{
+				"SECRETS": "- name: db\n  arn: arn:aws:secretsmanager:us-east-1:123456789012:secret:db-AbCdEf\n",
+			},
+			expected: []secretSpec{
+				{Name: "db", ARN: "arn:aws:secretsmanager:us-east-1:123456789012:secret:db-AbCdEf", Backend: backendSecretsManager, VersionStage: defaultVersionStage, Output: defaultOutput, Format: formatExport, Separator: defaultSeparator, Arrays: arraysError, File: "/tmp/db"},
+			},
+		},
+		{
+			name: "per secret format",
+			env: map[string]string{
+				"SECRETS": `[{"name":"tls/cert","arn":"arn:aws:secretsmanager:us-east-1:123456789012:secret:tls-AbCdEf","format":"raw"},{"name":"db","arn":"arn:aws:secretsmanager:us-east-1:123456789012:secret:db-AbCdEf"}]`,
+			},
+			format: formatDotenv,
+			expected: []secretSpec{
+				{Name: "tls/cert", ARN: "arn:aws:secretsmanager:us-east-1:123456789012:secret:tls-AbCdEf", Backend: backendSecretsManager, VersionStage: defaultVersionStage, Output: "/tmp/tls-cert", Format: formatRaw, Separator: defaultSeparator, Arrays: arraysError, File: "/tmp/tls-cert"},
+				{Name: "db", ARN: "arn:aws:secretsmanager:us-east-1:123456789012:secret:db-AbCdEf", Backend: backendSecretsManager, VersionStage: defaultVersionStage, Output: defaultOutput, Format: formatDotenv, Separator: defaultSeparator, Arrays: arraysError, File: "/tmp/db"},
+			},
+		},
+		{
+			name: "plain text file",
+			env: map[string]string{
+				"SECRET_ARN":  "arn:aws:secretsmanager:us-east-1:123456789012:secret:tls-AbCdEf",
+				"SECRET_FILE": "certs/tls.pem",
+			},
+			expected: []secretSpec{
+				{Name: "secret", ARN: "arn:aws:secretsmanager:us-east-1:123456789012:secret:tls-AbCdEf", Backend: backendSecretsManager, VersionStage: defaultVersionStage, Output: defaultOutput, Format: formatExport, Separator: defaultSeparator, Arrays: arraysError, File: "/tmp/certs/tls.pem"},
+			},
+		},
+		{
+			name: "file outside the output dir",
+			env: map[string]string{
+				"SECRET_ARN":  "arn:aws:secretsmanager:us-east-1:123456789012:secret:tls-AbCdEf",
+				"SECRET_FILE": "../etc/passwd",
+			},
+			err: true,
+		},
+		{
+			name: "version stage and id",
+			env: map[string]string{
+				"SECRETS": `[{"name":"pending","arn":"arn:aws:secretsmanager:us-east-1:123456789012:secret:db-AbCdEf","versionStage":"AWSPENDING"},{"name":"pinned","arn":"arn:aws:secretsmanager:us-east-1:123456789012:secret:db-AbCdEf","versionId":"EXAMPLE1-90ab-cdef-fedc-ba987EXAMPLE"}]`,
+			},
+			expected: []secretSpec{
+				{Name: "pending", ARN: "arn:aws:secretsmanager:us-east-1:123456789012:secret:db-AbCdEf", Backend: backendSecretsManager, VersionStage: "AWSPENDING", Output: defaultOutput, Format: formatExport, Separator: defaultSeparator, Arrays: arraysError, File: "/tmp/pending"},
+				{Name: "pinned", ARN: "arn:aws:secretsmanager:us-east-1:123456789012:secret:db-AbCdEf", Backend: backendSecretsManager, VersionID: "EXAMPLE1-90ab-cdef-fedc-ba987EXAMPLE", Output: defaultOutput, Format: formatExport, Separator: defaultSeparator, Arrays: arraysError, File: "/tmp/pinned"},
+			},
+		},
+		{
+			name: "assumed role",
+			env: map[string]string{
+				"SECRET_ARN":         "arn:aws:secretsmanager:us-east-1:210987654321:secret:db-AbCdEf",
+				"SECRET_ROLE_ARN":    "arn:aws:iam::210987654321:role/secrets-reader",
+				"SECRET_EXTERNAL_ID": "ext-123",
+			},
+			expected: []secretSpec{
+				{Name: "secret", ARN: "arn:aws:secretsmanager:us-east-1:210987654321:secret:db-AbCdEf", Backend: backendSecretsManager, RoleARN: "arn:aws:iam::210987654321:role/secrets-reader", ExternalID: "ext-123", SessionName: defaultSessionName, VersionStage: defaultVersionStage, Output: defaultOutput, Format: formatExport, Separator: defaultSeparator, Arrays: arraysError, File: "/tmp/secret"},
+			},
+		},
+		{
+			name: "parameters",
+			env: map[string]string{
+				"SECRET_ARNS": "ssm:/app/prod/*, db=ssm:/app/prod/db/password",
+				"SECRETS":     `[{"arn":"arn:aws:ssm:us-east-1:123456789012:parameter/app/prod/api-key","backend":"ssm","versionId":"3"}]`,
+			},
+			expected: []secretSpec{
+				{Name: "app/prod", ARN: "/app/prod/*", Backend: backendParameterStore, Output: defaultOutput, Format: formatExport, Separator: defaultSeparator, Arrays: arraysError, File: "/tmp/app-prod"},
+				{Name: "db", ARN: "/app/prod/db/password", Backend: backendParameterStore, Output: defaultOutput, Format: formatExport, Separator: defaultSeparator, Arrays: arraysError, File: "/tmp/db"},
+				{Name: "app/prod/api-key", ARN: "arn:aws:ssm:us-east-1:123456789012:parameter/app/prod/api-key", Backend: backendParameterStore, VersionID: "3", Output: defaultOutput, Format: formatExport, Separator: defaultSeparator, Arrays: arraysError, File: "/tmp/app-prod-api-key"},
+			},
+		},
+		{
+			name: "output dir and file",
+			env: map[string]string{
+				"SECRETS": `[{"name":"db","arn":"arn:aws:secretsmanager:us-east-1:123456789012:secret:db-AbCdEf"},{"name":"tls","arn":"arn:aws:secretsmanager:us-east-1:123456789012:secret:tls-AbCdEf","format":"raw","output":"certs/tls.pem"}]`,
+			},
+			output: &outputConfig{dir: "/var/run/secrets", file: "app.env", mode: 0600, uid: -1, gid: -1},
+			expected: []secretSpec{
+				{Name: "db", ARN: "arn:aws:secretsmanager:us-east-1:123456789012:secret:db-AbCdEf", Backend: backendSecretsManager, VersionStage: defaultVersionStage, Output: "/var/run/secrets/app.env", Format: formatExport, Separator: defaultSeparator, Arrays: arraysError, File: "/var/run/secrets/db"},
+				{Name: "tls", ARN: "arn:aws:secretsmanager:us-east-1:123456789012:secret:tls-AbCdEf", Backend: backendSecretsManager, VersionStage: defaultVersionStage, Output: "/var/run/secrets/certs/tls.pem", Format: formatRaw, Separator: defaultSeparator, Arrays: arraysError, File: "/var/run/secrets/tls"},
+			},
+		},
+		{
+			name: "selected keys",
+			env: map[string]string{
+				"SECRET_ARN": "arn:aws:secretsmanager:us-east-1:123456789012:secret:db-AbCdEf#password=DB_PASSWORD,username=DB_USER",
+				"SECRETS":    `[{"name":"api","arn":"api","keys":"token"}]`,
+			},
+			refs: []string{"cache#password=CACHE_PASSWORD"},
+			expected: []secretSpec{
+				{Name: "secret", ARN: "arn:aws:secretsmanager:us-east-1:123456789012:secret:db-AbCdEf", Backend: backendSecretsManager, VersionStage: defaultVersionStage, Output: defaultOutput, Format: formatExport, Separator: defaultSeparator, Arrays: arraysError, File: "/tmp/secret", Keys: "password=DB_PASSWORD,username=DB_USER"},
+				{Name: "api", ARN: "api", Backend: backendSecretsManager, VersionStage: defaultVersionStage, Output: defaultOutput, Format: formatExport, Separator: defaultSeparator, Arrays: arraysError, File: "/tmp/api", Keys: "token"},
+				{Name: "cache", ARN: "cache", Backend: backendSecretsManager, VersionStage: defaultVersionStage, Output: defaultOutput, Format: formatExport, Separator: defaultSeparator, Arrays: arraysError, File: "/tmp/cache", Keys: "password=CACHE_PASSWORD"},
+			},
+		},
+		{
+			name: "keys in the arn and on their own",
+			env: map[string]string{
+				"SECRETS": `[{"arn":"db#password","keys":"username"}]`,
+			},
+			err: true,
+		},
+		{
+			name: "keys in a list",
+			env: map[string]string{
+				"SECRET_ARNS": "db=arn:aws:secretsmanager:us-east-1:123456789012:secret:db-AbCdEf#password=DB_PASSWORD,arn:aws:secretsmanager:us-east-1:123456789012:secret:api-AbCdEf,ssm:/app/url#url",
+			},
+			expected: []secretSpec{
+				{Name: "db", ARN: "arn:aws:secretsmanager:us-east-1:123456789012:secret:db-AbCdEf", Backend: backendSecretsManager, VersionStage: defaultVersionStage, Output: defaultOutput, Format: formatExport, Separator: defaultSeparator, Arrays: arraysError, File: "/tmp/db", Keys: "password=DB_PASSWORD"},
+				{Name: "api-AbCdEf", ARN: "arn:aws:secretsmanager:us-east-1:123456789012:secret:api-AbCdEf", Backend: backendSecretsManager, VersionStage: defaultVersionStage, Output: defaultOutput, Format: formatExport, Separator: defaultSeparator, Arrays: arraysError, File: "/tmp/api-AbCdEf"},
+				{Name: "app/url", ARN: "/app/url", Backend: backendParameterStore, Output: defaultOutput, Format: formatExport, Separator: defaultSeparator, Arrays: arraysError, File: "/tmp/app-url", Keys: "url"},
+			},
+		},
+		{
+			name: "ARN with a =",
+			env: map[string]string{
+				"SECRET_ARNS": "arn:aws:secretsmanager:us-east-1:123456789012:secret:team=a-AbCdEf, api=arn:aws:secretsmanager:us-east-1:123456789012:secret:team=b-GhIjKl#token",
+			},
+			expected: []secretSpec{
+				{Name: "team=a-AbCdEf", ARN: "arn:aws:secretsmanager:us-east-1:123456789012:secret:team=a-AbCdEf", Backend: backendSecretsManager, VersionStage: defaultVersionStage, Output: defaultOutput, Format: formatExport, Separator: defaultSeparator, Arrays: arraysError, File: "/tmp/team=a-AbCdEf"},
+				{Name: "api", ARN: "arn:aws:secretsmanager:us-east-1:123456789012:secret:team=b-GhIjKl", Backend: backendSecretsManager, VersionStage: defaultVersionStage, Output: defaultOutput, Format: formatExport, Separator: defaultSeparator, Arrays: arraysError, File: "/tmp/api", Keys: "token"},
+			},
+		},
+		{
+			name: "several keys in a list",
+			env: map[string]string{
+				"SECRET_ARNS": "db=arn:aws:secretsmanager:us-east-1:123456789012:secret:db-AbCdEf#password=DB_PASSWORD,username=DB_USER",
+			},
+			err: true,
+		},
+		{
+			name: "invalid keys",
+			refs: []string{"db#password=,username"},
+			err:  true,
+		},
+		{
+			name: "output outside the output dir",
+			env: map[string]string{
+				"SECRETS": `[{"arn":"arn:aws:secretsmanager:us-east-1:123456789012:secret:db-AbCdEf","output":"../etc/passwd"}]`,
+			},
+			err: true,
+		},
+		{
+			name: "unknown backend",
+			env: map[string]string{
+				"SECRET_ARN":     "arn:aws:secretsmanager:us-east-1:123456789012:secret:db-AbCdEf",
+				"SECRET_BACKEND": "vault",
+			},
+			err: true,
+		},
+		{
+			name: "invalid role arn",
+			env: map[string]string{
+				"SECRET_ARN":      "arn:aws:secretsmanager:us-east-1:210987654321:secret:db-AbCdEf",
+				"SECRET_ROLE_ARN": "arn:aws:iam::210987654321:user/bob",
+			},
+			err: true,
+		},
+		{
+			name: "external id without a role",
+			env: map[string]string{
+				"SECRET_ARN":         "arn:aws:secretsmanager:us-east-1:210987654321:secret:db-AbCdEf",
+				"SECRET_EXTERNAL_ID": "ext-123",
+			},
+			err: true,
+		},
+		{
+			name: "unknown format",
+			env: map[string]string{
+				"SECRET_ARN":    "arn:aws:secretsmanager:us-east-1:123456789012:secret:db-AbCdEf",
+				"SECRET_FORMAT": "toml",
+			},
+			err: true,
+		},
+		{
+			name: "nothing specified",
+			err:  true,
+		},
+		{
+			name: "manifest entry without arn",
+			env:  map[string]string{"SECRETS": `[{"name":"db"}]`},
+			err:  true,
+		},
+	}
+	for _, testcase := range testCases {
+		getenv := func(key string) string { return testcase.env[key] }
+		out := testOutput
+		if testcase.output != nil {
+			out = *testcase.output
+		}
+		specs, err := collectSpecs(getenv, "", testcase.format, testcase.refs, out)
+		if testcase.err {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %#v", testcase.name, specs)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", testcase.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(specs, testcase.expected) {
+			t.Errorf("%s:\nexpected %#v\n, got %#v", testcase.name, testcase.expected, specs)
+		}
+	}
+}
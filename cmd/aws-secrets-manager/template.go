@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"gopkg.in/yaml.v2"
+)
+
+// secretTemplate renders the secrets into a file of its own with
+// text/template, for apps which want their secrets embedded in a config
+// file, like a JDBC URL or a .pgpass line.
+type secretTemplate struct {
+	// Name of the template, used in logs. Defaults to the output.
+	Name string `json:"name,omitempty" yaml:"name,omitempty"`
+
+	// Template is the text/template source. See templateData for what
+	// it is executed with and templateFuncs for the functions it has.
+	Template string `json:"template" yaml:"template"`
+
+	// Output is the file the template renders to. Relative paths are
+	// taken from the output dir.
+	Output string `json:"output" yaml:"output"`
+
+	tmpl *template.Template
+}
+
+// functions templates can use on top of the text/template builtins
+var templateFuncs = template.FuncMap{
+	// b64enc base64 encodes a value
+	"b64enc": func(value interface{}) string {
+		return base64.StdEncoding.EncodeToString([]byte(fmt.Sprint(value)))
+	},
+	// b64dec decodes a base64 encoded value
+	"b64dec": func(value interface{}) (string, error) {
+		data, err := base64.StdEncoding.DecodeString(fmt.Sprint(value))
+		if err != nil {
+			return "", fmt.Errorf("b64dec: %v", err)
+		}
+		return string(data), nil
+	},
+	// jsonPath extracts a value from a JSON object, see jsonPath
+	"jsonPath": jsonPath,
+	// default returns the value, or the default when the value is
+	// missing or empty. Missing keys are best looked up with index,
+	// as .secret.key fails on them.
+	"default": func(def, value interface{}) interface{} {
+		if value == nil || fmt.Sprint(value) == "" {
+			return def
+		}
+		return value
+	},
+	// toJSON encodes a value as JSON
+	"toJSON": func(value interface{}) (string, error) {
+		data, err := json.Marshal(value)
+		return string(data), err
+	},
+}
+
+// jsonPathSegment matches one step of a JSON path: .key, [index] or
+// ["key"] for keys with dots or brackets.
+var jsonPathSegment = regexp.MustCompile(`^(?:\.([^.\[\]]+)|\[(\d+)\]|\["([^"]*)"\])`)
+
+// jsonPath returns the value at the path in a JSON object, either already
+// decoded or as a JSON string. Paths look like $.db.hosts[0] or
+// ["key.with.dots"], the leading $ being optional. A path leading nowhere
+// is an error, so typos don't render as empty values.
+func jsonPath(path string, value interface{}) (interface{}, error) {
+	if s, ok := value.(string); ok {
+		if err := decodeJSON([]byte(s), &value); err != nil {
+			return nil, fmt.Errorf("jsonPath %s: value is not JSON", path)
+		}
+	}
+	rest := strings.TrimPrefix(path, "$")
+	if rest != "" && rest[0] != '.' && rest[0] != '[' {
+		rest = "." + rest
+	}
+	for rest != "" {
+		m := jsonPathSegment.FindStringSubmatch(rest)
+		if m == nil {
+			return nil, fmt.Errorf("jsonPath %s: invalid path at %q", path, rest)
+		}
+		rest = rest[len(m[0]):]
+
+		if m[2] != "" {
+			array, ok := value.([]interface{})
+			i, _ := strconv.Atoi(m[2])
+			if !ok || i >= len(array) {
+				return nil, fmt.Errorf("jsonPath %s: no element %s", path, m[0])
+			}
+			value = array[i]
+			continue
+		}
+		key := m[1] + m[3]
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("jsonPath %s: no key %q", path, key)
+		}
+		if value, ok = object[key]; !ok {
+			return nil, fmt.Errorf("jsonPath %s: no key %q", path, key)
+		}
+	}
+	return value, nil
+}
+
+// decodeJSON decodes JSON keeping numbers as they were written, so large
+// integers don't turn into floats when rendered. Anything after the value
+// is an error, as it is for json.Unmarshal.
+func decodeJSON(data []byte, value *interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(value); err != nil {
+		return err
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return fmt.Errorf("invalid character after top-level value")
+	}
+	return nil
+}
+
+// templateData is what the templates are executed with: the secrets by
+// name, JSON secrets decoded and the others as strings, so
+// {{ .db.password }} is the password key of the db secret.
+func templateData(results []fetchResult) (map[string]interface{}, error) {
+	data := map[string]interface{}{}
+	for _, result := range results {
+		if _, ok := data[result.spec.Name]; ok {
+			return nil, fmt.Errorf("more than one secret is named %s", result.spec.Name)
+		}
+		var value interface{}
+		if result.value.binary || decodeJSON(result.value.data, &value) != nil {
+			value = string(result.value.data)
+		}
+		data[result.spec.Name] = value
+	}
+	return data, nil
+}
+
+// parseTemplates parses a JSON or YAML list of templates
+func parseTemplates(data []byte) ([]secretTemplate, error) {
+	var templates []secretTemplate
+	if err := yaml.Unmarshal(data, &templates); err != nil {
+		return nil, fmt.Errorf("unable to parse templates: %v", err)
+	}
+	return templates, nil
+}
+
+// loadTemplateDir reads every file of the directory as a template
+// rendering to a file of the same name, as mounted from a ConfigMap.
+// Hidden files, like the ..data link of ConfigMap volumes, are skipped.
+func loadTemplateDir(dir string) ([]secretTemplate, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read templates: %v", err)
+	}
+	var templates []secretTemplate
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+		// ConfigMap keys are links to the files, so the links are
+		// followed
+		if info, err := os.Stat(path); err != nil || !info.Mode().IsRegular() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		text, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read template: %v", err)
+		}
+		templates = append(templates, secretTemplate{Template: string(text), Output: entry.Name()})
+	}
+	return templates, nil
+}
+
+// collectTemplates gathers the templates from, in order, the inline list
+// in the SECRETS_TEMPLATES env var, the files of the template dir and
+// repeated --template flags of the form output=file. The templates are
+// parsed and their outputs placed as the output config says.
+func collectTemplates(getenv func(string) string, dir string, refs []string, out outputConfig) ([]secretTemplate, error) {
+	var templates []secretTemplate
+
+	if inline := getenv("SECRETS_TEMPLATES"); inline != "" {
+		list, err := parseTemplates([]byte(inline))
+		if err != nil {
+			return nil, err
+		}
+		templates = append(templates, list...)
+	}
+
+	if dir != "" {
+		list, err := loadTemplateDir(dir)
+		if err != nil {
+			return nil, err
+		}
+		templates = append(templates, list...)
+	}
+
+	for _, ref := range refs {
+		i := strings.Index(ref, "=")
+		if i <= 0 || i == len(ref)-1 {
+			return nil, fmt.Errorf("invalid template %q, expected output=file", ref)
+		}
+		text, err := ioutil.ReadFile(ref[i+1:])
+		if err != nil {
+			return nil, fmt.Errorf("unable to read template: %v", err)
+		}
+		templates = append(templates, secretTemplate{Template: string(text), Output: ref[:i]})
+	}
+
+	for i := range templates {
+		if templates[i].Output == "" {
+			return nil, fmt.Errorf("template %d has no output", i)
+		}
+		if templates[i].Name == "" {
+			templates[i].Name = templates[i].Output
+		}
+		var err error
+		templates[i].tmpl, err = template.New(templates[i].Name).Funcs(templateFuncs).Option("missingkey=error").Parse(templates[i].Template)
+		if err != nil {
+			return nil, fmt.Errorf("template %s is invalid: %v", templates[i].Name, err)
+		}
+		if templates[i].Output, err = outputPath(templates[i].Output, out); err != nil {
+			return nil, fmt.Errorf("template %s has an output %v", templates[i].Name, err)
+		}
+	}
+	return templates, nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestJSONPath(t *testing.T) {
+	secret := `{"db":{"hosts":["a.internal","b.internal"],"port":5432},"key.with.dots":"x"}`
+	testCases := []struct {
+		path     string
+		expected string
+		err      bool
+	}{
+		{path: "$.db.hosts[1]", expected: "b.internal"},
+		{path: "db.port", expected: "5432"},
+		{path: `$["key.with.dots"]`, expected: "x"},
+		{path: "$.db.user", err: true},
+		{path: "$.db.hosts[2]", err: true},
+		{path: "$.db.port.value", err: true},
+		{path: "$.db..port", err: true},
+	}
+	for _, testcase := range testCases {
+		value, err := jsonPath(testcase.path, secret)
+		if testcase.err {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %v", testcase.path, value)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", testcase.path, err)
+			continue
+		}
+		if fmt.Sprint(value) != testcase.expected {
+			t.Errorf("%s: expected %v, got %v", testcase.path, testcase.expected, value)
+		}
+	}
+}
+
+func TestRenderTemplates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "secrets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	out := outputConfig{dir: dir, file: "secret", mode: 0600, uid: -1, gid: -1}
+
+	// one template from each source
+	templateDir := filepath.Join(dir, "templates")
+	os.Mkdir(templateDir, 0755)
+	ioutil.WriteFile(filepath.Join(templateDir, "jdbc.properties"),
+		[]byte(`url=jdbc:postgresql://{{ .db.host }}:{{ index .db "port" | default 5432 }}/app`+"\n"), 0644)
+	ioutil.WriteFile(filepath.Join(templateDir, "..data"), []byte("ignored"), 0644)
+	templateFile := filepath.Join(dir, "auth.tmpl")
+	ioutil.WriteFile(templateFile, []byte(`{{ printf "%s:%s" (jsonPath "$.username" .db) .api | b64enc }}`), 0644)
+	env := map[string]string{
+		"SECRETS_TEMPLATES": `[{"output": "pgpass", "template": "{{ .db.host }}:*:*:{{ .db.username }}:{{ .db.password }}\n"}]`,
+	}
+
+	templates, err := collectTemplates(func(name string) string { return env[name] }, templateDir, []string{"auth=" + templateFile}, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var outputs []string
+	for _, tmpl := range templates {
+		outputs = append(outputs, tmpl.Output)
+	}
+	expectedOutputs := []string{filepath.Join(dir, "pgpass"), filepath.Join(dir, "jdbc.properties"), filepath.Join(dir, "auth")}
+	if !reflect.DeepEqual(outputs, expectedOutputs) {
+		t.Fatalf("expected templates %v, got %v", expectedOutputs, outputs)
+	}
+
+	results := []fetchResult{
+		{spec: secretSpec{Name: "db", Format: formatNone}, value: secretValue{data: []byte(`{"host":"db.internal","username":"app","password":"hunter2"}`)}},
+		{spec: secretSpec{Name: "api", Format: formatNone}, value: secretValue{data: []byte("s3cr3t")}},
+	}
+	data, err := templateData(results)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := newSecretWriter(out)
+	for _, result := range results {
+		if err := w.add(result.spec, result.value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, tmpl := range templates {
+		if err := w.addTemplate(tmpl, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := w.flush(); err != nil {
+		t.Fatal(err)
+	}
+	for file, expected := range map[string]string{
+		"pgpass":          "db.internal:*:*:app:hunter2\n",
+		"jdbc.properties": "url=jdbc:postgresql://db.internal:5432/app\n",
+		"auth":            "YXBwOnMzY3IzdA==",
+	} {
+		got, err := ioutil.ReadFile(filepath.Join(dir, file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != expected {
+			t.Errorf("%s: expected %q, got %q", file, expected, got)
+		}
+	}
+
+	// missing keys and secrets fail rather than render empty
+	for _, text := range []string{"{{ .db.port }}", "{{ .cache.host }}", `{{ jsonPath "$.port" .db }}`} {
+		list, err := json.Marshal([]secretTemplate{{Output: "broken", Template: text}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		templates, err := collectTemplates(func(string) string { return string(list) }, "", nil, out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := newSecretWriter(out).addTemplate(templates[0], data); writeErrorCode(err) != exitMalformed {
+			t.Errorf("%s: expected a malformed error, got %v", text, err)
+		}
+	}
+}
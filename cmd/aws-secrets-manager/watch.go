@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// result of fetching a single secret
+type fetchResult struct {
+	spec  secretSpec
+	value secretValue
+	err   error
+}
+
+// syncer fetches the secrets and writes them out. It remembers what it
+// fetched last so later refreshes can skip secrets which didn't change.
+type syncer struct {
+	specs     []secretSpec
+	templates []secretTemplate
+	clients   *clientCache
+	policy    retryPolicy
+	out       outputConfig
+	log       *logger
+	// ask backends which can tell for the version of a secret before
+	// fetching its value again
+	checkVersion bool
+	// results of the last successful refresh, in the order of the specs
+	results []fetchResult
+}
+
+// refresh fetches all the secrets at once and writes them, returning
+// whether any file changed. Nothing is written unless every secret could
+// be fetched; all the failures are logged and the first one is returned.
+func (s *syncer) refresh(ctx context.Context) (bool, *fetchError) {
+	// the results keep the order of the specs so conflicts between
+	// secrets are reported in a predictable order.
+	results := make([]fetchResult, len(s.specs))
+	var wg sync.WaitGroup
+	for i, spec := range s.specs {
+		wg.Add(1)
+		go func(i int, spec secretSpec) {
+			defer wg.Done()
+			results[i] = s.fetch(ctx, i, spec)
+		}(i, spec)
+	}
+	wg.Wait()
+
+	var first *fetchError
+	for _, result := range results {
+		if result.err == nil {
+			continue
+		}
+		ferr := newError(awsErrorCode(result.err), result.spec.Name, result.err)
+		s.log.failure(result.spec, ferr)
+		if first == nil {
+			first = ferr
+		}
+	}
+	if first != nil {
+		return false, first
+	}
+
+	w := newSecretWriter(s.out)
+	for _, result := range results {
+		if err := w.add(result.spec, result.value); err != nil {
+			ferr := newError(writeErrorCode(err), result.spec.Name, err)
+			s.log.failure(result.spec, ferr)
+			return false, ferr
+		}
+	}
+	if len(s.templates) > 0 {
+		data, err := templateData(results)
+		if err != nil {
+			ferr := newError(exitInvalidConfig, "", err)
+			s.log.failure(secretSpec{}, ferr)
+			return false, ferr
+		}
+		for _, t := range s.templates {
+			if err := w.addTemplate(t, data); err != nil {
+				ferr := newError(writeErrorCode(err), t.Name, err)
+				s.log.failure(secretSpec{Name: t.Name}, ferr)
+				return false, ferr
+			}
+		}
+	}
+	changed, err := w.flush()
+	if err != nil {
+		ferr := newError(writeErrorCode(err), "", err)
+		s.log.failure(secretSpec{}, ferr)
+		return false, ferr
+	}
+	for i, result := range results {
+		if s.results == nil || !result.value.equal(s.results[i].value) {
+			s.log.info(result.spec, "secret written")
+		}
+	}
+	s.results = results
+	return changed, nil
+}
+
+// fetch fetches the secret of the spec at index i, or reuses the value
+// fetched last time when its backend tells the version hasn't changed.
+func (s *syncer) fetch(ctx context.Context, i int, spec secretSpec) fetchResult {
+	if s.checkVersion && s.results != nil && s.results[i].value.version != "" {
+		if v, ok := backendFor(spec).(versioner); ok {
+			version, err := v.version(ctx, s.clients, s.policy, spec)
+			if err != nil {
+				return fetchResult{spec: spec, err: err}
+			}
+			if version == s.results[i].value.version {
+				return s.results[i]
+			}
+		}
+	}
+	value, err := fetchSecret(ctx, s.clients, s.policy, spec)
+	if err == nil {
+		value, err = selectKeys(spec, value)
+	}
+	return fetchResult{spec: spec, value: value, err: err}
+}
+
+// watch refreshes the secrets every interval until the context is done,
+// each refresh getting the timeout to finish. A failed refresh leaves the
+// files as they were until a later one succeeds. The app is told to
+// reload whenever a file changed.
+func (s *syncer) watch(ctx context.Context, interval, timeout time.Duration, reload *reloader) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		refreshCtx, cancel := context.WithTimeout(ctx, timeout)
+		changed, ferr := s.refresh(refreshCtx)
+		if ferr == nil && changed {
+			if err := reload.reload(refreshCtx); err != nil {
+				s.log.failure(secretSpec{}, newError(exitUnknown, "", err))
+			}
+		}
+		cancel()
+	}
+}
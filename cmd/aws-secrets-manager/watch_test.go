@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws-samples/aws-secret-sidecar-injector/fakeaws"
+)
+
+func TestRefresh(t *testing.T) {
+	server := fakeaws.NewServer()
+	defer server.Close()
+	arn, _ := server.PutSecretString("db", `{"password":"hunter1"}`)
+	server.PutParameter("/app/host", fakeaws.TypeString, "db.internal")
+
+	dir, err := ioutil.TempDir("", "secrets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "secret")
+
+	s := &syncer{
+		specs: []secretSpec{
+			{Name: "db", ARN: arn, Backend: backendSecretsManager, Region: "us-east-1", VersionStage: defaultVersionStage, Format: formatExport, Output: path},
+			{Name: "host", ARN: "/app/host", Backend: backendParameterStore, Region: "us-east-1", Format: formatRaw, Output: filepath.Join(dir, "host")},
+		},
+		clients:      testClients(t, server.URL),
+		policy:       retryPolicy{maxAttempts: 1},
+		out:          outputConfig{dir: dir, file: "secret", mode: 0644, uid: -1, gid: -1},
+		log:          &logger{out: ioutil.Discard},
+		checkVersion: true,
+	}
+
+	testCases := []struct {
+		name    string
+		update  func()
+		changed bool
+		content string
+	}{
+		{name: "first", changed: true, content: "export password='hunter1';\n"},
+		{name: "unchanged", changed: false, content: "export password='hunter1';\n"},
+		{name: "rotated", update: func() { server.PutSecretString("db", `{"password":"hunter2"}`) }, changed: true, content: "export password='hunter2';\n"},
+		{name: "failing", update: func() { server.FailNext("DescribeSecret", fakeaws.ErrCodeAccessDenied, 1) }, changed: false, content: "export password='hunter2';\n"},
+	}
+	for _, testcase := range testCases {
+		if testcase.update != nil {
+			testcase.update()
+		}
+		changed, ferr := s.refresh(context.Background())
+		if testcase.name == "failing" {
+			if ferr == nil || ferr.code != exitAccessDenied {
+				t.Errorf("%s: expected access denied, got %v", testcase.name, ferr)
+			}
+		} else if ferr != nil {
+			t.Fatalf("%s: %v", testcase.name, ferr)
+		}
+		if changed != testcase.changed {
+			t.Errorf("%s: expected changed to be %v", testcase.name, testcase.changed)
+		}
+		got, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != testcase.content {
+			t.Errorf("%s: expected %q, got %q", testcase.name, testcase.content, got)
+		}
+	}
+
+	// the secret is only fetched again once its version changed, the
+	// parameter on every refresh
+	if calls := server.Calls("GetSecretValue"); calls != 2 {
+		t.Errorf("expected 2 calls to GetSecretValue, got %d", calls)
+	}
+	if calls := server.Calls("DescribeSecret"); calls != 3 {
+		t.Errorf("expected 3 calls to DescribeSecret, got %d", calls)
+	}
+	if calls := server.Calls("GetParameter"); calls != 4 {
+		t.Errorf("expected 4 calls to GetParameter, got %d", calls)
+	}
+}
+
+func TestWatchReloads(t *testing.T) {
+	server := fakeaws.NewServer()
+	defer server.Close()
+	arn, _ := server.PutSecretString("db", `{"password":"hunter1"}`)
+
+	var reloads int32
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			atomic.AddInt32(&reloads, 1)
+		}
+	}))
+	defer hook.Close()
+	reload, err := newReloader("", "", hook.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "secrets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s := &syncer{
+		specs:   []secretSpec{{Name: "db", ARN: arn, Backend: backendSecretsManager, Region: "us-east-1", VersionStage: defaultVersionStage, Format: formatJSON, Output: filepath.Join(dir, "db.json")}},
+		clients: testClients(t, server.URL),
+		policy:  retryPolicy{maxAttempts: 1},
+		out:     outputConfig{dir: dir, file: "secret", mode: 0644, uid: -1, gid: -1},
+		log:     &logger{out: ioutil.Discard},
+	}
+	if _, ferr := s.refresh(context.Background()); ferr != nil {
+		t.Fatal(ferr)
+	}
+	server.PutSecretString("db", `{"password":"hunter2"}`)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	s.watch(ctx, 10*time.Millisecond, time.Second, reload)
+
+	// only the refresh after the rotation changed the file
+	if n := atomic.LoadInt32(&reloads); n != 1 {
+		t.Errorf("expected the app to be reloaded once, got %d", n)
+	}
+}
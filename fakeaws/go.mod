@@ -0,0 +1,3 @@
+module github.com/aws-samples/aws-secret-sidecar-injector/fakeaws
+
+go 1.13
@@ -0,0 +1,171 @@
+package fakeaws
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+const (
+	stageCurrent  = "AWSCURRENT"
+	stagePrevious = "AWSPREVIOUS"
+)
+
+type secret struct {
+	arn      string
+	name     string
+	versions map[string]*version
+	// order versions were added in
+	order []string
+}
+
+type version struct {
+	id     string
+	str    *string
+	binary []byte
+	stages map[string]bool
+}
+
+// PutSecretString adds a version of the named secret holding a string and
+// returns the secret's ARN and the new version's id. The secret is created
+// if needed. With no stages the version becomes AWSCURRENT, and the version
+// it replaces AWSPREVIOUS, as when a secret is updated in AWS.
+func (s *Server) PutSecretString(name, value string, stages ...string) (string, string) {
+	return s.put(name, &version{str: &value}, stages)
+}
+
+// PutSecretBinary is PutSecretString for binary secrets
+func (s *Server) PutSecretBinary(name string, value []byte, stages ...string) (string, string) {
+	return s.put(name, &version{binary: value}, stages)
+}
+
+// DeleteSecret removes the named secret and all its versions
+func (s *Server) DeleteSecret(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.secrets, name)
+}
+
+func (s *Server) put(name string, v *version, stages []string) (string, string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sec, ok := s.secrets[name]
+	if !ok {
+		sec = &secret{
+			// AWS adds 6 random characters to the name in the ARN
+			arn:      fmt.Sprintf("arn:aws:secretsmanager:%s:%s:secret:%s-%06d", s.Region, s.Account, name, s.nextID()),
+			name:     name,
+			versions: map[string]*version{},
+		}
+		s.secrets[name] = sec
+	}
+
+	v.id = fmt.Sprintf("00000000-0000-0000-0000-%012d", s.nextID())
+	v.stages = map[string]bool{}
+	if len(stages) == 0 {
+		stages = []string{stageCurrent}
+	}
+	for _, stage := range stages {
+		for _, other := range sec.versions {
+			if !other.stages[stage] {
+				continue
+			}
+			delete(other.stages, stage)
+			if stage == stageCurrent {
+				for _, previous := range sec.versions {
+					delete(previous.stages, stagePrevious)
+				}
+				other.stages[stagePrevious] = true
+			}
+		}
+		v.stages[stage] = true
+	}
+	sec.versions[v.id] = v
+	sec.order = append(sec.order, v.id)
+	return sec.arn, v.id
+}
+
+// lookup finds a secret by ARN, partial ARN or name
+func (s *Server) lookup(id string) *secret {
+	for _, sec := range s.secrets {
+		if id == sec.arn || id == sec.name || id == sec.arn[:strings.LastIndex(sec.arn, "-")] {
+			return sec
+		}
+	}
+	return nil
+}
+
+func (s *Server) getSecretValue(w http.ResponseWriter, req Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sec := s.lookup(stringParam(req, "SecretId"))
+	if sec == nil {
+		writeJSONError(w, ErrCodeResourceNotFound, "Secrets Manager can't find the specified secret.")
+		return
+	}
+
+	versionID := stringParam(req, "VersionId")
+	stage := stringParam(req, "VersionStage")
+	if versionID == "" && stage == "" {
+		stage = stageCurrent
+	}
+
+	var found *version
+	for _, v := range sec.versions {
+		if (versionID == "" || v.id == versionID) && (stage == "" || v.stages[stage]) {
+			found = v
+		}
+	}
+	if found == nil {
+		writeJSONError(w, ErrCodeResourceNotFound, "Secrets Manager can't find the specified secret value for staging label: "+stage)
+		return
+	}
+
+	response := map[string]interface{}{
+		"ARN":           sec.arn,
+		"Name":          sec.name,
+		"VersionId":     found.id,
+		"VersionStages": sortedStages(found.stages),
+	}
+	if found.str != nil {
+		response["SecretString"] = *found.str
+	} else {
+		// encoding/json base64 encodes []byte as AWS does
+		response["SecretBinary"] = found.binary
+	}
+	writeJSON(w, response)
+}
+
+func (s *Server) describeSecret(w http.ResponseWriter, req Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sec := s.lookup(stringParam(req, "SecretId"))
+	if sec == nil {
+		writeJSONError(w, ErrCodeResourceNotFound, "Secrets Manager can't find the specified secret.")
+		return
+	}
+	stages := map[string][]string{}
+	for _, id := range sec.order {
+		if v := sec.versions[id]; len(v.stages) > 0 {
+			stages[id] = sortedStages(v.stages)
+		}
+	}
+	writeJSON(w, map[string]interface{}{
+		"ARN":                sec.arn,
+		"Name":               sec.name,
+		"VersionIdsToStages": stages,
+	})
+}
+
+func sortedStages(stages map[string]bool) []string {
+	sorted := make([]string, 0, len(stages))
+	for stage := range stages {
+		sorted = append(sorted, stage)
+	}
+	sort.Strings(sorted)
+	return sorted
+}
@@ -0,0 +1,230 @@
+// Package fakeaws is an in-process stand-in for the parts of AWS Secrets
+// Manager, Systems Manager Parameter Store and STS the injector uses, for
+// running tests end to end without AWS. Point the SDK at Server.URL as the
+// endpoint of all the services.
+package fakeaws
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// error codes returned by the fake, as returned by AWS
+const (
+	ErrCodeResourceNotFound = "ResourceNotFoundException"
+	ErrCodeInvalidParameter = "InvalidParameterException"
+	ErrCodeInvalidRequest   = "InvalidRequestException"
+	ErrCodeThrottling       = "ThrottlingException"
+	ErrCodeInternal         = "InternalServiceError"
+	ErrCodeAccessDenied     = "AccessDeniedException"
+)
+
+// Server is a fake Secrets Manager, Parameter Store and STS listening on a
+// local port
+type Server struct {
+	// URL of the server, to use as the SDK endpoint
+	URL string
+
+	// Region and Account used to build the ARNs of secrets and parameters
+	Region  string
+	Account string
+
+	server *httptest.Server
+
+	mu         sync.Mutex
+	secrets    map[string]*secret
+	parameters map[string]*parameter
+	failures   map[string][]string
+	calls      map[string]int
+	requests   []Request
+	ids        int
+}
+
+// Request is a call the server received
+type Request struct {
+	// Action called, like GetSecretValue or AssumeRole
+	Action string
+	// AccessKeyID the request was signed with
+	AccessKeyID string
+	// Params holds the JSON body of secrets manager and parameter store
+	// calls and the form values of STS calls.
+	Params map[string]interface{}
+}
+
+// NewServer starts a fake in us-east-1 of account 123456789012
+func NewServer() *Server {
+	s := &Server{
+		Region:     "us-east-1",
+		Account:    "123456789012",
+		secrets:    map[string]*secret{},
+		parameters: map[string]*parameter{},
+		failures:   map[string][]string{},
+		calls:      map[string]int{},
+	}
+	s.server = httptest.NewServer(http.HandlerFunc(s.handle))
+	s.URL = s.server.URL
+	return s
+}
+
+// Close shuts the server down
+func (s *Server) Close() {
+	s.server.Close()
+}
+
+// FailNext makes the next n calls to action fail with the error code,
+// after any failures already queued.
+func (s *Server) FailNext(action, code string, n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := 0; i < n; i++ {
+		s.failures[action] = append(s.failures[action], code)
+	}
+}
+
+// Calls returns how many times action was called, failures included
+func (s *Server) Calls(action string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.calls[action]
+}
+
+// Requests returns every request received so far, in order
+func (s *Server) Requests() []Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Request(nil), s.requests...)
+}
+
+func (s *Server) nextID() int {
+	s.ids++
+	return s.ids
+}
+
+// errorStatus is the HTTP status AWS answers an error code with
+func errorStatus(code string) int {
+	switch code {
+	case ErrCodeInternal:
+		return http.StatusInternalServerError
+	case ErrCodeAccessDenied:
+		return http.StatusForbidden
+	}
+	return http.StatusBadRequest
+}
+
+func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	req := Request{AccessKeyID: accessKeyID(r.Header.Get("Authorization")), Params: map[string]interface{}{}}
+	target := r.Header.Get("X-Amz-Target")
+	var query url.Values
+	if target != "" {
+		// json protocol, the action is in the target header
+		req.Action = target[strings.LastIndex(target, ".")+1:]
+		if len(body) > 0 {
+			if err := json.Unmarshal(body, &req.Params); err != nil {
+				writeJSONError(w, "SerializationException", err.Error())
+				return
+			}
+		}
+	} else {
+		// query protocol, the action is a form value
+		query, err = url.ParseQuery(string(body))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		req.Action = query.Get("Action")
+		for k := range query {
+			req.Params[k] = query.Get(k)
+		}
+	}
+
+	s.mu.Lock()
+	s.calls[req.Action]++
+	s.requests = append(s.requests, req)
+	var failure string
+	if queued := s.failures[req.Action]; len(queued) > 0 {
+		failure, s.failures[req.Action] = queued[0], queued[1:]
+	}
+	s.mu.Unlock()
+
+	if target != "" {
+		if failure != "" {
+			writeJSONError(w, failure, "injected failure")
+			return
+		}
+		s.handleJSON(w, req)
+		return
+	}
+	if failure != "" {
+		writeQueryError(w, failure, "injected failure")
+		return
+	}
+	s.handleQuery(w, req.Action, query)
+}
+
+// handleJSON answers the JSON protocol calls of secrets manager and
+// parameter store, their action names don't overlap.
+func (s *Server) handleJSON(w http.ResponseWriter, req Request) {
+	switch req.Action {
+	case "GetSecretValue":
+		s.getSecretValue(w, req)
+	case "DescribeSecret":
+		s.describeSecret(w, req)
+	case "GetParameter":
+		s.getParameter(w, req)
+	case "GetParametersByPath":
+		s.getParametersByPath(w, req)
+	default:
+		writeJSONError(w, "UnknownOperationException", req.Action)
+	}
+}
+
+func stringParam(req Request, name string) string {
+	value, _ := req.Params[name].(string)
+	return value
+}
+
+// accessKeyID pulls the access key out of a SigV4 authorization header
+func accessKeyID(authorization string) string {
+	i := strings.Index(authorization, "Credential=")
+	if i < 0 {
+		return ""
+	}
+	credential := authorization[i+len("Credential="):]
+	if j := strings.Index(credential, "/"); j >= 0 {
+		return credential[:j]
+	}
+	return ""
+}
+
+func writeJSON(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+	json.NewEncoder(w).Encode(value)
+}
+
+func writeJSONError(w http.ResponseWriter, code, message string) {
+	w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+	w.WriteHeader(errorStatus(code))
+	json.NewEncoder(w).Encode(map[string]string{"__type": code, "message": message})
+}
+
+func writeQueryError(w http.ResponseWriter, code, message string) {
+	w.Header().Set("Content-Type", "text/xml")
+	w.WriteHeader(errorStatus(code))
+	var escaped bytes.Buffer
+	xml.EscapeText(&escaped, []byte(message))
+	fmt.Fprintf(w, `<ErrorResponse><Error><Type>Sender</Type><Code>%s</Code><Message>%s</Message></Error><RequestId>fake</RequestId></ErrorResponse>`, code, escaped.String())
+}
@@ -0,0 +1,277 @@
+package fakeaws
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// callJSON makes a JSON protocol call, as secrets manager and parameter
+// store clients do, returning the status and decoded body.
+func callJSON(t *testing.T, s *Server, target string, params map[string]interface{}) (int, map[string]interface{}) {
+	t.Helper()
+	body, err := json.Marshal(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest("POST", s.URL, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Amz-Target", target)
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential=AKIATEST/20200101/us-east-1/secretsmanager/aws4_request, SignedHeaders=host, Signature=x")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var out map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, out
+}
+
+// callQuery makes a query protocol call, as STS clients do, returning the
+// status and raw body.
+func callQuery(t *testing.T, s *Server, form url.Values) (int, []byte) {
+	t.Helper()
+	resp, err := http.Post(s.URL, "application/x-www-form-urlencoded", strings.NewReader(form.Encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, body
+}
+
+func TestErrorShapes(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	s.PutSecretString("db", `{"password":"hunter2"}`)
+
+	status, body := callJSON(t, s, "secretsmanager.GetSecretValue", map[string]interface{}{"SecretId": "missing"})
+	if status != http.StatusBadRequest || body["__type"] != ErrCodeResourceNotFound {
+		t.Errorf("expected a 400 %s, got %d %v", ErrCodeResourceNotFound, status, body)
+	}
+	status, body = callJSON(t, s, "AmazonSSM.GetParameter", map[string]interface{}{"Name": "/missing"})
+	if status != http.StatusBadRequest || body["__type"] != ErrCodeParameterNotFound {
+		t.Errorf("expected a 400 %s, got %d %v", ErrCodeParameterNotFound, status, body)
+	}
+
+	// injected failures come first, in order, then calls succeed again
+	s.FailNext("GetSecretValue", ErrCodeInternal, 1)
+	s.FailNext("GetSecretValue", ErrCodeAccessDenied, 1)
+	for _, expected := range []struct {
+		status int
+		code   string
+	}{
+		{http.StatusInternalServerError, ErrCodeInternal},
+		{http.StatusForbidden, ErrCodeAccessDenied},
+		{http.StatusOK, ""},
+	} {
+		status, body := callJSON(t, s, "secretsmanager.GetSecretValue", map[string]interface{}{"SecretId": "db"})
+		if status != expected.status || expected.code != "" && body["__type"] != expected.code {
+			t.Errorf("expected %d %s, got %d %v", expected.status, expected.code, status, body)
+		}
+	}
+	if calls := s.Calls("GetSecretValue"); calls != 4 {
+		t.Errorf("expected 4 calls counting the failures, got %d", calls)
+	}
+
+	// STS errors are XML
+	s.FailNext("AssumeRole", ErrCodeThrottling, 1)
+	status, raw := callQuery(t, s, url.Values{"Action": {"AssumeRole"}, "RoleArn": {"arn:aws:iam::210987654321:role/reader"}, "RoleSessionName": {"test"}})
+	var errorResponse struct {
+		Code string `xml:"Error>Code"`
+	}
+	if err := xml.Unmarshal(raw, &errorResponse); err != nil {
+		t.Fatal(err)
+	}
+	if status != http.StatusBadRequest || errorResponse.Code != ErrCodeThrottling {
+		t.Errorf("expected a 400 %s, got %d %s", ErrCodeThrottling, status, raw)
+	}
+
+	status, body = callJSON(t, s, "secretsmanager.ListSecrets", nil)
+	if status != http.StatusBadRequest || body["__type"] != "UnknownOperationException" {
+		t.Errorf("expected an unknown operation, got %d %v", status, body)
+	}
+}
+
+func TestGetParametersByPath(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	var expected []string
+	for i := 0; i < 25; i++ {
+		name := fmt.Sprintf("/app/p%02d", i)
+		s.PutParameter(name, TypeString, "v")
+		expected = append(expected, name)
+	}
+	s.PutParameter("/app/nested/p", TypeSecureString, "secret")
+	s.PutParameter("/other/p", TypeString, "v")
+
+	// fetch pages the way the SDK's paginator does
+	list := func(params map[string]interface{}) ([]string, int) {
+		var names []string
+		pages := 0
+		for {
+			status, body := callJSON(t, s, "AmazonSSM.GetParametersByPath", params)
+			if status != http.StatusOK {
+				t.Fatalf("unexpected %d %v", status, body)
+			}
+			pages++
+			for _, p := range body["Parameters"].([]interface{}) {
+				names = append(names, p.(map[string]interface{})["Name"].(string))
+			}
+			token, ok := body["NextToken"].(string)
+			if !ok {
+				return names, pages
+			}
+			params["NextToken"] = token
+		}
+	}
+
+	names, pages := list(map[string]interface{}{"Path": "/app"})
+	if !reflect.DeepEqual(names, expected) || pages != 3 {
+		t.Errorf("expected %v in 3 pages, got %v in %d", expected, names, pages)
+	}
+	names, pages = list(map[string]interface{}{"Path": "/app/", "MaxResults": 7})
+	if !reflect.DeepEqual(names, expected) || pages != 4 {
+		t.Errorf("expected %v in 4 pages, got %v in %d", expected, names, pages)
+	}
+	names, _ = list(map[string]interface{}{"Path": "/app", "Recursive": true})
+	if len(names) != 26 || names[25] != "/app/p24" || names[0] != "/app/nested/p" {
+		t.Errorf("expected the nested parameter too, got %v", names)
+	}
+
+	// secure strings are only decrypted when asked to
+	for decrypt, expected := range map[bool]string{false: "encrypted:/app/nested/p", true: "secret"} {
+		_, body := callJSON(t, s, "AmazonSSM.GetParametersByPath", map[string]interface{}{"Path": "/app/nested", "WithDecryption": decrypt})
+		value := body["Parameters"].([]interface{})[0].(map[string]interface{})["Value"]
+		if value != expected {
+			t.Errorf("decrypt %v: expected %q, got %v", decrypt, expected, value)
+		}
+	}
+}
+
+func TestSecretVersionStages(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	arn, v1 := s.PutSecretString("db", "one")
+	_, v2 := s.PutSecretString("db", "two")
+	_, v3 := s.PutSecretString("db", "three", "AWSPENDING")
+
+	value := func(params map[string]interface{}) (string, string) {
+		t.Helper()
+		status, body := callJSON(t, s, "secretsmanager.GetSecretValue", params)
+		if status != http.StatusOK {
+			t.Fatalf("%v: unexpected %d %v", params, status, body)
+		}
+		return body["SecretString"].(string), body["VersionId"].(string)
+	}
+	for _, testcase := range []struct {
+		params  map[string]interface{}
+		value   string
+		version string
+	}{
+		{map[string]interface{}{"SecretId": "db"}, "two", v2},
+		{map[string]interface{}{"SecretId": arn}, "two", v2},
+		{map[string]interface{}{"SecretId": arn[:strings.LastIndex(arn, "-")]}, "two", v2},
+		{map[string]interface{}{"SecretId": "db", "VersionStage": "AWSPREVIOUS"}, "one", v1},
+		{map[string]interface{}{"SecretId": "db", "VersionStage": "AWSPENDING"}, "three", v3},
+		{map[string]interface{}{"SecretId": "db", "VersionId": v1}, "one", v1},
+	} {
+		if got, version := value(testcase.params); got != testcase.value || version != testcase.version {
+			t.Errorf("%v: expected %s (%s), got %s (%s)", testcase.params, testcase.value, testcase.version, got, version)
+		}
+	}
+	status, body := callJSON(t, s, "secretsmanager.GetSecretValue", map[string]interface{}{"SecretId": "db", "VersionId": v1, "VersionStage": "AWSCURRENT"})
+	if status != http.StatusBadRequest || body["__type"] != ErrCodeResourceNotFound {
+		t.Errorf("expected a version and a stage that don't match to be not found, got %d %v", status, body)
+	}
+
+	_, body = callJSON(t, s, "secretsmanager.DescribeSecret", map[string]interface{}{"SecretId": "db"})
+	expected := map[string]interface{}{
+		v1: []interface{}{"AWSPREVIOUS"},
+		v2: []interface{}{"AWSCURRENT"},
+		v3: []interface{}{"AWSPENDING"},
+	}
+	if !reflect.DeepEqual(body["VersionIdsToStages"], expected) {
+		t.Errorf("expected stages %v, got %v", expected, body["VersionIdsToStages"])
+	}
+
+	// a new current version moves AWSPREVIOUS along
+	_, v4 := s.PutSecretString("db", "four")
+	_, body = callJSON(t, s, "secretsmanager.DescribeSecret", map[string]interface{}{"SecretId": "db"})
+	expected = map[string]interface{}{
+		v2: []interface{}{"AWSPREVIOUS"},
+		v3: []interface{}{"AWSPENDING"},
+		v4: []interface{}{"AWSCURRENT"},
+	}
+	if !reflect.DeepEqual(body["VersionIdsToStages"], expected) {
+		t.Errorf("expected stages %v, got %v", expected, body["VersionIdsToStages"])
+	}
+
+	s.PutSecretBinary("tls", []byte{0, 1, 2})
+	_, body = callJSON(t, s, "secretsmanager.GetSecretValue", map[string]interface{}{"SecretId": "tls"})
+	if body["SecretBinary"] != base64.StdEncoding.EncodeToString([]byte{0, 1, 2}) {
+		t.Errorf("expected the binary base64 encoded, got %v", body)
+	}
+
+	s.DeleteSecret("db")
+	if status, _ := callJSON(t, s, "secretsmanager.GetSecretValue", map[string]interface{}{"SecretId": "db"}); status != http.StatusBadRequest {
+		t.Errorf("expected the deleted secret to be gone, got %d", status)
+	}
+}
+
+func TestAssumeRole(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+
+	status, raw := callQuery(t, s, url.Values{
+		"Action":          {"AssumeRole"},
+		"RoleArn":         {"arn:aws:iam::210987654321:role/reader"},
+		"RoleSessionName": {"injector"},
+	})
+	var response assumeRoleResponse
+	if err := xml.Unmarshal(raw, &response); err != nil {
+		t.Fatal(err)
+	}
+	if status != http.StatusOK || !strings.HasPrefix(response.Result.Credentials.AccessKeyID, AssumedKeyPrefix) {
+		t.Errorf("expected credentials from AssumeRole, got %d %s", status, raw)
+	}
+	if arn := response.Result.AssumedRoleUser.Arn; arn != "arn:aws:sts::210987654321:assumed-role/reader/injector" {
+		t.Errorf("expected the role assumed in its account, got %s", arn)
+	}
+
+	for _, form := range []url.Values{
+		{"Action": {"AssumeRole"}, "RoleArn": {"reader"}, "RoleSessionName": {"injector"}},
+		{"Action": {"AssumeRole"}, "RoleArn": {"arn:aws:iam::210987654321:role/reader"}},
+	} {
+		if status, raw := callQuery(t, s, form); status != http.StatusBadRequest || !strings.Contains(string(raw), "ValidationError") {
+			t.Errorf("%v: expected a validation error, got %d %s", form, status, raw)
+		}
+	}
+
+	// requests record the key they were signed with
+	callJSON(t, s, "secretsmanager.DescribeSecret", map[string]interface{}{"SecretId": "missing"})
+	requests := s.Requests()
+	last := requests[len(requests)-1]
+	if last.Action != "DescribeSecret" || last.AccessKeyID != "AKIATEST" || last.Params["SecretId"] != "missing" {
+		t.Errorf("unexpected request %+v", last)
+	}
+	if requests[0].Action != "AssumeRole" || requests[0].Params["RoleSessionName"] != "injector" {
+		t.Errorf("unexpected request %+v", requests[0])
+	}
+}
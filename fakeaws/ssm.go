@@ -0,0 +1,156 @@
+package fakeaws
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// error codes of parameter store
+const (
+	ErrCodeParameterNotFound        = "ParameterNotFound"
+	ErrCodeParameterVersionNotFound = "ParameterVersionNotFound"
+)
+
+// parameter types
+const (
+	TypeString       = "String"
+	TypeStringList   = "StringList"
+	TypeSecureString = "SecureString"
+)
+
+// most parameters parameter store returns in one page of
+// GetParametersByPath
+const maxPathResults = 10
+
+type parameter struct {
+	name     string
+	kind     string
+	versions []string
+	labels   map[string]int
+}
+
+// PutParameter adds a version of the named parameter and returns its
+// version number, starting at 1. The parameter is created if needed.
+// SecureString values are only returned when decryption is asked for.
+func (s *Server) PutParameter(name, kind, value string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	param, ok := s.parameters[name]
+	if !ok {
+		param = &parameter{name: name, labels: map[string]int{}}
+		s.parameters[name] = param
+	}
+	param.kind = kind
+	param.versions = append(param.versions, value)
+	return len(param.versions)
+}
+
+// LabelParameter attaches a label to a version of the named parameter,
+// moving it off any other version.
+func (s *Server) LabelParameter(name string, version int, label string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if param, ok := s.parameters[name]; ok {
+		param.labels[label] = version
+	}
+}
+
+func (s *Server) parameterARN(name string) string {
+	return fmt.Sprintf("arn:aws:ssm:%s:%s:parameter/%s", s.Region, s.Account, strings.TrimPrefix(name, "/"))
+}
+
+// parameterValue is a parameter as returned by parameter store
+func (s *Server) parameterValue(param *parameter, version int, decrypt bool) map[string]interface{} {
+	value := param.versions[version-1]
+	if param.kind == TypeSecureString && !decrypt {
+		value = "encrypted:" + param.name
+	}
+	return map[string]interface{}{
+		"ARN":     s.parameterARN(param.name),
+		"Name":    param.name,
+		"Type":    param.kind,
+		"Value":   value,
+		"Version": version,
+	}
+}
+
+func (s *Server) getParameter(w http.ResponseWriter, req Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	name := stringParam(req, "Name")
+	if strings.HasPrefix(name, "arn:") {
+		name = "/" + name[strings.Index(name, ":parameter/")+len(":parameter/"):]
+	}
+	// name:version or name:label picks a version, the latest otherwise
+	var selector string
+	if i := strings.LastIndex(name, ":"); i >= 0 {
+		name, selector = name[:i], name[i+1:]
+	}
+
+	param, ok := s.parameters[name]
+	if !ok {
+		writeJSONError(w, ErrCodeParameterNotFound, "")
+		return
+	}
+	version := len(param.versions)
+	if selector != "" {
+		var err error
+		if version, err = strconv.Atoi(selector); err != nil {
+			version = param.labels[selector]
+		}
+		if version < 1 || version > len(param.versions) {
+			writeJSONError(w, ErrCodeParameterVersionNotFound, "Systems Manager could not find version "+selector+" of "+name)
+			return
+		}
+	}
+	decrypt, _ := req.Params["WithDecryption"].(bool)
+	writeJSON(w, map[string]interface{}{"Parameter": s.parameterValue(param, version, decrypt)})
+}
+
+func (s *Server) getParametersByPath(w http.ResponseWriter, req Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	path := strings.TrimSuffix(stringParam(req, "Path"), "/") + "/"
+	recursive, _ := req.Params["Recursive"].(bool)
+	decrypt, _ := req.Params["WithDecryption"].(bool)
+
+	var names []string
+	for name := range s.parameters {
+		if !strings.HasPrefix(name, path) {
+			continue
+		}
+		if !recursive && strings.Contains(name[len(path):], "/") {
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	start, _ := strconv.Atoi(stringParam(req, "NextToken"))
+	if start > len(names) {
+		start = len(names)
+	}
+	end := start + maxPathResults
+	if max, ok := req.Params["MaxResults"].(float64); ok && int(max) < maxPathResults {
+		end = start + int(max)
+	}
+	response := map[string]interface{}{}
+	if end < len(names) {
+		response["NextToken"] = strconv.Itoa(end)
+	} else {
+		end = len(names)
+	}
+	params := []interface{}{}
+	for _, name := range names[start:end] {
+		param := s.parameters[name]
+		params = append(params, s.parameterValue(param, len(param.versions), decrypt))
+	}
+	response["Parameters"] = params
+	writeJSON(w, response)
+}
@@ -0,0 +1,108 @@
+package fakeaws
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const stsNamespace = "https://sts.amazonaws.com/doc/2011-06-15/"
+
+type stsCredentials struct {
+	AccessKeyID     string `xml:"AccessKeyId"`
+	SecretAccessKey string `xml:"SecretAccessKey"`
+	SessionToken    string `xml:"SessionToken"`
+	Expiration      string `xml:"Expiration"`
+}
+
+type assumedRoleUser struct {
+	Arn           string `xml:"Arn"`
+	AssumedRoleID string `xml:"AssumedRoleId"`
+}
+
+type assumeRoleResponse struct {
+	XMLName xml.Name `xml:"AssumeRoleResponse"`
+	Xmlns   string   `xml:"xmlns,attr"`
+	Result  struct {
+		Credentials     stsCredentials  `xml:"Credentials"`
+		AssumedRoleUser assumedRoleUser `xml:"AssumedRoleUser"`
+	} `xml:"AssumeRoleResult"`
+	RequestID string `xml:"ResponseMetadata>RequestId"`
+}
+
+type getCallerIdentityResponse struct {
+	XMLName xml.Name `xml:"GetCallerIdentityResponse"`
+	Xmlns   string   `xml:"xmlns,attr"`
+	Result  struct {
+		Arn     string `xml:"Arn"`
+		UserID  string `xml:"UserId"`
+		Account string `xml:"Account"`
+	} `xml:"GetCallerIdentityResult"`
+	RequestID string `xml:"ResponseMetadata>RequestId"`
+}
+
+// AssumedKeyPrefix starts the access key id of every set of credentials
+// handed out by AssumeRole, so tests can tell which calls used them.
+const AssumedKeyPrefix = "ASIAFAKE"
+
+func (s *Server) handleQuery(w http.ResponseWriter, action string, query url.Values) {
+	switch action {
+	case "AssumeRole":
+		s.assumeRole(w, query)
+	case "GetCallerIdentity":
+		var response getCallerIdentityResponse
+		response.Xmlns = stsNamespace
+		response.Result.Arn = fmt.Sprintf("arn:aws:iam::%s:user/fake", s.Account)
+		response.Result.UserID = "AIDAFAKE"
+		response.Result.Account = s.Account
+		response.RequestID = "fake"
+		writeXML(w, response)
+	default:
+		writeQueryError(w, "InvalidAction", action)
+	}
+}
+
+func (s *Server) assumeRole(w http.ResponseWriter, query url.Values) {
+	roleArn := query.Get("RoleArn")
+	sessionName := query.Get("RoleSessionName")
+	if !strings.HasPrefix(roleArn, "arn:") || !strings.Contains(roleArn, ":role/") || sessionName == "" {
+		writeQueryError(w, "ValidationError", "invalid role ARN or session name")
+		return
+	}
+
+	s.mu.Lock()
+	id := s.nextID()
+	s.mu.Unlock()
+
+	// the assumed role lives in the role's account
+	account := strings.Split(roleArn, ":")[4]
+	role := roleArn[strings.Index(roleArn, ":role/")+len(":role/"):]
+
+	var response assumeRoleResponse
+	response.Xmlns = stsNamespace
+	response.Result.Credentials = stsCredentials{
+		AccessKeyID:     fmt.Sprintf("%s%08d", AssumedKeyPrefix, id),
+		SecretAccessKey: "fake-secret-access-key",
+		SessionToken:    "fake-session-token",
+		Expiration:      time.Now().Add(time.Hour).UTC().Format(time.RFC3339),
+	}
+	response.Result.AssumedRoleUser = assumedRoleUser{
+		Arn:           fmt.Sprintf("arn:aws:sts::%s:assumed-role/%s/%s", account, role, sessionName),
+		AssumedRoleID: "AROAFAKE:" + sessionName,
+	}
+	response.RequestID = "fake"
+	writeXML(w, response)
+}
+
+func writeXML(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "text/xml")
+	data, err := xml.Marshal(value)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(data)
+}
@@ -3,6 +3,10 @@ module main
 go 1.13
 
 require (
+	github.com/aws-samples/aws-secret-sidecar-injector/fakeaws v0.0.0
 	github.com/aws/aws-sdk-go v1.30.27
+	gopkg.in/yaml.v2 v2.2.8
 	k8s.io/api v0.20.4
 )
+
+replace github.com/aws-samples/aws-secret-sidecar-injector/fakeaws => ./fakeaws